@@ -19,20 +19,28 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	mgmtapi "kmodules.xyz/resource-metadata/apis/management/v1alpha1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	managementv1alpha1 "github.com/tamalsaha/rancid-syncer/api/management/v1alpha1"
+	"github.com/tamalsaha/rancid-syncer/federate"
 	managementcontroller "github.com/tamalsaha/rancid-syncer/internal/controller/management"
+	monitoringcontroller "github.com/tamalsaha/rancid-syncer/internal/controller/monitoring"
+	"github.com/tamalsaha/rancid-syncer/quota"
+	"github.com/tamalsaha/rancid-syncer/tenancy"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -44,7 +52,10 @@ var (
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
+	utilruntime.Must(monitoringv1.AddToScheme(scheme))
+
 	utilruntime.Must(managementv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(mgmtapi.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -52,11 +63,27 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var tricksterServer string
+	var federateNamespaces string
+	var defaultPrometheus string
+	var enableQuotaWebhook bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&tricksterServer, "trickster-apiserver-url", "",
+		"The api server url written into trickster kubeconfigs. Defaults to the host the manager connects to.")
+	flag.StringVar(&federateNamespaces, "federate-allowed-namespaces", "",
+		"Comma separated namespaces federated by monitors selecting any namespace. Defaults to all namespaces.")
+	flag.StringVar(&defaultPrometheus, "default-prometheus", "",
+		"The cluster Prometheus as namespace/name. Defaults to the Rancher monitoring Prometheus.")
+	flag.StringVar(&tenancy.NamespaceLabelKey, "tenant-namespace-label", "",
+		"Namespace label that groups namespaces into tenants. Defaults to the Rancher project on Rancher clusters.")
+	flag.BoolVar(&enableQuotaWebhook, "enable-quota-webhook", false,
+		"Serve the validating webhook that enforces ProjectQuota limits. Enforcement is best-effort: "+
+			"usage comes from the last reconciled ProjectQuota status, so a burst of creates can exceed a limit. "+
+			"The webhook has failurePolicy=Ignore, so objects are admitted unchecked while it is unavailable.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,7 +92,24 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	if federateNamespaces != "" {
+		federate.AllowedNamespaces = strings.Split(federateNamespaces, ",")
+	}
+	if defaultPrometheus != "" {
+		key, err := tenancy.ParsePrometheusKey(defaultPrometheus)
+		if err != nil {
+			setupLog.Error(err, "invalid flag")
+			os.Exit(1)
+		}
+		tenancy.DefaultPrometheus = key
+	}
+
+	cfg := ctrl.GetConfigOrDie()
+	if tricksterServer == "" {
+		tricksterServer = cfg.Host
+	}
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		HealthProbeBindAddress: probeAddr,
@@ -95,6 +139,50 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "Project")
 		os.Exit(1)
 	}
+	if err = (&monitoringcontroller.TricksterReconciler{
+		Client: mgr.GetClient(),
+		Server: tricksterServer,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Trickster")
+		os.Exit(1)
+	}
+	if err = (&monitoringcontroller.FederateReconciler{
+		Client:   mgr.GetClient(),
+		Recorder: mgr.GetEventRecorderFor("federate"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Federate")
+		os.Exit(1)
+	}
+	if err = (&monitoringcontroller.PodMonitorFederateReconciler{
+		Client:   mgr.GetClient(),
+		Recorder: mgr.GetEventRecorderFor("federate"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PodMonitorFederate")
+		os.Exit(1)
+	}
+	if err = (&monitoringcontroller.PrometheusRuleFederateReconciler{
+		Client: mgr.GetClient(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PrometheusRuleFederate")
+		os.Exit(1)
+	}
+	if err = (&monitoringcontroller.ProjectIDReconciler{
+		Client: mgr.GetClient(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ProjectID")
+		os.Exit(1)
+	}
+	if err = (&monitoringcontroller.PodMonitorProjectIDReconciler{
+		Client: mgr.GetClient(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PodMonitorProjectID")
+		os.Exit(1)
+	}
+	if enableQuotaWebhook {
+		mgr.GetWebhookServer().Register(quota.ValidatorPath, &webhook.Admission{
+			Handler: quota.NewValidator(mgr.GetClient()),
+		})
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
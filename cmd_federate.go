@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/tamalsaha/rancid-syncer/federate"
+)
+
+func newFederateCmd(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "federate",
+		Short: "Inspect ServiceMonitor federation into project Prometheus",
+	}
+
+	var namespace string
+	var allowedNamespaces []string
+	plan := &cobra.Command{
+		Use:   "plan SERVICE_MONITOR",
+		Short: "Show what federating a ServiceMonitor changes, diffed against the live cluster",
+		Long: "Run the federator for the ServiceMonitor against the api server in dry-run mode, as if it were\n" +
+			"labeled for federation, and show every object it would create, patch or delete.\n\n" +
+			"The plan can't read the flags of the running manager. Pass the value of its\n" +
+			"--federate-allowed-namespaces flag as --allowed-namespaces, or the plan assumes all namespaces.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			federate.AllowedNamespaces = allowedNamespaces
+
+			_, _, kc, err := opts.clients()
+			if err != nil {
+				return err
+			}
+			p, err := federate.NewPlan(context.TODO(), kc, types.NamespacedName{Namespace: namespace, Name: args[0]})
+			if err != nil {
+				return err
+			}
+			return opts.print(os.Stdout, p, func(w io.Writer) {
+				if len(p.AllowedNamespaces) > 0 {
+					fmt.Fprintf(w, "allowed namespaces: %s\n\n", strings.Join(p.AllowedNamespaces, ","))
+				}
+				fmt.Fprintln(w, "PROMETHEUS\tACTION\tNAMESPACE\tKEEP\tREASON")
+				for _, t := range p.Targets {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Prometheus, t.Action, t.Namespace, t.KeepRegex, t.Reason)
+				}
+				fmt.Fprintln(w)
+				fmt.Fprintln(w, "CHANGE\tOBJECT")
+				for _, c := range p.Changes {
+					fmt.Fprintf(w, "%s\t%s\n", c.Action, c.Object)
+				}
+				for _, c := range p.Changes {
+					if c.Diff == "" {
+						continue
+					}
+					// the tab writer would align the indentation of the diff
+					fmt.Fprintf(w, "\n--- %s %s\n%s", c.Action, c.Object, strings.ReplaceAll(c.Diff, "\t", "  "))
+				}
+				if p.Error != "" {
+					fmt.Fprintf(w, "\nerror: %s\n", p.Error)
+				}
+			})
+		},
+	}
+	plan.Flags().StringVarP(&namespace, "namespace", "n", "default", "Namespace of the ServiceMonitor.")
+	plan.Flags().StringSliceVar(&allowedNamespaces, "allowed-namespaces", nil, "Namespaces federated by monitors selecting any namespace, as set by --federate-allowed-namespaces of the manager. Defaults to all namespaces.")
+
+	cmd.AddCommand(plan)
+	return cmd
+}
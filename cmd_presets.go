@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	chartsapi "x-helm.dev/apimachinery/apis/charts/v1alpha1"
+
+	"github.com/tamalsaha/rancid-syncer/presets"
+)
+
+func newPresetsCmd(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "presets",
+		Short: "Inspect chart presets",
+	}
+
+	var ref chartsapi.ChartPresetFlatRef
+	resolve := &cobra.Command{
+		Use:   "resolve",
+		Short: "Show the chart presets, in merge order, that apply to an editor variant in a namespace",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, _, kc, err := opts.clients()
+			if err != nil {
+				return err
+			}
+			values, err := presets.LoadPresetValues(kc, ref)
+			if err != nil {
+				return err
+			}
+			return opts.print(os.Stdout, values, func(w io.Writer) {
+				fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME")
+				for _, v := range values {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", v.Source.Resource.Kind, v.Source.Ref.Namespace, v.Source.Ref.Name)
+				}
+			})
+		},
+	}
+	flags := resolve.Flags()
+	flags.StringVar(&ref.Group, "group", ref.Group, "API group of the editor resource.")
+	flags.StringVar(&ref.Resource, "resource", ref.Resource, "Resource name of the editor, eg. prometheuses.")
+	flags.StringVar(&ref.Kind, "kind", ref.Kind, "Kind of the editor resource. Used when --resource is not set.")
+	flags.StringVar(&ref.Variant, "variant", ref.Variant, "Editor variant whose selector picks the presets.")
+	flags.StringVarP(&ref.Namespace, "namespace", "n", ref.Namespace, "Namespace the chart is installed in. Only cluster presets are used if empty.")
+	_ = resolve.MarkFlagRequired("variant")
+
+	cmd.AddCommand(resolve)
+	return cmd
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/duration"
+	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+
+	"github.com/tamalsaha/rancid-syncer/projects"
+)
+
+func newProjectsCmd(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "projects",
+		Short: "Show Rancher projects as seen by the platform",
+	}
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "list",
+			Short: "List Rancher projects",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				_, _, kc, err := opts.clients()
+				if err != nil {
+					return err
+				}
+				prjs, err := projects.ListRancherProjects(kc)
+				if err != nil {
+					return err
+				}
+				return opts.print(os.Stdout, prjs, func(w io.Writer) {
+					printProjects(w, prjs...)
+				})
+			},
+		},
+		&cobra.Command{
+			Use:   "get PROJECT_ID",
+			Short: "Show a Rancher project",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				_, _, kc, err := opts.clients()
+				if err != nil {
+					return err
+				}
+				prj, err := projects.GetRancherProject(kc, args[0])
+				if err != nil {
+					return err
+				}
+				return opts.print(os.Stdout, prj, func(w io.Writer) {
+					printProjects(w, *prj)
+				})
+			},
+		},
+	)
+	return cmd
+}
+
+func printProjects(w io.Writer, prjs ...rscoreapi.Project) {
+	fmt.Fprintln(w, "NAME\tTYPE\tNAMESPACES\tPROMETHEUS\tPRESETS\tAGE")
+	for _, prj := range prjs {
+		prom := "<none>"
+		if prj.Spec.Monitoring != nil && prj.Spec.Monitoring.PrometheusRef != nil {
+			prom = prj.Spec.Monitoring.PrometheusRef.Namespace + "/" + prj.Spec.Monitoring.PrometheusRef.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\n",
+			prj.Name,
+			prj.Spec.Type,
+			len(prj.Spec.Namespaces),
+			prom,
+			len(prj.Spec.Presets),
+			duration.HumanDuration(time.Since(prj.CreationTimestamp.Time)))
+	}
+}
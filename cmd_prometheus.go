@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+	"github.com/tamalsaha/rancid-syncer/trickster"
+)
+
+func newPrometheusCmd(opts *rootOptions) *cobra.Command {
+	var key types.NamespacedName
+	// resolveKey defaults the Prometheus to the cluster Prometheus.
+	resolveKey := func() {
+		def := tenancy.DefaultPrometheusKey()
+		if key.Namespace == "" {
+			key.Namespace = def.Namespace
+		}
+		if key.Name == "" {
+			key.Name = def.Name
+		}
+	}
+
+	cmd := &cobra.Command{
+		Use:   "prometheus",
+		Short: "Connect a Prometheus to the platform",
+	}
+	cmd.PersistentFlags().StringVarP(&key.Namespace, "namespace", "n", "", "Namespace of the Prometheus. Defaults to the namespace of the default Prometheus.")
+	cmd.PersistentFlags().StringVar(&key.Name, "name", "", "Name of the Prometheus. Defaults to the default Prometheus.")
+
+	var allInProject bool
+	setupCmd := &cobra.Command{
+		Use:   "setup",
+		Short: "Create the trickster service account, presets and AppBindings for a Prometheus and print its connection config",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolveKey()
+			cfg, rmc, kc, err := opts.clients()
+			if err != nil {
+				return err
+			}
+			if allInProject {
+				pcfgs, err := SetupProjectPrometheuses(cfg, kc, rmc, key)
+				if err != nil {
+					return err
+				}
+				return opts.print(os.Stdout, pcfgs, func(w io.Writer) {
+					printPrometheusConfig(w, pcfgs...)
+				})
+			}
+			pcfg, err := SetupClusterForPrometheus(cfg, kc, rmc, key)
+			if err != nil {
+				return err
+			}
+			return opts.print(os.Stdout, pcfg, func(w io.Writer) {
+				printPrometheusConfig(w, pcfg)
+			})
+		},
+	}
+	setupCmd.Flags().BoolVar(&allInProject, "all-in-project", false, "Set up every Prometheus in the project of the Prometheus, primary first.")
+
+	dryRun := true
+	var byName bool
+	teardownCmd := &cobra.Command{
+		Use:   "teardown",
+		Short: "Remove everything prometheus setup created for a Prometheus",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolveKey()
+			_, _, kc, err := opts.clients()
+			if err != nil {
+				return err
+			}
+			return Teardown(kc, key, byName, dryRun)
+		},
+	}
+	teardownCmd.Flags().BoolVar(&dryRun, "dry-run", dryRun, "Only list the objects that would be removed.")
+	teardownCmd.Flags().BoolVar(&byName, "by-name", false, "Also remove objects that are not labeled as created by prometheus setup, found by their well-known names.")
+
+	cmd.AddCommand(
+		setupCmd,
+		teardownCmd,
+		&cobra.Command{
+			Use:   "config",
+			Short: "Print the connection config of a Prometheus that is already set up",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				resolveKey()
+				cfg, rmc, kc, err := opts.clients()
+				if err != nil {
+					return err
+				}
+				pcfg, err := GetPrometheusConfig(cfg, kc, rmc, key)
+				if err != nil {
+					return err
+				}
+				return opts.print(os.Stdout, pcfg, func(w io.Writer) {
+					printPrometheusConfig(w, pcfg)
+				})
+			},
+		},
+		&cobra.Command{
+			Use:   "kubeconfig",
+			Short: "Print the kubeconfig of the trickster service account for a Prometheus that is already set up",
+			Long: "Print the kubeconfig stored in the trickster-kubeconfig Secret next to the Prometheus.\n" +
+				"The kubeconfig is always printed as yaml; -o is ignored.",
+			Args: cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				resolveKey()
+				_, _, kc, err := opts.clients()
+				if err != nil {
+					return err
+				}
+				var s core.Secret
+				err = kc.Get(context.TODO(), client.ObjectKey{Namespace: key.Namespace, Name: trickster.KubeconfigSecretName}, &s)
+				if err != nil {
+					return err
+				}
+				_, err = os.Stdout.Write(s.Data[trickster.KubeconfigKey])
+				return err
+			},
+		},
+	)
+	return cmd
+}
+
+func printPrometheusConfig(w io.Writer, pcfgs ...*mona.PrometheusConfig) {
+	fmt.Fprintln(w, "SERVICE\tPORT\tURL\tTOKEN")
+	for _, pcfg := range pcfgs {
+		token := "<none>"
+		if pcfg.BearerToken != "" {
+			token = "<set>"
+		}
+		fmt.Fprintf(w, "%s/%s\t%s\t%s\t%s\n", pcfg.Service.Namespace, pcfg.Service.Name, pcfg.Service.Port, pcfg.URL, token)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	core "k8s.io/api/core/v1"
+	"k8s.io/client-go/discovery"
+	mgmtapi "kmodules.xyz/resource-metadata/apis/management/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/quota"
+)
+
+func newQuotaCmd(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "quota",
+		Short: "Inspect project quotas",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "usage PROJECT_ID",
+		Short: "Calculate the current usage of a ProjectQuota without updating its status",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, _, kc, err := opts.clients()
+			if err != nil {
+				return err
+			}
+			disc, err := discovery.NewDiscoveryClientForConfig(cfg)
+			if err != nil {
+				return err
+			}
+
+			var pj mgmtapi.ProjectQuota
+			if err := kc.Get(context.TODO(), client.ObjectKey{Name: args[0]}, &pj); err != nil {
+				return err
+			}
+			if err := quota.NewReconciler(kc, disc).CalculateStatus(&pj); err != nil {
+				return err
+			}
+			return opts.print(os.Stdout, pj.Status, func(w io.Writer) {
+				fmt.Fprintln(w, "GROUP\tKIND\tRESULT\tHARD\tUSED")
+				for _, q := range pj.Status.Quotas {
+					kind := q.Kind
+					if kind == "" {
+						kind = "*"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", q.Group, kind, q.Result, formatResourceList(q.Hard), formatResourceList(q.Used))
+				}
+			})
+		},
+	})
+	return cmd
+}
+
+func formatResourceList(rl core.ResourceList) string {
+	if len(rl) == 0 {
+		return "<none>"
+	}
+	parts := make([]string, 0, len(rl))
+	for name, q := range rl {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, q.String()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
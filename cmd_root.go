@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"kmodules.xyz/resource-metadata/client/clientset/versioned"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+const (
+	outputYAML  = "yaml"
+	outputJSON  = "json"
+	outputTable = "table"
+)
+
+type rootOptions struct {
+	kubeconfig  string
+	kubecontext string
+	output      string
+
+	defaultPrometheus string
+}
+
+func NewRootCmd() *cobra.Command {
+	opts := &rootOptions{}
+	cmd := &cobra.Command{
+		Use:          "rancid-syncer",
+		Short:        "Inspect and set up Rancher projects, monitoring, presets and quotas",
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if opts.defaultPrometheus != "" {
+				key, err := tenancy.ParsePrometheusKey(opts.defaultPrometheus)
+				if err != nil {
+					return err
+				}
+				tenancy.DefaultPrometheus = key
+			}
+
+			switch opts.output {
+			case outputYAML, outputJSON, outputTable:
+				return nil
+			}
+			return fmt.Errorf("unknown output format %q, must be one of yaml, json, table", opts.output)
+		},
+	}
+
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&opts.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file. Defaults to $KUBECONFIG or ~/.kube/config.")
+	flags.StringVar(&opts.kubecontext, "context", "", "The kubeconfig context to use.")
+	flags.StringVarP(&opts.output, "output", "o", outputTable, "Output format. One of yaml, json, table.")
+	flags.StringVar(&opts.defaultPrometheus, "default-prometheus", "", "The cluster Prometheus as namespace/name. Defaults to the Rancher monitoring Prometheus.")
+	flags.StringVar(&tenancy.NamespaceLabelKey, "tenant-namespace-label", "", "Namespace label that groups namespaces into tenants. Defaults to the Rancher project on Rancher clusters.")
+
+	cmd.AddCommand(
+		newProjectsCmd(opts),
+		newPrometheusCmd(opts),
+		newPresetsCmd(opts),
+		newQuotaCmd(opts),
+		newFederateCmd(opts),
+	)
+	return cmd
+}
+
+func (o *rootOptions) restConfig() (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: o.kubecontext}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+func (o *rootOptions) clients() (*rest.Config, versioned.Interface, client.Client, error) {
+	cfg, err := o.restConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rmc, kc, err := NewClient(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cfg, rmc, kc, nil
+}
+
+// print writes obj in the selected output format. table writes the rows,
+// header first, for the table format.
+func (o *rootOptions) print(w io.Writer, obj any, table func(w io.Writer)) error {
+	switch o.output {
+	case outputJSON:
+		data, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case outputTable:
+		if table != nil {
+			tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+			table(tw)
+			return tw.Flush()
+		}
+	}
+
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
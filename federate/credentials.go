@@ -0,0 +1,229 @@
+package federate
+
+import (
+	"context"
+
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// endpointSecretRefs returns every Secret reference in e: bearer token,
+// authorization, basic auth, oauth2 and TLS CA, cert and key. The returned
+// pointers point into e, so the references can be rewritten in place.
+func endpointSecretRefs(e *monitoringv1.Endpoint) []*core.SecretKeySelector {
+	var refs []*core.SecretKeySelector
+	add := func(ref *core.SecretKeySelector) {
+		if ref != nil && ref.Name != "" {
+			refs = append(refs, ref)
+		}
+	}
+
+	add(&e.BearerTokenSecret)
+	if e.Authorization != nil {
+		add(e.Authorization.Credentials)
+	}
+	if e.BasicAuth != nil {
+		add(&e.BasicAuth.Username)
+		add(&e.BasicAuth.Password)
+	}
+	if e.OAuth2 != nil {
+		add(e.OAuth2.ClientID.Secret)
+		add(&e.OAuth2.ClientSecret)
+	}
+	if e.TLSConfig != nil {
+		add(e.TLSConfig.CA.Secret)
+		add(e.TLSConfig.Cert.Secret)
+		add(e.TLSConfig.KeySecret)
+	}
+	return refs
+}
+
+// endpointConfigMapRefs returns every ConfigMap reference in e: oauth2 client
+// id and TLS CA and cert.
+func endpointConfigMapRefs(e *monitoringv1.Endpoint) []*core.ConfigMapKeySelector {
+	var refs []*core.ConfigMapKeySelector
+	add := func(ref *core.ConfigMapKeySelector) {
+		if ref != nil && ref.Name != "" {
+			refs = append(refs, ref)
+		}
+	}
+
+	if e.OAuth2 != nil {
+		add(e.OAuth2.ClientID.ConfigMap)
+	}
+	if e.TLSConfig != nil {
+		add(e.TLSConfig.CA.ConfigMap)
+		add(e.TLSConfig.Cert.ConfigMap)
+	}
+	return refs
+}
+
+// credentialCopyName returns the name of the copy of the Secret or ConfigMap
+// ns/name made for the ServiceMonitor named targetName. Every target
+// ServiceMonitor gets its own copy, so each copy has a single owner and is
+// pruned with it.
+func credentialCopyName(targetName, ns, name string) string {
+	return hashedName(name+"-"+ns, targetName+":"+ns+"/"+name)
+}
+
+// renameCredentials points the Secret and ConfigMap references of e, an
+// endpoint copied from namespace ns into the ServiceMonitor named targetName,
+// to the copies of those objects.
+func renameCredentials(e *monitoringv1.Endpoint, ns, targetName string) {
+	for _, ref := range endpointSecretRefs(e) {
+		ref.Name = credentialCopyName(targetName, ns, ref.Name)
+	}
+	for _, ref := range endpointConfigMapRefs(e) {
+		ref.Name = credentialCopyName(targetName, ns, ref.Name)
+	}
+}
+
+// refersTo reports whether any of endpoints refers to the Secret or
+// ConfigMap obj.
+func refersTo(endpoints []monitoringv1.Endpoint, obj client.Object) bool {
+	for i := range endpoints {
+		switch obj.(type) {
+		case *core.Secret:
+			for _, ref := range endpointSecretRefs(&endpoints[i]) {
+				if ref.Name == obj.GetName() {
+					return true
+				}
+			}
+		case *core.ConfigMap:
+			for _, ref := range endpointConfigMapRefs(&endpoints[i]) {
+				if ref.Name == obj.GetName() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// collectCredentials returns the Secrets and ConfigMaps in namespace ns the
+// endpoints refer to.
+func collectCredentials(kc client.Client, ns string, endpoints []monitoringv1.Endpoint) ([]core.Secret, []core.ConfigMap, error) {
+	secretNames := sets.NewString()
+	configMapNames := sets.NewString()
+	for i := range endpoints {
+		for _, ref := range endpointSecretRefs(&endpoints[i]) {
+			secretNames.Insert(ref.Name)
+		}
+		for _, ref := range endpointConfigMapRefs(&endpoints[i]) {
+			configMapNames.Insert(ref.Name)
+		}
+	}
+
+	var secrets []core.Secret
+	for _, name := range secretNames.List() {
+		var secret core.Secret
+		err := kc.Get(context.TODO(), client.ObjectKey{Namespace: ns, Name: name}, &secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+
+	var configMaps []core.ConfigMap
+	for _, name := range configMapNames.List() {
+		var cm core.ConfigMap
+		err := kc.Get(context.TODO(), client.ObjectKey{Namespace: ns, Name: name}, &cm)
+		if err != nil {
+			return nil, nil, err
+		}
+		configMaps = append(configMaps, cm)
+	}
+	return secrets, configMaps, nil
+}
+
+// copyCredentials copies secrets and configMaps next to targetSvcMon and
+// returns the copies.
+func copyCredentials(kc client.Client, secrets []core.Secret, configMaps []core.ConfigMap, targetSvcMon *monitoringv1.ServiceMonitor) ([]client.Object, []error) {
+	var copies []client.Object
+	var errList []error
+	for _, src := range secrets {
+		copies = append(copies, &core.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: targetSvcMon.Namespace, Name: credentialCopyName(targetSvcMon.Name, src.Namespace, src.Name)}})
+
+		if err := copySecret(kc, &src, targetSvcMon); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	for _, src := range configMaps {
+		copies = append(copies, &core.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: targetSvcMon.Namespace, Name: credentialCopyName(targetSvcMon.Name, src.Namespace, src.Name)}})
+
+		if err := copyConfigMap(kc, &src, targetSvcMon); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	return copies, errList
+}
+
+func copySecret(kc client.Client, src *core.Secret, targetSvcMon *monitoringv1.ServiceMonitor) error {
+	target := core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      credentialCopyName(targetSvcMon.Name, src.Namespace, src.Name),
+			Namespace: targetSvcMon.Namespace,
+		},
+	}
+
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Secret)
+
+		ref := metav1.NewControllerRef(targetSvcMon, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "ServiceMonitor",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, trackingLabels(targetSvcMon))
+
+		obj.Data = src.Data
+		obj.Type = src.Type
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s Secret %s/%s", vt, target.Namespace, target.Name)
+	return nil
+}
+
+func copyConfigMap(kc client.Client, src *core.ConfigMap, targetSvcMon *monitoringv1.ServiceMonitor) error {
+	target := core.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      credentialCopyName(targetSvcMon.Name, src.Namespace, src.Name),
+			Namespace: targetSvcMon.Namespace,
+		},
+	}
+
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.ConfigMap)
+
+		ref := metav1.NewControllerRef(targetSvcMon, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "ServiceMonitor",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, trackingLabels(targetSvcMon))
+
+		obj.Data = src.Data
+		obj.BinaryData = src.BinaryData
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s ConfigMap %s/%s", vt, target.Namespace, target.Name)
+	return nil
+}
@@ -0,0 +1,86 @@
+package federate
+
+import (
+	"reflect"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+)
+
+func secretRef(name string) *core.SecretKeySelector {
+	return &core.SecretKeySelector{LocalObjectReference: core.LocalObjectReference{Name: name}, Key: "key"}
+}
+
+func configMapRef(name string) *core.ConfigMapKeySelector {
+	return &core.ConfigMapKeySelector{LocalObjectReference: core.LocalObjectReference{Name: name}, Key: "key"}
+}
+
+func testEndpoint() monitoringv1.Endpoint {
+	return monitoringv1.Endpoint{
+		BearerTokenSecret: *secretRef("token"),
+		Authorization:     &monitoringv1.SafeAuthorization{Credentials: secretRef("authz")},
+		BasicAuth: &monitoringv1.BasicAuth{
+			Username: *secretRef("basic"),
+			Password: *secretRef("basic"),
+		},
+		OAuth2: &monitoringv1.OAuth2{
+			ClientID:     monitoringv1.SecretOrConfigMap{ConfigMap: configMapRef("oauth2-id")},
+			ClientSecret: *secretRef("oauth2-secret"),
+		},
+		TLSConfig: &monitoringv1.TLSConfig{
+			SafeTLSConfig: monitoringv1.SafeTLSConfig{
+				CA:        monitoringv1.SecretOrConfigMap{ConfigMap: configMapRef("ca")},
+				Cert:      monitoringv1.SecretOrConfigMap{Secret: secretRef("cert")},
+				KeySecret: secretRef("key"),
+			},
+		},
+	}
+}
+
+func TestEndpointCredentialRefs(t *testing.T) {
+	e := testEndpoint()
+
+	var secrets []string
+	for _, ref := range endpointSecretRefs(&e) {
+		secrets = append(secrets, ref.Name)
+	}
+	wantSecrets := []string{"token", "authz", "basic", "basic", "oauth2-secret", "cert", "key"}
+	if !reflect.DeepEqual(secrets, wantSecrets) {
+		t.Errorf("endpointSecretRefs() = %v, want %v", secrets, wantSecrets)
+	}
+
+	var configMaps []string
+	for _, ref := range endpointConfigMapRefs(&e) {
+		configMaps = append(configMaps, ref.Name)
+	}
+	wantConfigMaps := []string{"oauth2-id", "ca"}
+	if !reflect.DeepEqual(configMaps, wantConfigMaps) {
+		t.Errorf("endpointConfigMapRefs() = %v, want %v", configMaps, wantConfigMaps)
+	}
+
+	if refs := endpointSecretRefs(&monitoringv1.Endpoint{}); len(refs) != 0 {
+		t.Errorf("endpointSecretRefs() of an empty endpoint = %v, want none", refs)
+	}
+}
+
+func TestRenameCredentials(t *testing.T) {
+	e := testEndpoint()
+	renameCredentials(&e, "demo", "target")
+
+	if got, want := e.BearerTokenSecret.Name, credentialCopyName("target", "demo", "token"); got != want {
+		t.Errorf("bearer token secret = %s, want %s", got, want)
+	}
+	if got, want := e.TLSConfig.CA.ConfigMap.Name, credentialCopyName("target", "demo", "ca"); got != want {
+		t.Errorf("tls ca config map = %s, want %s", got, want)
+	}
+	secret := &core.Secret{}
+	secret.Name = credentialCopyName("target", "demo", "basic")
+	if !refersTo([]monitoringv1.Endpoint{e}, secret) {
+		t.Errorf("renamed endpoint does not refer to %s", secret.Name)
+	}
+	secret.Name = credentialCopyName("other", "demo", "basic")
+	if refersTo([]monitoringv1.Endpoint{e}, secret) {
+		t.Errorf("renamed endpoint refers to the copy %s made for another ServiceMonitor", secret.Name)
+	}
+}
@@ -0,0 +1,186 @@
+package federate
+
+import (
+	"context"
+
+	"github.com/google/go-cmp/cmp"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	meta_util "kmodules.xyz/client-go/meta"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ChangeCreate = "create"
+	ChangePatch  = "patch"
+	ChangeDelete = "delete"
+)
+
+// Change is a write the federator would make. Diff is the difference
+// between the live object and the object the api server accepted in dry-run
+// mode.
+type Change struct {
+	Action string `json:"action"`
+	Object string `json:"object"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+// dryRunClient sends every write in dry-run mode and records it as a
+// Change. Gets and lists see the ServiceMonitor federated as labeled for
+// federation, so it can be planned before it is labeled.
+type dryRunClient struct {
+	client.Client
+	federated client.ObjectKey
+	changes   []Change
+}
+
+var _ client.Client = &dryRunClient{}
+
+func (c *dryRunClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if err := c.Client.Get(ctx, key, obj, opts...); err != nil {
+		return err
+	}
+	if svcMon, ok := obj.(*monitoringv1.ServiceMonitor); ok && key == c.federated {
+		svcMon.Labels = meta_util.OverwriteKeys(svcMon.Labels, map[string]string{
+			mona.PrometheusKey: mona.PrometheusValueFederated,
+		})
+	}
+	return nil
+}
+
+func (c *dryRunClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if err := c.Client.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	svcMonList, ok := list.(*monitoringv1.ServiceMonitorList)
+	if !ok {
+		return nil
+	}
+
+	var svcMon monitoringv1.ServiceMonitor
+	err := c.Get(ctx, c.federated, &svcMon)
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+	matches := (listOpts.Namespace == "" || listOpts.Namespace == svcMon.Namespace) &&
+		(listOpts.LabelSelector == nil || listOpts.LabelSelector.Matches(labels.Set(svcMon.Labels)))
+
+	items := make([]*monitoringv1.ServiceMonitor, 0, len(svcMonList.Items)+1)
+	for _, item := range svcMonList.Items {
+		if client.ObjectKeyFromObject(item) != c.federated {
+			items = append(items, item)
+		}
+	}
+	if matches {
+		items = append(items, &svcMon)
+	}
+	svcMonList.Items = items
+	return nil
+}
+
+func (c *dryRunClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.Client.Create(ctx, obj, append(opts, client.DryRunAll)...); err != nil {
+		return err
+	}
+	return c.record(ChangeCreate, obj, nil, obj)
+}
+
+func (c *dryRunClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	live, err := c.live(ctx, obj)
+	if err != nil {
+		return err
+	}
+	if err := c.Client.Patch(ctx, obj, patch, append(opts, client.DryRunAll)...); err != nil {
+		return err
+	}
+	return c.record(ChangePatch, obj, live, obj)
+}
+
+func (c *dryRunClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	live, err := c.live(ctx, obj)
+	if err != nil {
+		return err
+	}
+	if err := c.Client.Update(ctx, obj, append(opts, client.DryRunAll)...); err != nil {
+		return err
+	}
+	return c.record(ChangePatch, obj, live, obj)
+}
+
+func (c *dryRunClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if err := c.Client.Delete(ctx, obj, append(opts, client.DryRunAll)...); err != nil {
+		return err
+	}
+	return c.record(ChangeDelete, obj, nil, nil)
+}
+
+// live returns the object stored in the cluster for obj, or nil.
+func (c *dryRunClient) live(ctx context.Context, obj client.Object) (client.Object, error) {
+	live := obj.DeepCopyObject().(client.Object)
+	err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), live)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return live, err
+}
+
+// record adds a Change for the write to obj that turned before into after.
+// Patches that change nothing are dropped.
+func (c *dryRunClient) record(action string, obj, before, after client.Object) error {
+	objID, err := objectID(c.Client, obj)
+	if err != nil {
+		return err
+	}
+
+	a, err := planContent(before)
+	if err != nil {
+		return err
+	}
+	b, err := planContent(after)
+	if err != nil {
+		return err
+	}
+	d := cmp.Diff(a, b)
+	if action == ChangePatch && d == "" {
+		return nil
+	}
+	c.changes = append(c.changes, Change{
+		Action: action,
+		Object: objID,
+		Diff:   d,
+	})
+	return nil
+}
+
+// planContent returns the content of obj without the fields the api server
+// manages and the AnnotationKeyStatus annotation, or nil.
+func planContent(obj client.Object) (map[string]interface{}, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	delete(content, "status")
+	if m, ok := content["metadata"].(map[string]interface{}); ok {
+		for _, k := range []string{"managedFields", "resourceVersion", "uid", "creationTimestamp", "generation"} {
+			delete(m, k)
+		}
+		delete(m, "ownerReferences") // uid of dry-run owners changes every time
+		// the status is bookkeeping of the federator, not a planned change
+		if annotations, ok := m["annotations"].(map[string]interface{}); ok {
+			delete(annotations, AnnotationKeyStatus)
+			if len(annotations) == 0 {
+				delete(m, "annotations")
+			}
+		}
+	}
+	return content, nil
+}
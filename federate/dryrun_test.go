@@ -0,0 +1,93 @@
+package federate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+)
+
+func TestDryRunClientList(t *testing.T) {
+	planned := &monitoringv1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "planned"}}
+	labeled := &monitoringv1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "monitoring",
+		Name:      "labeled",
+		Labels:    map[string]string{mona.PrometheusKey: mona.PrometheusValueFederated},
+	}}
+	dc := &dryRunClient{
+		Client:    testutil.NewFakeClient(t, planned, labeled),
+		federated: client.ObjectKeyFromObject(planned),
+	}
+
+	tests := []struct {
+		name string
+		opts []client.ListOption
+		want []string
+	}{
+		{
+			name: "federated",
+			opts: []client.ListOption{client.MatchingLabels{mona.PrometheusKey: mona.PrometheusValueFederated}},
+			want: []string{"monitoring/labeled", "demo/planned"},
+		},
+		{
+			name: "federated in namespace",
+			opts: []client.ListOption{client.InNamespace("demo"), client.MatchingLabels{mona.PrometheusKey: mona.PrometheusValueFederated}},
+			want: []string{"demo/planned"},
+		},
+		{
+			name: "other namespace",
+			opts: []client.ListOption{client.InNamespace("monitoring")},
+			want: []string{"monitoring/labeled"},
+		},
+		{
+			name: "all",
+			want: []string{"monitoring/labeled", "demo/planned"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var list monitoringv1.ServiceMonitorList
+			if err := dc.List(context.TODO(), &list, tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, item := range list.Items {
+				got = append(got, client.ObjectKeyFromObject(item).String())
+				if client.ObjectKeyFromObject(item) == dc.federated && item.Labels[mona.PrometheusKey] != mona.PrometheusValueFederated {
+					t.Errorf("List() returned %s without the federate label", dc.federated)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDryRunClientRecordSkipsStatus(t *testing.T) {
+	before := &monitoringv1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "planned"}}
+	dc := &dryRunClient{Client: testutil.NewFakeClient(t, before)}
+
+	after := before.DeepCopy()
+	after.Annotations = map[string]string{AnnotationKeyStatus: `[{"prometheus":"t1-monitoring/prom"}]`}
+	if err := dc.record(ChangePatch, after, before, after); err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.changes) != 0 {
+		t.Errorf("status annotation patch recorded as %+v, want no changes", dc.changes)
+	}
+
+	after.Labels = map[string]string{"team": "db"}
+	if err := dc.record(ChangePatch, after, before, after); err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.changes) != 1 {
+		t.Errorf("label patch recorded as %+v, want one change", dc.changes)
+	}
+}
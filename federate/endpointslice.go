@@ -0,0 +1,291 @@
+package federate
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"gomodules.xyz/pointer"
+	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EndpointSliceManagedBy is the managed-by label value of the EndpointSlices
+// produced by the federator. kube-controller-manager leaves them alone.
+const EndpointSliceManagedBy = "federate.k8s.appscode.com"
+
+// clusterIPs returns the cluster IPs of svc, primary family first.
+func clusterIPs(svc *core.Service) []string {
+	ips := svc.Spec.ClusterIPs
+	if len(ips) == 0 && svc.Spec.ClusterIP != "" {
+		ips = []string{svc.Spec.ClusterIP}
+	}
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if ip != core.ClusterIPNone {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+func addressType(ip string) discovery.AddressType {
+	if strings.Contains(ip, ":") {
+		return discovery.AddressTypeIPv6
+	}
+	return discovery.AddressTypeIPv4
+}
+
+// copyEndpointSlices points the copy of srcSvc next to targetSvcMon at the
+// cluster IPs of srcSvc, with one EndpointSlice per IP family. It returns the
+// EndpointSlices it produced.
+func copyEndpointSlices(kc client.Client, srcSvc *core.Service, targetSvcMon *monitoringv1.ServiceMonitor) ([]client.Object, error) {
+	ref := metav1.NewControllerRef(targetSvcMon, schema.GroupVersionKind{
+		Group:   monitoring.GroupName,
+		Version: monitoringv1.Version,
+		Kind:    "ServiceMonitor",
+	})
+
+	ports := make([]discovery.EndpointPort, 0, len(srcSvc.Spec.Ports))
+	for _, p := range srcSvc.Spec.Ports {
+		port := p
+		ports = append(ports, discovery.EndpointPort{
+			Name:        &port.Name,
+			Protocol:    &port.Protocol,
+			Port:        &port.Port,
+			AppProtocol: port.AppProtocol,
+		})
+	}
+
+	var result []client.Object
+	for _, ip := range clusterIPs(srcSvc) {
+		at := addressType(ip)
+		slice := discovery.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      copyName(srcSvc.Namespace, srcSvc.Name) + "-" + strings.ToLower(string(at)),
+				Namespace: targetSvcMon.Namespace,
+			},
+		}
+		vt, err := cu.CreateOrPatch(context.TODO(), kc, &slice, func(in client.Object, createOp bool) client.Object {
+			obj := in.(*discovery.EndpointSlice)
+
+			obj.OwnerReferences = []metav1.OwnerReference{*ref}
+			obj.Labels = meta_util.OverwriteKeys(obj.Labels, trackingLabels(targetSvcMon), map[string]string{
+				discovery.LabelServiceName: copyName(srcSvc.Namespace, srcSvc.Name),
+				discovery.LabelManagedBy:   EndpointSliceManagedBy,
+			})
+
+			obj.AddressType = at
+			obj.Endpoints = []discovery.Endpoint{
+				{
+					Addresses: []string{ip},
+					Conditions: discovery.EndpointConditions{
+						Ready: pointer.TrueP(),
+					},
+				},
+			}
+			obj.Ports = ports
+
+			return obj
+		})
+		if err != nil {
+			return nil, err
+		}
+		klog.Infof("%s EndpointSlice %s/%s", vt, slice.Namespace, slice.Name)
+		result = append(result, &slice)
+	}
+	return result, nil
+}
+
+// copyEndpoints writes the Endpoints matching the EndpointSlices of the copy
+// of srcSvc. Prometheus discovers ServiceMonitor targets through the
+// Endpoints api, so it can't be dropped yet. The Endpoints is labeled so it
+// isn't mirrored into a second set of EndpointSlices.
+func copyEndpoints(kc client.Client, srcSvc *core.Service, targetSvcMon *monitoringv1.ServiceMonitor) error {
+	target := core.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      copyName(srcSvc.Namespace, srcSvc.Name),
+			Namespace: targetSvcMon.Namespace,
+		},
+	}
+
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Endpoints)
+
+		ref := metav1.NewControllerRef(targetSvcMon, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "ServiceMonitor",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, trackingLabels(targetSvcMon), map[string]string{
+			discovery.LabelSkipMirror: "true",
+		})
+
+		var subset core.EndpointSubset
+		for _, ip := range clusterIPs(srcSvc) {
+			subset.Addresses = append(subset.Addresses, core.EndpointAddress{IP: ip})
+		}
+		for _, port := range srcSvc.Spec.Ports {
+			subset.Ports = append(subset.Ports, core.EndpointPort{
+				Name:        port.Name,
+				Port:        port.Port,
+				Protocol:    port.Protocol,
+				AppProtocol: port.AppProtocol,
+			})
+		}
+		obj.Subsets = nil
+		if len(subset.Addresses) > 0 {
+			obj.Subsets = []core.EndpointSubset{subset}
+		}
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s Endpoints %s/%s", vt, target.Namespace, target.Name)
+	return nil
+}
+
+const (
+	// AnnotationKeyEndpointsMode on a federated ServiceMonitor selects how the
+	// copies of its Services reach the source: EndpointsModeService through
+	// the cluster IP, or EndpointsModePods through every ready pod. Headless
+	// Services always use EndpointsModePods.
+	AnnotationKeyEndpointsMode = "federate.k8s.appscode.com/endpoints"
+
+	EndpointsModeService = "service"
+	EndpointsModePods    = "pods"
+)
+
+// usePodEndpoints reports whether the copy of srcSvc mirrors the pod endpoints of srcSvc.
+func usePodEndpoints(svcMon *monitoringv1.ServiceMonitor, srcSvc *core.Service) bool {
+	return len(clusterIPs(srcSvc)) == 0 || svcMon.Annotations[AnnotationKeyEndpointsMode] == EndpointsModePods
+}
+
+// mirrorEndpointSlices copies the ready endpoints of the EndpointSlices of
+// srcSvc, with their target refs, next to targetSvcMon. It returns the
+// EndpointSlices it produced.
+func mirrorEndpointSlices(kc client.Client, srcSvc *core.Service, targetSvcMon *monitoringv1.ServiceMonitor) ([]client.Object, error) {
+	ref := metav1.NewControllerRef(targetSvcMon, schema.GroupVersionKind{
+		Group:   monitoring.GroupName,
+		Version: monitoringv1.Version,
+		Kind:    "ServiceMonitor",
+	})
+
+	var srcSlices discovery.EndpointSliceList
+	err := kc.List(context.TODO(), &srcSlices, client.InNamespace(srcSvc.Namespace), client.MatchingLabels{
+		discovery.LabelServiceName: srcSvc.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []client.Object
+	for _, src := range srcSlices.Items {
+		if src.AddressType == discovery.AddressTypeFQDN {
+			continue
+		}
+
+		var endpoints []discovery.Endpoint
+		for _, e := range src.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			endpoints = append(endpoints, discovery.Endpoint{
+				Addresses:  e.Addresses,
+				Conditions: discovery.EndpointConditions{Ready: pointer.TrueP()},
+				Hostname:   e.Hostname,
+				TargetRef:  e.TargetRef,
+				NodeName:   e.NodeName,
+				Zone:       e.Zone,
+			})
+		}
+
+		slice := discovery.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      copyName(src.Namespace, src.Name),
+				Namespace: targetSvcMon.Namespace,
+			},
+		}
+		vt, err := cu.CreateOrPatch(context.TODO(), kc, &slice, func(in client.Object, createOp bool) client.Object {
+			obj := in.(*discovery.EndpointSlice)
+
+			obj.OwnerReferences = []metav1.OwnerReference{*ref}
+			obj.Labels = meta_util.OverwriteKeys(obj.Labels, trackingLabels(targetSvcMon), map[string]string{
+				discovery.LabelServiceName: copyName(srcSvc.Namespace, srcSvc.Name),
+				discovery.LabelManagedBy:   EndpointSliceManagedBy,
+			})
+
+			obj.AddressType = src.AddressType
+			obj.Endpoints = endpoints
+			obj.Ports = src.Ports
+
+			return obj
+		})
+		if err != nil {
+			return nil, err
+		}
+		klog.Infof("%s EndpointSlice %s/%s", vt, slice.Namespace, slice.Name)
+		result = append(result, &slice)
+	}
+	return result, nil
+}
+
+// mirrorEndpoints copies the ready addresses of the Endpoints of srcSvc, with
+// their target refs, next to targetSvcMon. See copyEndpoints for why the
+// Endpoints is still written.
+func mirrorEndpoints(kc client.Client, srcSvc *core.Service, targetSvcMon *monitoringv1.ServiceMonitor) error {
+	var srcEP core.Endpoints
+	err := kc.Get(context.TODO(), client.ObjectKeyFromObject(srcSvc), &srcEP)
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+
+	var subsets []core.EndpointSubset
+	for _, s := range srcEP.Subsets {
+		if len(s.Addresses) == 0 {
+			continue
+		}
+		subsets = append(subsets, core.EndpointSubset{
+			Addresses: s.Addresses,
+			Ports:     s.Ports,
+		})
+	}
+
+	target := core.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      copyName(srcSvc.Namespace, srcSvc.Name),
+			Namespace: targetSvcMon.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Endpoints)
+
+		ref := metav1.NewControllerRef(targetSvcMon, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "ServiceMonitor",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, trackingLabels(targetSvcMon), map[string]string{
+			discovery.LabelSkipMirror: "true",
+		})
+		obj.Subsets = subsets
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s Endpoints %s/%s", vt, target.Namespace, target.Name)
+	return nil
+}
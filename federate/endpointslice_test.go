@@ -0,0 +1,211 @@
+package federate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+)
+
+func targetServiceMonitor() *monitoringv1.ServiceMonitor {
+	return &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "monitoring",
+			Name:      copyName("demo", "redis"),
+			UID:       "target-uid",
+			Labels:    SourceLabels(monitoringv1.ServiceMonitorsKind, client.ObjectKey{Namespace: "demo", Name: "redis"}),
+		},
+	}
+}
+
+func TestClusterIPs(t *testing.T) {
+	cases := []struct {
+		name string
+		spec core.ServiceSpec
+		want []string
+	}{
+		{name: "single stack", spec: core.ServiceSpec{ClusterIP: "10.0.0.1"}, want: []string{"10.0.0.1"}},
+		{name: "dual stack", spec: core.ServiceSpec{ClusterIP: "10.0.0.1", ClusterIPs: []string{"10.0.0.1", "fd00::1"}}, want: []string{"10.0.0.1", "fd00::1"}},
+		{name: "headless", spec: core.ServiceSpec{ClusterIP: core.ClusterIPNone, ClusterIPs: []string{core.ClusterIPNone}}, want: []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := clusterIPs(&core.Service{Spec: c.spec}); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("clusterIPs() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCopyEndpointSlices(t *testing.T) {
+	kc := testutil.NewFakeClient(t)
+	target := targetServiceMonitor()
+	srcSvc := &core.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "redis"},
+		Spec: core.ServiceSpec{
+			ClusterIP:  "10.0.0.1",
+			ClusterIPs: []string{"10.0.0.1", "fd00::1"},
+			Ports:      []core.ServicePort{{Name: "metrics", Port: 9121, Protocol: core.ProtocolTCP}},
+		},
+	}
+
+	produced, err := copyEndpointSlices(kc, srcSvc, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(produced) != 2 {
+		t.Fatalf("copyEndpointSlices() produced %d EndpointSlices, want one per IP family", len(produced))
+	}
+
+	want := map[discovery.AddressType]string{discovery.AddressTypeIPv4: "10.0.0.1", discovery.AddressTypeIPv6: "fd00::1"}
+	for _, obj := range produced {
+		var slice discovery.EndpointSlice
+		if err := kc.Get(context.TODO(), client.ObjectKeyFromObject(obj), &slice); err != nil {
+			t.Fatal(err)
+		}
+		if ip := want[slice.AddressType]; len(slice.Endpoints) != 1 || !reflect.DeepEqual(slice.Endpoints[0].Addresses, []string{ip}) {
+			t.Errorf("EndpointSlice %s endpoints = %+v, want %s", slice.Name, slice.Endpoints, ip)
+		}
+		if len(slice.Ports) != 1 || *slice.Ports[0].Name != "metrics" || *slice.Ports[0].Port != 9121 {
+			t.Errorf("EndpointSlice %s ports = %+v, want metrics:9121", slice.Name, slice.Ports)
+		}
+		if slice.Labels[discovery.LabelServiceName] != copyName("demo", "redis") || slice.Labels[discovery.LabelManagedBy] != EndpointSliceManagedBy {
+			t.Errorf("EndpointSlice %s labels = %v, want the copy Service and %s", slice.Name, slice.Labels, EndpointSliceManagedBy)
+		}
+		if slice.Labels[LabelKeySourceName] != "redis" {
+			t.Errorf("EndpointSlice %s is not tracked by its source, labels = %v", slice.Name, slice.Labels)
+		}
+		if len(slice.OwnerReferences) != 1 || slice.OwnerReferences[0].UID != target.UID {
+			t.Errorf("EndpointSlice %s owners = %+v, want the target ServiceMonitor", slice.Name, slice.OwnerReferences)
+		}
+	}
+}
+
+func TestCopyEndpoints(t *testing.T) {
+	kc := testutil.NewFakeClient(t)
+	target := targetServiceMonitor()
+	srcSvc := &core.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "redis"},
+		Spec: core.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []core.ServicePort{{Name: "metrics", Port: 9121, Protocol: core.ProtocolTCP}},
+		},
+	}
+	if err := copyEndpoints(kc, srcSvc, target); err != nil {
+		t.Fatal(err)
+	}
+
+	var ep core.Endpoints
+	if err := kc.Get(context.TODO(), client.ObjectKey{Namespace: "monitoring", Name: copyName("demo", "redis")}, &ep); err != nil {
+		t.Fatal(err)
+	}
+	if ep.Labels[discovery.LabelSkipMirror] != "true" {
+		t.Errorf("Endpoints labels = %v, want %s", ep.Labels, discovery.LabelSkipMirror)
+	}
+	want := []core.EndpointSubset{{
+		Addresses: []core.EndpointAddress{{IP: "10.0.0.1"}},
+		Ports:     []core.EndpointPort{{Name: "metrics", Port: 9121, Protocol: core.ProtocolTCP}},
+	}}
+	if !reflect.DeepEqual(ep.Subsets, want) {
+		t.Errorf("Endpoints subsets = %+v, want %+v", ep.Subsets, want)
+	}
+}
+
+func TestUsePodEndpoints(t *testing.T) {
+	headless := &core.Service{Spec: core.ServiceSpec{ClusterIP: core.ClusterIPNone}}
+	clusterIP := &core.Service{Spec: core.ServiceSpec{ClusterIP: "10.0.0.1"}}
+	pods := &monitoringv1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationKeyEndpointsMode: EndpointsModePods}}}
+
+	if !usePodEndpoints(&monitoringv1.ServiceMonitor{}, headless) {
+		t.Errorf("usePodEndpoints() of a headless Service = false, want true")
+	}
+	if usePodEndpoints(&monitoringv1.ServiceMonitor{}, clusterIP) {
+		t.Errorf("usePodEndpoints() of a cluster IP Service = true, want false")
+	}
+	if !usePodEndpoints(pods, clusterIP) {
+		t.Errorf("usePodEndpoints() with the %s annotation = false, want true", EndpointsModePods)
+	}
+}
+
+func TestMirrorEndpointSlices(t *testing.T) {
+	port := int32(9121)
+	portName := "metrics"
+	notReady := false
+	ref := &core.ObjectReference{Kind: "Pod", Namespace: "demo", Name: "redis-0"}
+	kc := testutil.NewFakeClient(t,
+		&discovery.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Namespace: "demo", Name: "redis-abcde", Labels: map[string]string{discovery.LabelServiceName: "redis"}},
+			AddressType: discovery.AddressTypeIPv4,
+			Endpoints: []discovery.Endpoint{
+				{Addresses: []string{"10.1.0.1"}, TargetRef: ref},
+				{Addresses: []string{"10.1.0.2"}, Conditions: discovery.EndpointConditions{Ready: &notReady}},
+			},
+			Ports: []discovery.EndpointPort{{Name: &portName, Port: &port}},
+		},
+		&discovery.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Namespace: "demo", Name: "redis-fqdn", Labels: map[string]string{discovery.LabelServiceName: "redis"}},
+			AddressType: discovery.AddressTypeFQDN,
+			Endpoints:   []discovery.Endpoint{{Addresses: []string{"redis.example.com"}}},
+		},
+		&discovery.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Namespace: "demo", Name: "postgres-abcde", Labels: map[string]string{discovery.LabelServiceName: "postgres"}},
+			AddressType: discovery.AddressTypeIPv4,
+		},
+	)
+	srcSvc := &core.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "redis"}, Spec: core.ServiceSpec{ClusterIP: core.ClusterIPNone}}
+
+	produced, err := mirrorEndpointSlices(kc, srcSvc, targetServiceMonitor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(produced) != 1 || produced[0].GetName() != copyName("demo", "redis-abcde") {
+		t.Fatalf("mirrorEndpointSlices() produced %v, want only the copy of redis-abcde", produced)
+	}
+
+	var slice discovery.EndpointSlice
+	if err := kc.Get(context.TODO(), client.ObjectKeyFromObject(produced[0]), &slice); err != nil {
+		t.Fatal(err)
+	}
+	if len(slice.Endpoints) != 1 || slice.Endpoints[0].Addresses[0] != "10.1.0.1" || !reflect.DeepEqual(slice.Endpoints[0].TargetRef, ref) {
+		t.Errorf("mirrored endpoints = %+v, want the ready redis-0 endpoint", slice.Endpoints)
+	}
+	if slice.Labels[discovery.LabelServiceName] != copyName("demo", "redis") {
+		t.Errorf("mirrored EndpointSlice labels = %v, want the copy Service", slice.Labels)
+	}
+}
+
+func TestMirrorEndpoints(t *testing.T) {
+	subset := core.EndpointSubset{
+		Addresses: []core.EndpointAddress{{IP: "10.1.0.1", TargetRef: &core.ObjectReference{Kind: "Pod", Namespace: "demo", Name: "redis-0"}}},
+		Ports:     []core.EndpointPort{{Name: "metrics", Port: 9121}},
+	}
+	kc := testutil.NewFakeClient(t, &core.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "redis"},
+		Subsets: []core.EndpointSubset{
+			subset,
+			{NotReadyAddresses: []core.EndpointAddress{{IP: "10.1.0.2"}}, Ports: subset.Ports},
+		},
+	})
+	srcSvc := &core.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "redis"}}
+	if err := mirrorEndpoints(kc, srcSvc, targetServiceMonitor()); err != nil {
+		t.Fatal(err)
+	}
+
+	var ep core.Endpoints
+	if err := kc.Get(context.TODO(), client.ObjectKey{Namespace: "monitoring", Name: copyName("demo", "redis")}, &ep); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ep.Subsets, []core.EndpointSubset{subset}) {
+		t.Errorf("mirrored subsets = %+v, want only the ready addresses", ep.Subsets)
+	}
+	if ep.Labels[discovery.LabelSkipMirror] != "true" {
+		t.Errorf("mirrored Endpoints labels = %v, want %s", ep.Labels, discovery.LabelSkipMirror)
+	}
+}
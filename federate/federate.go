@@ -0,0 +1,487 @@
+package federate
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+// Reconcile federates a ServiceMonitor labeled mona.PrometheusValueFederated
+// into every Prometheus and reports the results on the ServiceMonitor.
+// recorder may be nil.
+func Reconcile(ctx context.Context, kc client.Client, recorder record.EventRecorder, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var svcMon monitoringv1.ServiceMonitor
+	if err := kc.Get(ctx, req.NamespacedName, &svcMon); err != nil {
+		if apierrors.IsNotFound(err) {
+			// the ServiceMonitor is gone, remove its copies
+			return ctrl.Result{}, unfederate(kc, req.NamespacedName)
+		}
+		log.Error(err, "unable to fetch ServiceMonitor")
+		return ctrl.Result{}, err
+	}
+
+	// has federate label
+	val, found := svcMon.Labels[mona.PrometheusKey]
+	if !found || val != mona.PrometheusValueFederated {
+		return ctrl.Result{}, unfederate(kc, req.NamespacedName)
+	}
+
+	if !tenancy.Enabled(kc) {
+		return ctrl.Result{}, nil
+	}
+
+	srcServices, srcSecrets, srcConfigMaps, err := collectSources(kc, &svcMon)
+	if err != nil {
+		report(kc, recorder, monitoringv1.ServiceMonitorsKind, &svcMon, []TargetResult{newTargetResult(kc, nil, nil, []error{err})})
+		return ctrl.Result{}, err
+	}
+
+	var promList monitoringv1.PrometheusList
+	if err := kc.List(context.TODO(), &promList); err != nil {
+		log.Error(err, "unable to list Prometheus")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	var errList []error
+	var desired []client.Object
+	var results []TargetResult
+	for _, prom := range promList.Items {
+		action, err := federateAction(&svcMon, prom)
+		if action == ActionSkip {
+			log.Error(err, "bad service monitor")
+			report(kc, recorder, monitoringv1.ServiceMonitorsKind, &svcMon, []TargetResult{newTargetResult(kc, prom, nil, []error{err})})
+			return ctrl.Result{}, nil // don't retry until svcmon changes
+		}
+
+		var objects []client.Object
+		var promErrs []error
+		switch action {
+		case ActionLabel:
+			objects = []client.Object{&svcMon}
+			if err := updateServiceMonitorLabels(kc, prom, &svcMon); err != nil {
+				promErrs = append(promErrs, err)
+			}
+		case ActionFederate:
+			objects, promErrs = federateToPrometheus(kc, prom, &svcMon, srcServices)
+			desired = append(desired, objects...)
+		default:
+			objects, promErrs = copyToPrometheus(kc, prom, &svcMon, srcServices, srcSecrets, srcConfigMaps)
+			desired = append(desired, objects...)
+		}
+		errList = append(errList, promErrs...)
+		results = append(results, newTargetResult(kc, prom, objects, promErrs))
+	}
+	if len(errList) == 0 {
+		if err := prune(kc, monitoringv1.ServiceMonitorsKind, req.NamespacedName, desired); err != nil {
+			errList = append(errList, err)
+		} else if err := pruneFederateServices(kc); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	report(kc, recorder, monitoringv1.ServiceMonitorsKind, &svcMon, results)
+
+	return ctrl.Result{}, errors.NewAggregate(errList)
+}
+
+// copyToPrometheus copies svcMon and the objects it refers to next to the
+// project Prometheus prom. It returns the objects it produced.
+func copyToPrometheus(
+	kc client.Client,
+	prom *monitoringv1.Prometheus,
+	svcMon *monitoringv1.ServiceMonitor,
+	srcServices map[client.ObjectKey]core.Service,
+	srcSecrets []core.Secret,
+	srcConfigMaps []core.ConfigMap,
+) ([]client.Object, []error) {
+	targetSvcMon, err := copyServiceMonitor(kc, prom, svcMon)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var errList []error
+	objects := []client.Object{targetSvcMon}
+	for _, srcSvc := range srcServices {
+		objects = append(objects,
+			&core.Service{ObjectMeta: metav1.ObjectMeta{Namespace: targetSvcMon.Namespace, Name: copyName(srcSvc.Namespace, srcSvc.Name)}},
+			&core.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: targetSvcMon.Namespace, Name: copyName(srcSvc.Namespace, srcSvc.Name)}},
+		)
+
+		if err := copyService(kc, &srcSvc, targetSvcMon); err != nil {
+			errList = append(errList, err)
+		}
+		if usePodEndpoints(svcMon, &srcSvc) {
+			slices, err := mirrorEndpointSlices(kc, &srcSvc, targetSvcMon)
+			if err != nil {
+				errList = append(errList, err)
+			}
+			objects = append(objects, slices...)
+			if err := mirrorEndpoints(kc, &srcSvc, targetSvcMon); err != nil {
+				errList = append(errList, err)
+			}
+		} else {
+			slices, err := copyEndpointSlices(kc, &srcSvc, targetSvcMon)
+			if err != nil {
+				errList = append(errList, err)
+			}
+			objects = append(objects, slices...)
+			if err := copyEndpoints(kc, &srcSvc, targetSvcMon); err != nil {
+				errList = append(errList, err)
+			}
+		}
+	}
+
+	copies, errs := copyCredentials(kc, srcSecrets, srcConfigMaps, targetSvcMon)
+	objects = append(objects, copies...)
+	errList = append(errList, errs...)
+	return objects, errList
+}
+
+// unfederate removes the copies of the ServiceMonitor key and its /federate
+// ServiceMonitors from project Prometheus, and the federate Services no
+// /federate ServiceMonitor uses anymore.
+func unfederate(kc client.Client, key client.ObjectKey) error {
+	if err := prune(kc, monitoringv1.ServiceMonitorsKind, key, nil); err != nil {
+		return err
+	}
+	return pruneFederateServices(kc)
+}
+
+// collectSources returns the Services selected by svcMon and the Secrets and
+// ConfigMaps its endpoints refer to.
+func collectSources(kc client.Client, svcMon *monitoringv1.ServiceMonitor) (map[client.ObjectKey]core.Service, []core.Secret, []core.ConfigMap, error) {
+	// services
+	srcServices := map[client.ObjectKey]core.Service{}
+	svcSel, err := metav1.LabelSelectorAsSelector(&svcMon.Spec.Selector)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	namespaces, err := selectedNamespaces(kc, svcMon.Spec.NamespaceSelector)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, ns := range namespaces {
+		var svcList core.ServiceList
+		err = kc.List(context.TODO(), &svcList, client.InNamespace(ns), client.MatchingLabelsSelector{
+			Selector: svcSel,
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, svc := range svcList.Items {
+			if isCopy(&svc) {
+				continue
+			}
+			srcServices[client.ObjectKeyFromObject(&svc)] = svc
+		}
+	}
+
+	srcSecrets, srcConfigMaps, err := collectCredentials(kc, svcMon.Namespace, svcMon.Spec.Endpoints)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return srcServices, srcSecrets, srcConfigMaps, nil
+}
+
+func updateServiceMonitorLabels(kc client.Client, prom *monitoringv1.Prometheus, src *monitoringv1.ServiceMonitor) error {
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, src, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.ServiceMonitor)
+
+		labels, _ := meta_util.LabelsForLabelSelector(prom.Spec.ServiceMonitorSelector)
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels)
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s ServiceMonitor %s/%s", vt, src.Namespace, src.Name)
+	return nil
+}
+
+func copyServiceMonitor(kc client.Client, prom *monitoringv1.Prometheus, src *monitoringv1.ServiceMonitor) (*monitoringv1.ServiceMonitor, error) {
+	keepNSMetrics, err := keepNamespacesRelabelConfigs(kc, prom)
+	if err != nil {
+		return nil, err
+	}
+
+	target := monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      copyName(src.Namespace, src.Name),
+			Namespace: prom.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.ServiceMonitor)
+
+		ref := metav1.NewControllerRef(prom, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "Prometheus",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+
+		labels, _ := meta_util.LabelsForLabelSelector(prom.Spec.ServiceMonitorSelector)
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels, SourceLabels(monitoringv1.ServiceMonitorsKind, client.ObjectKeyFromObject(src)))
+		delete(obj.Labels, mona.PrometheusKey)
+
+		obj.Spec = *src.Spec.DeepCopy()
+
+		for i := range obj.Spec.Endpoints {
+			e := obj.Spec.Endpoints[i]
+
+			e.HonorLabels = true // keep original labels
+			e.MetricRelabelConfigs = withKeepNamespaces(e.MetricRelabelConfigs, keepNSMetrics)
+			renameCredentials(&e, src.Namespace, obj.Name)
+			obj.Spec.Endpoints[i] = e
+		}
+
+		return obj
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("%s ServiceMonitor %s/%s", vt, target.Namespace, target.Name)
+	return &target, nil
+}
+
+// keepNamespacesRelabelConfigs returns the relabel configs that keep only
+// the metrics of the namespaces selected by the project Prometheus. The keep
+// config is last. When it matches tenancy.LabelNameProjectID, it is preceded
+// by the configs that set that label, so the copy never depends on the
+// relabel configs of the source.
+func keepNamespacesRelabelConfigs(kc client.Client, prom *monitoringv1.Prometheus) ([]*monitoringv1.RelabelConfig, error) {
+	namespaces, err := tenancy.TenantNamespaces(kc, prom)
+	if err != nil {
+		return nil, err
+	}
+	// keep non-namespaced resources too
+	m, err := tenancy.NamespaceMatcher(kc, prom, namespaces, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Label != tenancy.LabelNameProjectID {
+		return []*monitoringv1.RelabelConfig{
+			{
+				Action:       "keep",
+				SourceLabels: []monitoringv1.LabelName{monitoringv1.LabelName(m.Label)},
+				Regex:        "(" + m.Regex + ")",
+			},
+		}, nil
+	}
+
+	// series of namespaces outside any project have no project id either, so
+	// match both labels to tell them from non-namespaced series
+	return append(tenancy.ProjectIDRelabelConfigs(m.ProjectID, namespaces), &monitoringv1.RelabelConfig{
+		Action:       "keep",
+		SourceLabels: []monitoringv1.LabelName{"namespace", tenancy.LabelNameProjectID},
+		Regex:        "(;|[^;]+;" + regexp.QuoteMeta(m.ProjectID) + ")",
+	}), nil
+}
+
+// withKeepNamespaces appends keep to configs, unless configs already ends
+// with it. Keeping last lets the hand-edited configs of the source set or
+// rename labels first.
+func withKeepNamespaces(configs, keep []*monitoringv1.RelabelConfig) []*monitoringv1.RelabelConfig {
+	if len(configs) >= len(keep) && reflect.DeepEqual(keep, configs[len(configs)-len(keep):]) {
+		return configs
+	}
+	out := make([]*monitoringv1.RelabelConfig, 0, len(configs)+len(keep))
+	out = append(out, configs...)
+	for _, c := range keep {
+		out = append(out, c.DeepCopy())
+	}
+	return out
+}
+
+func copyService(kc client.Client, src *core.Service, targetSvcMon *monitoringv1.ServiceMonitor) error {
+	target := core.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      copyName(src.Namespace, src.Name),
+			Namespace: targetSvcMon.Namespace,
+		},
+	}
+
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Service)
+
+		ref := metav1.NewControllerRef(targetSvcMon, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "ServiceMonitor",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, src.Labels, trackingLabels(targetSvcMon))
+		obj.Annotations = meta_util.OverwriteKeys(obj.Annotations, src.Annotations)
+
+		obj.Spec.Type = core.ServiceTypeClusterIP
+		if createOp && len(clusterIPs(src)) == 0 {
+			obj.Spec.ClusterIP = core.ClusterIPNone
+		}
+
+		for _, port := range src.Spec.Ports {
+			obj.Spec.Ports = UpsertServicePort(obj.Spec.Ports, port)
+		}
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s Service %s/%s", vt, target.Namespace, target.Name)
+	return nil
+}
+
+func UpsertServicePort(ports []core.ServicePort, x core.ServicePort) []core.ServicePort {
+	for i, port := range ports {
+		if port.Name == x.Name {
+			port.Port = x.Port
+			port.Protocol = x.Protocol
+			port.TargetPort = intstr.FromInt(int(x.Port))
+			ports[i] = port
+			return ports
+		}
+	}
+	return append(ports, core.ServicePort{
+		Name:       x.Name,
+		Protocol:   x.Protocol,
+		Port:       x.Port,
+		TargetPort: intstr.FromInt(int(x.Port)),
+	})
+}
+
+func UpsertEndpointPort(ports []core.EndpointPort, x core.EndpointPort) []core.EndpointPort {
+	for i, port := range ports {
+		if port.Name == x.Name {
+			port.Port = x.Port
+			ports[i] = port
+			return ports
+		}
+	}
+	return append(ports, core.EndpointPort{
+		Name: x.Name,
+		Port: x.Port,
+	})
+}
+
+// service -> []serviceMonitors
+func ServiceMonitorsForService(kc client.Client, obj client.Object) []reconcile.Request {
+	var list monitoringv1.ServiceMonitorList
+	err := kc.List(context.TODO(), &list, client.MatchingLabels{
+		mona.PrometheusKey: mona.PrometheusValueFederated,
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	var req []reconcile.Request
+	for _, svcMon := range list.Items {
+		if isCopy(obj) || !selectsNamespace(svcMon.Spec.NamespaceSelector, obj.GetNamespace()) {
+			continue
+		}
+		sel, err := metav1.LabelSelectorAsSelector(&svcMon.Spec.Selector)
+		if err != nil {
+			return nil
+		}
+		if sel.Matches(labels.Set(obj.GetLabels())) {
+			req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svcMon)})
+		}
+	}
+	return req
+}
+
+// Prometheus -> serviceMonitor
+func ServiceMonitorsForPrometheus(kc client.Client, obj client.Object) []reconcile.Request {
+	var list monitoringv1.ServiceMonitorList
+	err := kc.List(context.TODO(), &list, client.MatchingLabels{
+		mona.PrometheusKey: mona.PrometheusValueFederated,
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	var req []reconcile.Request
+	for _, svcMon := range list.Items {
+		req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svcMon)})
+	}
+	return req
+}
+
+// endpointslice -> []serviceMonitors
+func ServiceMonitorsForEndpointSlice(kc client.Client, obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[discovery.LabelServiceName]
+	if !ok || obj.GetLabels()[discovery.LabelManagedBy] == EndpointSliceManagedBy {
+		return nil
+	}
+	var svc core.Service
+	err := kc.Get(context.TODO(), client.ObjectKey{Namespace: obj.GetNamespace(), Name: name}, &svc)
+	if err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			klog.Error(err)
+		}
+		return nil
+	}
+	return ServiceMonitorsForService(kc, &svc)
+}
+
+// secret or configmap -> []serviceMonitors
+func ServiceMonitorsForCredential(kc client.Client, obj client.Object) []reconcile.Request {
+	var list monitoringv1.ServiceMonitorList
+	err := kc.List(context.TODO(), &list, client.InNamespace(obj.GetNamespace()), client.MatchingLabels{
+		mona.PrometheusKey: mona.PrometheusValueFederated,
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	var req []reconcile.Request
+	for _, svcMon := range list.Items {
+		if refersTo(svcMon.Spec.Endpoints, obj) {
+			req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svcMon)})
+		}
+	}
+	return req
+}
+
+// namespace -> []serviceMonitors
+//
+// Namespace labels decide which namespaces a project Prometheus selects, so
+// every federated ServiceMonitor is reconciled to recompute its keep regex.
+func ServiceMonitorsForNamespace(kc client.Client, obj client.Object) []reconcile.Request {
+	return ServiceMonitorsForPrometheus(kc, obj)
+}
+
+func contains(arr []string, x string) bool {
+	for _, s := range arr {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
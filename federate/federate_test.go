@@ -0,0 +1,130 @@
+package federate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+// relabel applies the replace and keep configs to lbls like Prometheus does,
+// and reports whether the series is kept.
+func relabel(configs []*monitoringv1.RelabelConfig, lbls map[string]string) bool {
+	for _, c := range configs {
+		var values []string
+		for _, l := range c.SourceLabels {
+			values = append(values, lbls[string(l)])
+		}
+		sep := c.Separator
+		if sep == "" {
+			sep = ";"
+		}
+		regex := c.Regex
+		if regex == "" {
+			regex = "(.*)"
+		}
+		re := regexp.MustCompile("^(?:" + regex + ")$")
+		matched := re.MatchString(strings.Join(values, sep))
+		switch c.Action {
+		case "keep":
+			if !matched {
+				return false
+			}
+		case "replace", "":
+			if matched {
+				lbls[c.TargetLabel] = re.ReplaceAllString(strings.Join(values, sep), c.Replacement)
+			}
+		}
+	}
+	return true
+}
+
+func TestCopyServiceMonitorKeepsProjectNamespaces(t *testing.T) {
+	defer func(v string) { tenancy.NamespaceLabelKey = v }(tenancy.NamespaceLabelKey)
+	tenancy.NamespaceLabelKey = "tenant"
+
+	prom := &monitoringv1.Prometheus{ObjectMeta: metav1.ObjectMeta{Namespace: "t1-monitoring", Name: "prom"}}
+	src := &monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "kube-state-metrics"},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{
+				{
+					Port: "http",
+					MetricRelabelConfigs: []*monitoringv1.RelabelConfig{
+						{Action: "replace", SourceLabels: []monitoringv1.LabelName{"exported_namespace"}, Regex: "(.+)", TargetLabel: "namespace", Replacement: "$1"},
+					},
+				},
+			},
+		},
+	}
+	objs := []client.Object{
+		prom,
+		src,
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: prom.Namespace, Labels: map[string]string{"tenant": "t1"}}},
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+	}
+	for i := 0; i < 100; i++ {
+		objs = append(objs, &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("t1-app-%03d", i), Labels: map[string]string{"tenant": "t1"}}})
+	}
+	kc := testutil.NewFakeClient(t, objs...)
+
+	for _, maxLen := range []int{tenancy.MaxNamespaceRegexLen, 256} {
+		t.Run(fmt.Sprintf("max regex len %d", maxLen), func(t *testing.T) {
+			defer func(v int) { tenancy.MaxNamespaceRegexLen = v }(tenancy.MaxNamespaceRegexLen)
+			tenancy.MaxNamespaceRegexLen = maxLen
+
+			target, err := copyServiceMonitor(kc, prom, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			configs := target.Spec.Endpoints[0].MetricRelabelConfigs
+			if configs[0].TargetLabel != "namespace" {
+				t.Errorf("hand-edited relabel config is not first: %+v", configs[0])
+			}
+			if last := configs[len(configs)-1]; last.Action != "keep" {
+				t.Errorf("last relabel config = %+v, want keep", last)
+			}
+
+			tests := []struct {
+				lbls map[string]string
+				want bool
+			}{
+				{map[string]string{"namespace": "t1-app-050"}, true},
+				{map[string]string{"exported_namespace": "t1-app-099"}, true},
+				{map[string]string{}, true},
+				{map[string]string{"namespace": "other"}, false},
+				{map[string]string{"namespace": "other", tenancy.LabelNameProjectID: "t2"}, false},
+				{map[string]string{"namespace": "t1-app-050", "exported_namespace": "other"}, false},
+			}
+			for _, tt := range tests {
+				if got := relabel(configs, tt.lbls); got != tt.want {
+					t.Errorf("series %v kept = %v, want %v", tt.lbls, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithKeepNamespaces(t *testing.T) {
+	own := &monitoringv1.RelabelConfig{Action: "drop", SourceLabels: []monitoringv1.LabelName{"__name__"}, Regex: "go_.*"}
+	keep := []*monitoringv1.RelabelConfig{
+		{Action: "replace", SourceLabels: []monitoringv1.LabelName{"namespace"}, Regex: "(a)", TargetLabel: tenancy.LabelNameProjectID, Replacement: "p"},
+		{Action: "keep", SourceLabels: []monitoringv1.LabelName{tenancy.LabelNameProjectID}, Regex: "(|p)"},
+	}
+
+	got := withKeepNamespaces([]*monitoringv1.RelabelConfig{own}, keep)
+	if len(got) != 3 || got[0] != own || got[2].Action != "keep" {
+		t.Fatalf("withKeepNamespaces() = %+v, want own config followed by keep", got)
+	}
+	if again := withKeepNamespaces(got, keep); len(again) != 3 {
+		t.Errorf("withKeepNamespaces() added keep twice: %+v", again)
+	}
+}
@@ -0,0 +1,121 @@
+package federate
+
+import (
+	"context"
+	"fmt"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// Every object produced by the federator is labeled with the source it was
+// produced for, so copies that are no longer desired can be pruned.
+const (
+	LabelKeySourceKind      = "federate.k8s.appscode.com/source-kind"
+	LabelKeySourceNamespace = "federate.k8s.appscode.com/source-namespace"
+	LabelKeySourceName      = "federate.k8s.appscode.com/source-name"
+)
+
+// SourceLabels returns the tracking labels for the copies of the source kind/key.
+func SourceLabels(kind string, key client.ObjectKey) map[string]string {
+	return map[string]string{
+		LabelKeySourceKind:      kind,
+		LabelKeySourceNamespace: key.Namespace,
+		LabelKeySourceName:      key.Name,
+	}
+}
+
+// trackingLabels returns the tracking labels of a copy, so objects produced
+// next to it can be labeled the same way.
+func trackingLabels(obj client.Object) map[string]string {
+	result := map[string]string{}
+	for _, k := range []string{LabelKeySourceKind, LabelKeySourceNamespace, LabelKeySourceName} {
+		if v, ok := obj.GetLabels()[k]; ok {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// ListCopies returns every object produced for the source kind/key.
+func ListCopies(kc client.Client, kind string, key client.ObjectKey) ([]client.Object, error) {
+	lists := []client.ObjectList{
+		&monitoringv1.ServiceMonitorList{},
+		&monitoringv1.PrometheusRuleList{},
+		&core.ServiceList{},
+		&core.EndpointsList{},
+		&discovery.EndpointSliceList{},
+		&core.SecretList{},
+		&core.ConfigMapList{},
+	}
+
+	var result []client.Object
+	for _, list := range lists {
+		err := kc.List(context.TODO(), list, client.MatchingLabels(SourceLabels(kind, key)))
+		if meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			obj, ok := item.(client.Object)
+			if !ok {
+				return nil, fmt.Errorf("unexpected item type %T in %T", item, list)
+			}
+			result = append(result, obj)
+		}
+	}
+	return result, nil
+}
+
+// prune deletes the copies of the source kind/key that are not in desired.
+// A nil desired removes every copy.
+func prune(kc client.Client, kind string, key client.ObjectKey, desired []client.Object) error {
+	keep := sets.NewString()
+	for _, obj := range desired {
+		id, err := objectID(kc, obj)
+		if err != nil {
+			return err
+		}
+		keep.Insert(id)
+	}
+
+	copies, err := ListCopies(kc, kind, key)
+	if err != nil {
+		return err
+	}
+	for _, obj := range copies {
+		id, err := objectID(kc, obj)
+		if err != nil {
+			return err
+		}
+		if keep.Has(id) {
+			continue
+		}
+		err = kc.Delete(context.TODO(), obj)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		klog.Infof("pruned %s", id)
+	}
+	return nil
+}
+
+func objectID(kc client.Client, obj client.Object) (string, error) {
+	gvk, err := apiutil.GVKForObject(obj, kc.Scheme())
+	if err != nil {
+		return "", err
+	}
+	return gvk.Kind + " " + client.ObjectKeyFromObject(obj).String(), nil
+}
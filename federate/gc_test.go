@@ -0,0 +1,123 @@
+package federate
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+)
+
+func TestPrune(t *testing.T) {
+	src := client.ObjectKey{Namespace: "demo", Name: "redis"}
+	other := client.ObjectKey{Namespace: "demo", Name: "postgres"}
+	meta := func(name string, key client.ObjectKey) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: "monitoring", Name: name, Labels: SourceLabels(monitoringv1.ServiceMonitorsKind, key)}
+	}
+
+	kc := testutil.NewFakeClient(t,
+		&monitoringv1.ServiceMonitor{ObjectMeta: meta("redis-demo", src)},
+		&core.Service{ObjectMeta: meta("redis-demo", src)},
+		&core.Service{ObjectMeta: meta("stale-demo", src)},
+		&core.Endpoints{ObjectMeta: meta("stale-demo", src)},
+		&discovery.EndpointSlice{ObjectMeta: meta("stale-demo-ipv4", src), AddressType: discovery.AddressTypeIPv4},
+		&core.Secret{ObjectMeta: meta("stale-auth", src)},
+		&core.Service{ObjectMeta: meta("postgres-demo", other)},
+		&core.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "unlabeled"}},
+	)
+
+	desired := []client.Object{
+		&monitoringv1.ServiceMonitor{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "redis-demo"}},
+		&core.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "redis-demo"}},
+	}
+	if err := prune(kc, monitoringv1.ServiceMonitorsKind, src, desired); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(key client.ObjectKey) []string {
+		copies, err := ListCopies(kc, monitoringv1.ServiceMonitorsKind, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, obj := range copies {
+			id, err := objectID(kc, obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, id)
+		}
+		sort.Strings(result)
+		return result
+	}
+	if got, want := ids(src), []string{"Service monitoring/redis-demo", "ServiceMonitor monitoring/redis-demo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("copies after prune = %v, want %v", got, want)
+	}
+	if got, want := ids(other), []string{"Service monitoring/postgres-demo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("copies of another source = %v, want %v", got, want)
+	}
+
+	if err := prune(kc, monitoringv1.ServiceMonitorsKind, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(src); len(got) != 0 {
+		t.Errorf("copies after pruning everything = %v, want none", got)
+	}
+	var svc core.Service
+	if err := kc.Get(context.TODO(), client.ObjectKey{Namespace: "monitoring", Name: "unlabeled"}, &svc); err != nil {
+		t.Errorf("prune deleted an object it does not track: %v", err)
+	}
+}
+
+func TestPruneFederateServices(t *testing.T) {
+	clusterProm := client.ObjectKey{Namespace: "monitoring", Name: "prom"}
+	svcMon := client.ObjectKey{Namespace: "demo", Name: "redis"}
+	promLabels := SourceLabels(monitoringv1.PrometheusesKind, clusterProm)
+	meta := func(ns, name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: ns, Name: name, Labels: promLabels}
+	}
+
+	kc := testutil.NewFakeClient(t,
+		// t1 still scrapes /federate
+		&monitoringv1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "t1-monitoring", Name: "redis-demo", Labels: SourceLabels(monitoringv1.ServiceMonitorsKind, svcMon)},
+			Spec:       monitoringv1.ServiceMonitorSpec{Selector: metav1.LabelSelector{MatchLabels: promLabels}},
+		},
+		&core.Service{ObjectMeta: meta("t1-monitoring", "prom-federate")},
+		&core.Endpoints{ObjectMeta: meta("t1-monitoring", "prom-federate")},
+		// t2 switched back to copies
+		&monitoringv1.ServiceMonitor{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "t2-monitoring", Name: "redis-demo", Labels: SourceLabels(monitoringv1.ServiceMonitorsKind, svcMon)},
+			Spec:       monitoringv1.ServiceMonitorSpec{Selector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}}},
+		},
+		&core.Service{ObjectMeta: meta("t2-monitoring", "prom-federate")},
+		&core.Endpoints{ObjectMeta: meta("t2-monitoring", "prom-federate")},
+	)
+
+	if err := pruneFederateServices(kc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ns   string
+		want bool
+	}{
+		{ns: "t1-monitoring", want: true},
+		{ns: "t2-monitoring", want: false},
+	} {
+		key := client.ObjectKey{Namespace: tc.ns, Name: "prom-federate"}
+		for _, obj := range []client.Object{&core.Service{}, &core.Endpoints{}} {
+			err := kc.Get(context.TODO(), key, obj)
+			if got := err == nil; got != tc.want {
+				t.Errorf("%T %s exists = %v, want %v", obj, key, got, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package federate
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AllowedNamespaces limits the namespaces a monitor with an Any or empty
+// namespace selector federates from. Empty allows every namespace. It is set
+// once at startup.
+var AllowedNamespaces []string
+
+// selectsAll reports whether sel selects every (allowed) namespace.
+func selectsAll(sel monitoringv1.NamespaceSelector) bool {
+	return sel.Any || len(sel.MatchNames) == 0
+}
+
+// selectedNamespaces returns the namespaces selected by sel.
+func selectedNamespaces(kc client.Client, sel monitoringv1.NamespaceSelector) ([]string, error) {
+	if !selectsAll(sel) {
+		return sel.MatchNames, nil
+	}
+	if len(AllowedNamespaces) > 0 {
+		return AllowedNamespaces, nil
+	}
+
+	var nsList core.NamespaceList
+	if err := kc.List(context.TODO(), &nsList); err != nil {
+		return nil, err
+	}
+	namespaces := make([]string, 0, len(nsList.Items))
+	for _, ns := range nsList.Items {
+		namespaces = append(namespaces, ns.Name)
+	}
+	return namespaces, nil
+}
+
+// selectsNamespace reports whether sel selects the namespace ns.
+func selectsNamespace(sel monitoringv1.NamespaceSelector, ns string) bool {
+	if !selectsAll(sel) {
+		return contains(sel.MatchNames, ns)
+	}
+	return len(AllowedNamespaces) == 0 || contains(AllowedNamespaces, ns)
+}
+
+// isCopy reports whether obj was produced by the federator, so it is never
+// federated again.
+func isCopy(obj client.Object) bool {
+	_, found := obj.GetLabels()[LabelKeySourceKind]
+	return found
+}
+
+// copyName returns the name of the copy of the object ns/name. It ends in a
+// hash of ns/name, so copies of objects from different namespaces never
+// collide, even when name-ns does. It is a valid DNS label, so it can be used
+// for Services.
+func copyName(ns, name string) string {
+	return hashedName(name+"-"+ns, ns+"/"+name)
+}
+
+// hashedName returns prefix, truncated and with dots replaced to fit in a DNS
+// label, followed by a short hash of key.
+func hashedName(prefix, key string) string {
+	const maxLen = 63
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	if len(prefix) > maxLen-len(suffix) {
+		prefix = prefix[:maxLen-len(suffix)]
+	}
+	return strings.TrimRight(strings.ReplaceAll(prefix, ".", "-"), "-") + suffix
+}
@@ -0,0 +1,54 @@
+package federate
+
+import (
+	"strings"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestCopyName(t *testing.T) {
+	long := strings.Repeat("x", 63)
+	tests := []struct {
+		ns, name string
+	}{
+		{"demo", "redis"},
+		{"b-c", "redis"},
+		{"c", "redis-b"},
+		{"c-b", "redis"},
+		{long, long},
+		{long, long + "y"},
+		{"demo", "app.metrics"},
+	}
+	seen := map[string]string{}
+	for _, tt := range tests {
+		got := copyName(tt.ns, tt.name)
+		if errs := validation.IsDNS1123Label(got); len(errs) > 0 {
+			t.Errorf("copyName(%s, %s) = %s is not a DNS label: %v", tt.ns, tt.name, got, errs)
+		}
+		if !strings.HasPrefix(got, strings.ReplaceAll(tt.name, ".", "-")[:5]) {
+			t.Errorf("copyName(%s, %s) = %s, want the source name as prefix", tt.ns, tt.name, got)
+		}
+		key := tt.ns + "/" + tt.name
+		if other, found := seen[got]; found {
+			t.Errorf("copyName(%s) = copyName(%s) = %s", key, other, got)
+		}
+		seen[got] = key
+		if again := copyName(tt.ns, tt.name); again != got {
+			t.Errorf("copyName(%s) is not stable: %s != %s", key, got, again)
+		}
+	}
+}
+
+func TestPodMonitorTargetName(t *testing.T) {
+	podMon := &monitoringv1.PodMonitor{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "redis"}}
+	got := podMonitorTargetName(podMon)
+	if errs := validation.IsDNS1123Label(got); len(errs) > 0 {
+		t.Errorf("podMonitorTargetName() = %s is not a DNS label: %v", got, errs)
+	}
+	if same := copyName("demo", "redis-pods"); got == same {
+		t.Errorf("podMonitorTargetName() = %s collides with the copy of a ServiceMonitor named redis-pods", got)
+	}
+}
@@ -0,0 +1,116 @@
+package federate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+const (
+	ActionLabel    = "label"
+	ActionCopy     = "copy"
+	ActionFederate = "federate"
+	ActionSkip     = "skip"
+)
+
+// Plan describes what Reconcile does for a federated ServiceMonitor.
+type Plan struct {
+	ServiceMonitor types.NamespacedName `json:"serviceMonitor"`
+	// AllowedNamespaces are the namespaces the plan assumed for monitors
+	// selecting any namespace. Empty means every namespace.
+	AllowedNamespaces []string     `json:"allowedNamespaces,omitempty"`
+	Targets           []PlanTarget `json:"targets,omitempty"`
+	// Changes are the writes Reconcile makes, computed by running it against
+	// the api server in dry-run mode.
+	Changes []Change `json:"changes,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type PlanTarget struct {
+	Prometheus types.NamespacedName `json:"prometheus"`
+	// Action is label for the default Prometheus, which scrapes the source
+	// ServiceMonitor directly, and copy or federate for project Prometheus.
+	Action    string `json:"action"`
+	Namespace string `json:"namespace,omitempty"`
+	// KeepRegex is the regex of the namespaces whose metrics the project
+	// Prometheus keeps.
+	KeepRegex string `json:"keepRegex,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// federateAction returns what Reconcile or ReconcilePodMonitor does for src,
+// a ServiceMonitor or PodMonitor, with prom. The error says why it skips prom.
+// Only ServiceMonitors can be federated through /federate.
+func federateAction(src client.Object, prom *monitoringv1.Prometheus) (string, error) {
+	kind := "service monitor"
+	svcMon, isSvcMon := src.(*monitoringv1.ServiceMonitor)
+	if !isSvcMon {
+		kind = "pod monitor"
+	}
+
+	switch {
+	case tenancy.IsDefaultPrometheus(prom):
+		return ActionLabel, nil
+	case prom.Namespace == src.GetNamespace():
+		return ActionSkip, fmt.Errorf("federated %s can't be in the same namespace with project Prometheus %s/%s", kind, prom.Namespace, prom.Name)
+	case isSvcMon && useFederateMode(svcMon):
+		return ActionFederate, nil
+	default:
+		return ActionCopy, nil
+	}
+}
+
+// NewPlan computes the Plan for the ServiceMonitor with the given key, as if
+// it were labeled for federation, without changing anything.
+func NewPlan(ctx context.Context, kc client.Client, key types.NamespacedName) (*Plan, error) {
+	dc := &dryRunClient{Client: kc, federated: key}
+
+	var svcMon monitoringv1.ServiceMonitor
+	if err := dc.Get(ctx, key, &svcMon); err != nil {
+		return nil, err
+	}
+	plan := &Plan{ServiceMonitor: key, AllowedNamespaces: AllowedNamespaces}
+
+	var promList monitoringv1.PrometheusList
+	if err := kc.List(ctx, &promList); err != nil {
+		return nil, err
+	}
+	sort.Slice(promList.Items, func(i, j int) bool {
+		return client.ObjectKeyFromObject(promList.Items[i]).String() < client.ObjectKeyFromObject(promList.Items[j]).String()
+	})
+	for _, prom := range promList.Items {
+		target := PlanTarget{
+			Prometheus: client.ObjectKeyFromObject(prom),
+		}
+		action, err := federateAction(&svcMon, prom)
+		target.Action = action
+		switch action {
+		case ActionSkip:
+			target.Reason = err.Error()
+		case ActionLabel:
+			target.Namespace = svcMon.Namespace
+		case ActionCopy, ActionFederate:
+			target.Namespace = prom.Namespace
+			keep, err := keepNamespacesRelabelConfigs(dc, prom)
+			if err != nil {
+				return nil, err
+			}
+			target.KeepRegex = keep[len(keep)-1].Regex
+		}
+		plan.Targets = append(plan.Targets, target)
+	}
+
+	_, err := Reconcile(ctx, dc, nil, reconcile.Request{NamespacedName: key})
+	if err != nil {
+		plan.Error = err.Error()
+	}
+	plan.Changes = dc.changes
+	return plan, nil
+}
@@ -0,0 +1,539 @@
+package federate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+const (
+	// LabelKeyPodMonitor and LabelKeyPodMonitorNamespace identify the
+	// PodMonitor a federated Service was generated for.
+	LabelKeyPodMonitor          = "federate.k8s.appscode.com/podmonitor"
+	LabelKeyPodMonitorNamespace = "federate.k8s.appscode.com/podmonitor-namespace"
+)
+
+// ReconcilePodMonitor federates a PodMonitor labeled mona.PrometheusValueFederated.
+//
+// A project Prometheus ignores namespace selectors, so a copied PodMonitor
+// would only find pods in its own namespace. Instead, the ready pods selected
+// by the PodMonitor are published as a headless Service with manual Endpoints
+// next to each project Prometheus, and scraped through a ServiceMonitor whose
+// endpoints are converted from the podMetricsEndpoints. The default
+// Prometheus sees every PodMonitor, so the PodMonitor is only labeled for it.
+// The results are reported on the PodMonitor like for a ServiceMonitor.
+// recorder may be nil.
+func ReconcilePodMonitor(ctx context.Context, kc client.Client, recorder record.EventRecorder, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var podMon monitoringv1.PodMonitor
+	if err := kc.Get(ctx, req.NamespacedName, &podMon); err != nil {
+		if apierrors.IsNotFound(err) {
+			// the PodMonitor is gone, remove its copies
+			return ctrl.Result{}, prune(kc, monitoringv1.PodMonitorsKind, req.NamespacedName, nil)
+		}
+		log.Error(err, "unable to fetch PodMonitor")
+		return ctrl.Result{}, err
+	}
+
+	// has federate label
+	val, found := podMon.Labels[mona.PrometheusKey]
+	if !found || val != mona.PrometheusValueFederated {
+		return ctrl.Result{}, prune(kc, monitoringv1.PodMonitorsKind, req.NamespacedName, nil)
+	}
+
+	if !tenancy.Enabled(kc) {
+		return ctrl.Result{}, nil
+	}
+
+	pods, err := collectPods(kc, &podMon)
+	if err != nil {
+		report(kc, recorder, monitoringv1.PodMonitorsKind, &podMon, []TargetResult{newTargetResult(kc, nil, nil, []error{err})})
+		return ctrl.Result{}, err
+	}
+	srcSecrets, srcConfigMaps, err := collectCredentials(kc, podMon.Namespace, podMonitorEndpoints(&podMon))
+	if err != nil {
+		report(kc, recorder, monitoringv1.PodMonitorsKind, &podMon, []TargetResult{newTargetResult(kc, nil, nil, []error{err})})
+		return ctrl.Result{}, err
+	}
+
+	var promList monitoringv1.PrometheusList
+	if err := kc.List(context.TODO(), &promList); err != nil {
+		log.Error(err, "unable to list Prometheus")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	var errList []error
+	var desired []client.Object
+	var results []TargetResult
+	for _, prom := range promList.Items {
+		action, err := federateAction(&podMon, prom)
+		if action == ActionSkip {
+			log.Error(err, "bad pod monitor")
+			report(kc, recorder, monitoringv1.PodMonitorsKind, &podMon, []TargetResult{newTargetResult(kc, prom, nil, []error{err})})
+			return ctrl.Result{}, nil // don't retry until podmon changes
+		}
+
+		var objects []client.Object
+		var promErrs []error
+		if action == ActionLabel {
+			objects = []client.Object{&podMon}
+			if err := updatePodMonitorLabels(kc, prom, &podMon); err != nil {
+				promErrs = append(promErrs, err)
+			}
+		} else {
+			objects, promErrs = copyPodMonitorToPrometheus(kc, prom, &podMon, pods, srcSecrets, srcConfigMaps)
+			desired = append(desired, objects...)
+		}
+		errList = append(errList, promErrs...)
+		results = append(results, newTargetResult(kc, prom, objects, promErrs))
+	}
+	if len(errList) == 0 {
+		if err := prune(kc, monitoringv1.PodMonitorsKind, req.NamespacedName, desired); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	report(kc, recorder, monitoringv1.PodMonitorsKind, &podMon, results)
+
+	return ctrl.Result{}, errors.NewAggregate(errList)
+}
+
+// copyPodMonitorToPrometheus publishes the pods of podMon and copies the
+// objects it refers to next to the project Prometheus prom. It returns the
+// objects it produced.
+func copyPodMonitorToPrometheus(
+	kc client.Client,
+	prom *monitoringv1.Prometheus,
+	podMon *monitoringv1.PodMonitor,
+	pods []core.Pod,
+	srcSecrets []core.Secret,
+	srcConfigMaps []core.ConfigMap,
+) ([]client.Object, []error) {
+	targetSvcMon, err := copyPodMonitor(kc, prom, podMon)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var errList []error
+	objects := []client.Object{
+		targetSvcMon,
+		&core.Service{ObjectMeta: metav1.ObjectMeta{Namespace: targetSvcMon.Namespace, Name: targetSvcMon.Name}},
+		&core.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: targetSvcMon.Namespace, Name: targetSvcMon.Name}},
+	}
+	if err := copyPods(kc, podMon, pods, targetSvcMon); err != nil {
+		errList = append(errList, err)
+	}
+	copies, errs := copyCredentials(kc, srcSecrets, srcConfigMaps, targetSvcMon)
+	objects = append(objects, copies...)
+	errList = append(errList, errs...)
+	return objects, errList
+}
+
+// podMonitorTargetName is the name of the ServiceMonitor, Service and
+// Endpoints generated for a PodMonitor. The hash includes the kind, so it
+// never collides with the copy of a ServiceMonitor or Service.
+func podMonitorTargetName(podMon *monitoringv1.PodMonitor) string {
+	return hashedName(podMon.Name+"-pods-"+podMon.Namespace, monitoringv1.PodMonitorsKind+":"+podMon.Namespace+"/"+podMon.Name)
+}
+
+// collectPods returns the running and ready pods selected by podMon, by namespace and name.
+func collectPods(kc client.Client, podMon *monitoringv1.PodMonitor) ([]core.Pod, error) {
+	sel, err := metav1.LabelSelectorAsSelector(&podMon.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, err := selectedNamespaces(kc, podMon.Spec.NamespaceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []core.Pod
+	for _, ns := range namespaces {
+		var podList core.PodList
+		err = kc.List(context.TODO(), &podList, client.InNamespace(ns), client.MatchingLabelsSelector{
+			Selector: sel,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range podList.Items {
+			if pod.Status.PodIP != "" && isPodReady(&pod) {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return pods, nil
+}
+
+func isPodReady(pod *core.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != core.PodRunning {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == core.PodReady {
+			return c.Status == core.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podMonitorEndpoints returns the pod metrics endpoints of podMon as
+// ServiceMonitor endpoints.
+func podMonitorEndpoints(podMon *monitoringv1.PodMonitor) []monitoringv1.Endpoint {
+	endpoints := make([]monitoringv1.Endpoint, 0, len(podMon.Spec.PodMetricsEndpoints))
+	for _, pe := range podMon.Spec.PodMetricsEndpoints {
+		endpoints = append(endpoints, endpointForPodMetricsEndpoint(*pe.DeepCopy()))
+	}
+	return endpoints
+}
+
+func updatePodMonitorLabels(kc client.Client, prom *monitoringv1.Prometheus, src *monitoringv1.PodMonitor) error {
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, src, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.PodMonitor)
+
+		labels, _ := meta_util.LabelsForLabelSelector(prom.Spec.PodMonitorSelector)
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels)
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s PodMonitor %s/%s", vt, src.Namespace, src.Name)
+	return nil
+}
+
+// copyPodMonitor creates the ServiceMonitor that scrapes the pods of src
+// through the Service generated by copyPods.
+func copyPodMonitor(kc client.Client, prom *monitoringv1.Prometheus, src *monitoringv1.PodMonitor) (*monitoringv1.ServiceMonitor, error) {
+	keepNSMetrics, err := keepNamespacesRelabelConfigs(kc, prom)
+	if err != nil {
+		return nil, err
+	}
+
+	target := monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      podMonitorTargetName(src),
+			Namespace: prom.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.ServiceMonitor)
+
+		ref := metav1.NewControllerRef(prom, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "Prometheus",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+
+		labels, _ := meta_util.LabelsForLabelSelector(prom.Spec.ServiceMonitorSelector)
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels, SourceLabels(monitoringv1.PodMonitorsKind, client.ObjectKeyFromObject(src)))
+		delete(obj.Labels, mona.PrometheusKey)
+
+		obj.Spec = monitoringv1.ServiceMonitorSpec{
+			PodTargetLabels: src.Spec.PodTargetLabels,
+			Selector: metav1.LabelSelector{
+				MatchLabels: podMonitorServiceLabels(src),
+			},
+			SampleLimit:           src.Spec.SampleLimit,
+			TargetLimit:           src.Spec.TargetLimit,
+			LabelLimit:            src.Spec.LabelLimit,
+			LabelNameLengthLimit:  src.Spec.LabelNameLengthLimit,
+			LabelValueLengthLimit: src.Spec.LabelValueLengthLimit,
+		}
+		for _, pe := range src.Spec.PodMetricsEndpoints {
+			e := endpointForPodMetricsEndpoint(*pe.DeepCopy())
+
+			e.HonorLabels = true // keep original labels
+			e.MetricRelabelConfigs = withKeepNamespaces(e.MetricRelabelConfigs, keepNSMetrics)
+			renameCredentials(&e, src.Namespace, obj.Name)
+			obj.Spec.Endpoints = append(obj.Spec.Endpoints, e)
+		}
+
+		return obj
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("%s ServiceMonitor %s/%s", vt, target.Namespace, target.Name)
+	return &target, nil
+}
+
+func podMonitorServiceLabels(podMon *monitoringv1.PodMonitor) map[string]string {
+	return map[string]string{
+		LabelKeyPodMonitor:          podMon.Name,
+		LabelKeyPodMonitorNamespace: podMon.Namespace,
+	}
+}
+
+func endpointForPodMetricsEndpoint(pe monitoringv1.PodMetricsEndpoint) monitoringv1.Endpoint {
+	e := monitoringv1.Endpoint{
+		Port:                 podMetricsPortName(pe),
+		Path:                 pe.Path,
+		Scheme:               pe.Scheme,
+		Params:               pe.Params,
+		Interval:             pe.Interval,
+		ScrapeTimeout:        pe.ScrapeTimeout,
+		BearerTokenSecret:    pe.BearerTokenSecret,
+		Authorization:        pe.Authorization,
+		HonorLabels:          pe.HonorLabels,
+		HonorTimestamps:      pe.HonorTimestamps,
+		BasicAuth:            pe.BasicAuth,
+		OAuth2:               pe.OAuth2,
+		MetricRelabelConfigs: pe.MetricRelabelConfigs,
+		RelabelConfigs:       pe.RelabelConfigs,
+		ProxyURL:             pe.ProxyURL,
+		FollowRedirects:      pe.FollowRedirects,
+		EnableHttp2:          pe.EnableHttp2,
+	}
+	if pe.TLSConfig != nil {
+		e.TLSConfig = &monitoringv1.TLSConfig{
+			SafeTLSConfig: pe.TLSConfig.SafeTLSConfig,
+		}
+	}
+	return e
+}
+
+// podMetricsPortName returns the name of the generated Service port for pe.
+// Numeric target ports get a synthetic name.
+func podMetricsPortName(pe monitoringv1.PodMetricsEndpoint) string {
+	if pe.Port != "" {
+		return pe.Port
+	}
+	if pe.TargetPort != nil {
+		if pe.TargetPort.Type == intstr.String {
+			return pe.TargetPort.StrVal
+		}
+		return fmt.Sprintf("port-%d", pe.TargetPort.IntVal)
+	}
+	return ""
+}
+
+// podMetricsPort returns the container port of pod that pe scrapes, or 0.
+func podMetricsPort(pod *core.Pod, pe monitoringv1.PodMetricsEndpoint) int32 {
+	name := pe.Port
+	if name == "" && pe.TargetPort != nil {
+		if pe.TargetPort.Type == intstr.Int {
+			return pe.TargetPort.IntVal
+		}
+		name = pe.TargetPort.StrVal
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == name {
+				return p.ContainerPort
+			}
+		}
+	}
+	return 0
+}
+
+// copyPods publishes pods as a headless Service and Endpoints next to targetSvcMon.
+func copyPods(kc client.Client, podMon *monitoringv1.PodMonitor, pods []core.Pod, targetSvcMon *monitoringv1.ServiceMonitor) error {
+	ref := metav1.NewControllerRef(targetSvcMon, schema.GroupVersionKind{
+		Group:   monitoring.GroupName,
+		Version: monitoringv1.Version,
+		Kind:    "ServiceMonitor",
+	})
+
+	var svcPorts []core.ServicePort
+	var subsets []core.EndpointSubset
+	for _, pod := range pods {
+		subset := core.EndpointSubset{
+			Addresses: []core.EndpointAddress{
+				{
+					IP:       pod.Status.PodIP,
+					NodeName: pointerOrNil(pod.Spec.NodeName),
+					TargetRef: &core.ObjectReference{
+						Kind:      "Pod",
+						Namespace: pod.Namespace,
+						Name:      pod.Name,
+						UID:       pod.UID,
+					},
+				},
+			},
+		}
+		for _, pe := range podMon.Spec.PodMetricsEndpoints {
+			port := podMetricsPort(&pod, pe)
+			if port == 0 {
+				continue
+			}
+			name := podMetricsPortName(pe)
+			subset.Ports = UpsertEndpointPort(subset.Ports, core.EndpointPort{
+				Name: name,
+				Port: port,
+			})
+			if !hasServicePort(svcPorts, name) {
+				svcPorts = append(svcPorts, core.ServicePort{
+					Name:       name,
+					Port:       port,
+					TargetPort: intstr.FromInt(int(port)),
+				})
+			}
+		}
+		if len(subset.Ports) > 0 {
+			subsets = append(subsets, subset)
+		}
+	}
+
+	svc := core.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      targetSvcMon.Name,
+			Namespace: targetSvcMon.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &svc, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Service)
+
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, podMonitorServiceLabels(podMon), trackingLabels(targetSvcMon))
+
+		obj.Spec.Type = core.ServiceTypeClusterIP
+		if createOp {
+			obj.Spec.ClusterIP = core.ClusterIPNone
+		}
+		obj.Spec.Selector = nil
+		for _, port := range svcPorts {
+			obj.Spec.Ports = UpsertServicePort(obj.Spec.Ports, port)
+		}
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s Service %s/%s", vt, svc.Namespace, svc.Name)
+
+	ep := core.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      targetSvcMon.Name,
+			Namespace: targetSvcMon.Namespace,
+		},
+	}
+	vt, err = cu.CreateOrPatch(context.TODO(), kc, &ep, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Endpoints)
+
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, podMonitorServiceLabels(podMon), trackingLabels(targetSvcMon), map[string]string{
+			discovery.LabelSkipMirror: "true",
+		})
+		obj.Subsets = subsets
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s Endpoints %s/%s", vt, ep.Namespace, ep.Name)
+	return nil
+}
+
+func hasServicePort(ports []core.ServicePort, name string) bool {
+	for _, p := range ports {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func pointerOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// pod -> []podMonitors
+func PodMonitorsForPod(kc client.Client, obj client.Object) []reconcile.Request {
+	var list monitoringv1.PodMonitorList
+	err := kc.List(context.TODO(), &list, client.MatchingLabels{
+		mona.PrometheusKey: mona.PrometheusValueFederated,
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	var req []reconcile.Request
+	for _, podMon := range list.Items {
+		if !selectsNamespace(podMon.Spec.NamespaceSelector, obj.GetNamespace()) {
+			continue
+		}
+		sel, err := metav1.LabelSelectorAsSelector(&podMon.Spec.Selector)
+		if err != nil {
+			continue
+		}
+		if sel.Matches(labels.Set(obj.GetLabels())) {
+			req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(podMon)})
+		}
+	}
+	return req
+}
+
+// secret or configmap -> []podMonitors
+func PodMonitorsForCredential(kc client.Client, obj client.Object) []reconcile.Request {
+	var list monitoringv1.PodMonitorList
+	err := kc.List(context.TODO(), &list, client.InNamespace(obj.GetNamespace()), client.MatchingLabels{
+		mona.PrometheusKey: mona.PrometheusValueFederated,
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	var req []reconcile.Request
+	for _, podMon := range list.Items {
+		if refersTo(podMonitorEndpoints(podMon), obj) {
+			req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(podMon)})
+		}
+	}
+	return req
+}
+
+// Prometheus or namespace -> []podMonitors
+func PodMonitorsForPrometheus(kc client.Client, obj client.Object) []reconcile.Request {
+	var list monitoringv1.PodMonitorList
+	err := kc.List(context.TODO(), &list, client.MatchingLabels{
+		mona.PrometheusKey: mona.PrometheusValueFederated,
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	var req []reconcile.Request
+	for _, podMon := range list.Items {
+		req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(podMon)})
+	}
+	return req
+}
@@ -0,0 +1,96 @@
+package federate
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+func TestCopyPodMonitor(t *testing.T) {
+	prom := &monitoringv1.Prometheus{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "t1-monitoring",
+			Name:        "prom",
+			UID:         "prom-uid",
+			Annotations: map[string]string{tenancy.AnnotationKeyTenantNamespaces: "app"},
+		},
+		Spec: monitoringv1.PrometheusSpec{
+			CommonPrometheusFields: monitoringv1.CommonPrometheusFields{
+				ServiceMonitorSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"release": "t1"}},
+			},
+		},
+	}
+	src := &monitoringv1.PodMonitor{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "demo",
+			Name:      "redis",
+			Labels: map[string]string{
+				mona.PrometheusKey: mona.PrometheusValueFederated,
+				// added by the reconciler for the PodMonitorSelector of the default Prometheus
+				"release": "cluster",
+				"team":    "db",
+			},
+		},
+		Spec: monitoringv1.PodMonitorSpec{
+			PodMetricsEndpoints: []monitoringv1.PodMetricsEndpoint{{Port: "metrics"}},
+		},
+	}
+	kc := testutil.NewFakeClient(t, prom, src)
+
+	target, err := copyPodMonitor(kc, prom, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got monitoringv1.ServiceMonitor
+	if err := kc.Get(context.TODO(), client.ObjectKeyFromObject(target), &got); err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := SourceLabels(monitoringv1.PodMonitorsKind, client.ObjectKeyFromObject(src))
+	wantLabels["release"] = "t1"
+	if !reflect.DeepEqual(got.Labels, wantLabels) {
+		t.Errorf("copy labels = %v, want %v", got.Labels, wantLabels)
+	}
+}
+
+func TestReconcilePodMonitorSameNamespace(t *testing.T) {
+	defer func(v types.NamespacedName) { tenancy.DefaultPrometheus = v }(tenancy.DefaultPrometheus)
+	tenancy.DefaultPrometheus = types.NamespacedName{Namespace: "monitoring", Name: "prom"}
+
+	prom := &monitoringv1.Prometheus{ObjectMeta: metav1.ObjectMeta{Namespace: "t1-monitoring", Name: "prom"}}
+	src := &monitoringv1.PodMonitor{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: prom.Namespace,
+			Name:      "redis",
+			Labels:    map[string]string{mona.PrometheusKey: mona.PrometheusValueFederated},
+		},
+	}
+	kc := testutil.NewFakeClient(t, prom, src)
+
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(src)}
+	if _, err := ReconcilePodMonitor(context.TODO(), kc, nil, req); err != nil {
+		t.Fatal(err)
+	}
+
+	var got monitoringv1.PodMonitor
+	if err := kc.Get(context.TODO(), req.NamespacedName, &got); err != nil {
+		t.Fatal(err)
+	}
+	var results []TargetResult
+	if err := json.Unmarshal([]byte(got.Annotations[AnnotationKeyStatus]), &results); err != nil {
+		t.Fatalf("status annotation %q: %v", got.Annotations[AnnotationKeyStatus], err)
+	}
+	if len(results) != 1 || results[0].Prometheus != "t1-monitoring/prom" || results[0].Error == "" {
+		t.Errorf("status = %+v, want the same namespace error for t1-monitoring/prom", results)
+	}
+}
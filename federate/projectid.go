@@ -0,0 +1,279 @@
+package federate
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+	"github.com/tamalsaha/rancid-syncer/trickster"
+)
+
+// ReconcileProjectID keeps the tenancy.LabelNameProjectID metric relabel
+// configs of a ServiceMonitor selected by the cluster Prometheus in sync with
+// the namespaces of each project. Every series scraped for it then carries
+// the id of the project of its namespace label, so project Prometheus and
+// dashboards can filter with project_id="<id>".
+//
+// Metric relabel configs that set tenancy.LabelNameProjectID are owned by the
+// syncer and are replaced on every reconcile. The namespace regexes are
+// capped the same way as the keep configs of federated copies.
+// ServiceMonitors managed by another tool, eg. Helm, are left alone.
+func ReconcileProjectID(ctx context.Context, kc client.Client, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var svcMon monitoringv1.ServiceMonitor
+	if err := kc.Get(ctx, req.NamespacedName, &svcMon); err != nil {
+		log.Error(err, "unable to fetch ServiceMonitor")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if isCopy(&svcMon) {
+		return ctrl.Result{}, nil
+	}
+
+	configs, skip, err := projectIDConfigsFor(ctx, kc, &svcMon, func(prom *monitoringv1.Prometheus) (*metav1.LabelSelector, *metav1.LabelSelector) {
+		return prom.Spec.ServiceMonitorSelector, prom.Spec.ServiceMonitorNamespaceSelector
+	})
+	if err != nil || skip {
+		return ctrl.Result{}, err
+	}
+
+	changed := false
+	endpoints := make([]monitoringv1.Endpoint, len(svcMon.Spec.Endpoints))
+	for i, e := range svcMon.Spec.Endpoints {
+		e.MetricRelabelConfigs = withProjectID(e.MetricRelabelConfigs, configs)
+		changed = changed || relabelConfigsChanged(svcMon.Spec.Endpoints[i].MetricRelabelConfigs, e.MetricRelabelConfigs)
+		endpoints[i] = e
+	}
+	if !changed {
+		return ctrl.Result{}, nil
+	}
+
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &svcMon, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.ServiceMonitor)
+		obj.Spec.Endpoints = endpoints
+		return obj
+	})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	klog.Infof("%s ServiceMonitor %s/%s", vt, svcMon.Namespace, svcMon.Name)
+	return ctrl.Result{}, nil
+}
+
+// ReconcilePodMonitorProjectID does for a PodMonitor selected by the cluster
+// Prometheus what ReconcileProjectID does for a ServiceMonitor.
+func ReconcilePodMonitorProjectID(ctx context.Context, kc client.Client, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var podMon monitoringv1.PodMonitor
+	if err := kc.Get(ctx, req.NamespacedName, &podMon); err != nil {
+		log.Error(err, "unable to fetch PodMonitor")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	configs, skip, err := projectIDConfigsFor(ctx, kc, &podMon, func(prom *monitoringv1.Prometheus) (*metav1.LabelSelector, *metav1.LabelSelector) {
+		return prom.Spec.PodMonitorSelector, prom.Spec.PodMonitorNamespaceSelector
+	})
+	if err != nil || skip {
+		return ctrl.Result{}, err
+	}
+
+	changed := false
+	endpoints := make([]monitoringv1.PodMetricsEndpoint, len(podMon.Spec.PodMetricsEndpoints))
+	for i, e := range podMon.Spec.PodMetricsEndpoints {
+		e.MetricRelabelConfigs = withProjectID(e.MetricRelabelConfigs, configs)
+		changed = changed || relabelConfigsChanged(podMon.Spec.PodMetricsEndpoints[i].MetricRelabelConfigs, e.MetricRelabelConfigs)
+		endpoints[i] = e
+	}
+	if !changed {
+		return ctrl.Result{}, nil
+	}
+
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &podMon, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.PodMonitor)
+		obj.Spec.PodMetricsEndpoints = endpoints
+		return obj
+	})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	klog.Infof("%s PodMonitor %s/%s", vt, podMon.Namespace, podMon.Name)
+	return ctrl.Result{}, nil
+}
+
+// projectIDConfigsFor returns the tenancy.LabelNameProjectID relabel configs
+// for obj, a ServiceMonitor or PodMonitor: none if the cluster Prometheus does
+// not select it with the selectors returned by selectors. skip is true when
+// obj must not be changed at all.
+func projectIDConfigsFor(
+	ctx context.Context,
+	kc client.Client,
+	obj client.Object,
+	selectors func(prom *monitoringv1.Prometheus) (*metav1.LabelSelector, *metav1.LabelSelector),
+) (configs []*monitoringv1.RelabelConfig, skip bool, err error) {
+	if managedByOther(obj) || !tenancy.Enabled(kc) {
+		return nil, true, nil
+	}
+
+	var clusterProm monitoringv1.Prometheus
+	err = kc.Get(ctx, tenancy.DefaultPrometheusKey(), &clusterProm)
+	if apierrors.IsNotFound(err) {
+		return nil, true, nil
+	} else if err != nil {
+		log.FromContext(ctx).Error(err, "unable to fetch cluster Prometheus")
+		return nil, false, err
+	}
+
+	sel, nsSel := selectors(&clusterProm)
+	selected, err := selectedByPrometheus(kc, &clusterProm, obj, sel, nsSel)
+	if err != nil || !selected {
+		return nil, false, err
+	}
+	configs, err = projectIDRelabelConfigs(kc)
+	return configs, false, err
+}
+
+// managedByOther reports whether obj is labeled as managed by a tool other
+// than the syncer, which would revert or fight over its relabel configs.
+func managedByOther(obj client.Object) bool {
+	v, ok := obj.GetLabels()[meta_util.ManagedByLabelKey]
+	return ok && v != trickster.OwnedLabels[meta_util.ManagedByLabelKey]
+}
+
+// relabelConfigsChanged reports whether the relabel configs of an endpoint
+// changed from before to after.
+func relabelConfigsChanged(before, after []*monitoringv1.RelabelConfig) bool {
+	return (len(before) > 0 || len(after) > 0) && !reflect.DeepEqual(before, after)
+}
+
+// selectedByPrometheus reports whether prom scrapes obj, a ServiceMonitor or
+// PodMonitor, given its selector sel and namespace selector nsSel for them.
+func selectedByPrometheus(kc client.Client, prom *monitoringv1.Prometheus, obj client.Object, sel, nsSel *metav1.LabelSelector) (bool, error) {
+	if sel == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(sel)
+	if err != nil {
+		return false, err
+	}
+	if !selector.Matches(labels.Set(obj.GetLabels())) {
+		return false, nil
+	}
+
+	if nsSel == nil {
+		// Prometheus only watches its own namespace
+		return obj.GetNamespace() == prom.Namespace, nil
+	}
+	nsSelector, err := metav1.LabelSelectorAsSelector(nsSel)
+	if err != nil {
+		return false, err
+	}
+	var ns core.Namespace
+	if err := kc.Get(context.TODO(), client.ObjectKey{Name: obj.GetNamespace()}, &ns); err != nil {
+		return false, err
+	}
+	return nsSelector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// projectIDRelabelConfigs returns the metric relabel configs, sorted by
+// project id, that set tenancy.LabelNameProjectID on the series of the
+// namespaces of each project. The namespace regexes are capped by
+// tenancy.MaxNamespaceRegexLen, so a large project gets several configs.
+func projectIDRelabelConfigs(kc client.Client) ([]*monitoringv1.RelabelConfig, error) {
+	var nsList core.NamespaceList
+	if err := kc.List(context.TODO(), &nsList); err != nil {
+		return nil, err
+	}
+
+	projects := map[string][]string{}
+	for _, ns := range nsList.Items {
+		if id := tenancy.ProjectID(kc, &ns); id != "" {
+			projects[id] = append(projects[id], ns.Name)
+		}
+	}
+	ids := make([]string, 0, len(projects))
+	for id := range projects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var configs []*monitoringv1.RelabelConfig
+	for _, id := range ids {
+		namespaces := projects[id]
+		sort.Strings(namespaces)
+		configs = append(configs, tenancy.ProjectIDRelabelConfigs(id, namespaces)...)
+	}
+	return configs, nil
+}
+
+// withProjectID replaces the tenancy.LabelNameProjectID relabel configs in
+// configs with projectIDs, keeping every other config in order.
+func withProjectID(configs, projectIDs []*monitoringv1.RelabelConfig) []*monitoringv1.RelabelConfig {
+	var out []*monitoringv1.RelabelConfig
+	for _, c := range configs {
+		if c.TargetLabel != tenancy.LabelNameProjectID {
+			out = append(out, c)
+		}
+	}
+	for _, c := range projectIDs {
+		out = append(out, c.DeepCopy())
+	}
+	return out
+}
+
+// namespace or cluster Prometheus -> []serviceMonitors
+//
+// A namespace moving between projects changes the relabel configs of every
+// ServiceMonitor the cluster Prometheus selects.
+func ServiceMonitorsForProjectID(kc client.Client, obj client.Object) []reconcile.Request {
+	if prom, ok := obj.(*monitoringv1.Prometheus); ok && !tenancy.IsDefaultPrometheus(prom) {
+		return nil
+	}
+
+	var list monitoringv1.ServiceMonitorList
+	if err := kc.List(context.TODO(), &list); err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	var req []reconcile.Request
+	for _, svcMon := range list.Items {
+		if !isCopy(svcMon) {
+			req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svcMon)})
+		}
+	}
+	return req
+}
+
+// namespace or cluster Prometheus -> []podMonitors
+func PodMonitorsForProjectID(kc client.Client, obj client.Object) []reconcile.Request {
+	if prom, ok := obj.(*monitoringv1.Prometheus); ok && !tenancy.IsDefaultPrometheus(prom) {
+		return nil
+	}
+
+	var list monitoringv1.PodMonitorList
+	if err := kc.List(context.TODO(), &list); err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	req := make([]reconcile.Request, 0, len(list.Items))
+	for _, podMon := range list.Items {
+		req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(podMon)})
+	}
+	return req
+}
@@ -0,0 +1,138 @@
+package federate
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	meta_util "kmodules.xyz/client-go/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+func TestProjectIDRelabelConfigs(t *testing.T) {
+	defer func(v string) { tenancy.NamespaceLabelKey = v }(tenancy.NamespaceLabelKey)
+	tenancy.NamespaceLabelKey = "tenant"
+	defer func(v int) { tenancy.MaxNamespaceRegexLen = v }(tenancy.MaxNamespaceRegexLen)
+	tenancy.MaxNamespaceRegexLen = 256
+
+	objs := []client.Object{
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other", Labels: map[string]string{"tenant": "t2"}}},
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "untagged"}},
+	}
+	for i := 0; i < 100; i++ {
+		objs = append(objs, &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("ns-%03d", i), Labels: map[string]string{"tenant": "t1"}}})
+	}
+	kc := testutil.NewFakeClient(t, objs...)
+
+	configs, err := projectIDRelabelConfigs(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) < 3 {
+		t.Fatalf("projectIDRelabelConfigs() returned %d configs, want the t1 namespaces split under the cap", len(configs))
+	}
+	namespaces := map[string]string{}
+	for _, c := range configs {
+		if len(c.Regex) > tenancy.MaxNamespaceRegexLen {
+			t.Errorf("regex %q is longer than %d", c.Regex, tenancy.MaxNamespaceRegexLen)
+		}
+		if c.TargetLabel != tenancy.LabelNameProjectID {
+			t.Errorf("target label = %s, want %s", c.TargetLabel, tenancy.LabelNameProjectID)
+		}
+		for _, ns := range []string{"other", "untagged", "ns-000", "ns-099"} {
+			lbls := map[string]string{"namespace": ns}
+			relabel([]*monitoringv1.RelabelConfig{c}, lbls)
+			if id := lbls[tenancy.LabelNameProjectID]; id != "" {
+				if prev, ok := namespaces[ns]; ok {
+					t.Errorf("namespace %s is matched by project %s and %s", ns, prev, id)
+				}
+				namespaces[ns] = id
+			}
+		}
+	}
+	want := map[string]string{"other": "t2", "ns-000": "t1", "ns-099": "t1"}
+	if !reflect.DeepEqual(namespaces, want) {
+		t.Errorf("project ids = %v, want %v", namespaces, want)
+	}
+	if last := configs[len(configs)-1]; last.Replacement != "t2" {
+		t.Errorf("configs are not sorted by project id, last is %s", last.Replacement)
+	}
+}
+
+func TestWithProjectID(t *testing.T) {
+	drop := &monitoringv1.RelabelConfig{SourceLabels: []monitoringv1.LabelName{"__name__"}, Regex: "go_.*", Action: "drop"}
+	stale := &monitoringv1.RelabelConfig{SourceLabels: []monitoringv1.LabelName{"namespace"}, Regex: "a", TargetLabel: tenancy.LabelNameProjectID, Replacement: "old"}
+	fresh := tenancy.ProjectIDRelabelConfigs("t1", []string{"a", "b"})
+
+	got := withProjectID([]*monitoringv1.RelabelConfig{stale, drop}, fresh)
+	want := append([]*monitoringv1.RelabelConfig{drop}, fresh...)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withProjectID() = %v, want %v", got, want)
+	}
+	if got := withProjectID([]*monitoringv1.RelabelConfig{stale}, nil); len(got) != 0 {
+		t.Errorf("withProjectID() without projects = %v, want none", got)
+	}
+}
+
+func TestReconcilePodMonitorProjectID(t *testing.T) {
+	defer func(v string) { tenancy.NamespaceLabelKey = v }(tenancy.NamespaceLabelKey)
+	tenancy.NamespaceLabelKey = "tenant"
+	defer func(v types.NamespacedName) { tenancy.DefaultPrometheus = v }(tenancy.DefaultPrometheus)
+	tenancy.DefaultPrometheus = types.NamespacedName{Namespace: "monitoring", Name: "prom"}
+
+	clusterProm := &monitoringv1.Prometheus{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "prom"},
+		Spec: monitoringv1.PrometheusSpec{
+			CommonPrometheusFields: monitoringv1.CommonPrometheusFields{
+				PodMonitorSelector:          &metav1.LabelSelector{MatchLabels: map[string]string{"release": "cluster"}},
+				PodMonitorNamespaceSelector: &metav1.LabelSelector{},
+			},
+		},
+	}
+	podMon := func(name string, labels map[string]string) *monitoringv1.PodMonitor {
+		return &monitoringv1.PodMonitor{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: name, Labels: labels},
+			Spec: monitoringv1.PodMonitorSpec{
+				PodMetricsEndpoints: []monitoringv1.PodMetricsEndpoint{{Port: "metrics"}},
+			},
+		}
+	}
+	kc := testutil.NewFakeClient(t,
+		clusterProm,
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "demo", Labels: map[string]string{"tenant": "t1"}}},
+		podMon("selected", map[string]string{"release": "cluster"}),
+		podMon("unselected", nil),
+		podMon("helm", map[string]string{"release": "cluster", meta_util.ManagedByLabelKey: "Helm"}),
+	)
+
+	want := tenancy.ProjectIDRelabelConfigs("t1", []string{"demo"})
+	for _, tc := range []struct {
+		name string
+		want []*monitoringv1.RelabelConfig
+	}{
+		{name: "selected", want: want},
+		{name: "unselected", want: nil},
+		{name: "helm", want: nil},
+	} {
+		key := client.ObjectKey{Namespace: "demo", Name: tc.name}
+		if _, err := ReconcilePodMonitorProjectID(context.TODO(), kc, ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+		var got monitoringv1.PodMonitor
+		if err := kc.Get(context.TODO(), key, &got); err != nil {
+			t.Fatal(err)
+		}
+		if configs := got.Spec.PodMetricsEndpoints[0].MetricRelabelConfigs; !reflect.DeepEqual(configs, tc.want) {
+			t.Errorf("PodMonitor %s metric relabel configs = %v, want %v", tc.name, configs, tc.want)
+		}
+	}
+}
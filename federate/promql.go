@@ -0,0 +1,219 @@
+package federate
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// identifiers that are never metric names
+	promqlKeywords = map[string]bool{
+		"and": true, "or": true, "unless": true, "bool": true, "offset": true, "atan2": true,
+		"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+		"inf": true, "nan": true,
+	}
+	// aggregation operators, which may be followed by a grouping clause instead of "("
+	promqlAggregations = map[string]bool{
+		"sum": true, "min": true, "max": true, "avg": true, "group": true, "stddev": true, "stdvar": true,
+		"count": true, "count_values": true, "bottomk": true, "topk": true, "quantile": true,
+	}
+	// keywords followed by a parenthesized list of label names
+	promqlGroupings = map[string]bool{
+		"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+	}
+)
+
+// InjectLabelMatcher adds matcher, eg. namespace=~"a|b", to every vector
+// selector in the PromQL expression expr. It only tokenizes expr, so it keeps
+// the original formatting, but it does not validate expr.
+func InjectLabelMatcher(expr, matcher string) (string, error) {
+	var out strings.Builder
+	skipGrouping := false
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			end, err := scanString(expr, i)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expr[i:end])
+			i = end
+		case c == '#':
+			end := strings.IndexByte(expr[i:], '\n')
+			if end < 0 {
+				end = len(expr) - i
+			}
+			out.WriteString(expr[i : i+end])
+			i += end
+		case c == '[':
+			end, err := scanBracket(expr, i, '[', ']')
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expr[i:end])
+			i = end
+		case c == '{':
+			// selector without a metric name
+			end, err := scanBracket(expr, i, '{', '}')
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(injectIntoBraces(expr[i:end], matcher))
+			i = end
+		case c == '(' && skipGrouping:
+			end, err := scanBracket(expr, i, '(', ')')
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expr[i:end])
+			i = end
+			skipGrouping = false
+		case isDigit(c) || (c == '.' && i+1 < len(expr) && isDigit(expr[i+1])):
+			// numbers and durations
+			end := i
+			for end < len(expr) && (isIdentChar(expr[end]) || expr[end] == '.' ||
+				((expr[end] == '+' || expr[end] == '-') && (expr[end-1] == 'e' || expr[end-1] == 'E'))) {
+				end++
+			}
+			out.WriteString(expr[i:end])
+			i = end
+		case isIdentStart(c):
+			end := i
+			for end < len(expr) && isIdentChar(expr[end]) {
+				end++
+			}
+			ident := expr[i:end]
+			out.WriteString(ident)
+			i = end
+
+			next := skipSpace(expr, i)
+			lower := strings.ToLower(ident)
+			switch {
+			case promqlGroupings[lower]:
+				// group_left and group_right may come without a label list
+				skipGrouping = next < len(expr) && expr[next] == '('
+			case promqlKeywords[lower], promqlAggregations[lower]:
+			case next < len(expr) && expr[next] == '(':
+				// function call
+			case next < len(expr) && expr[next] == '{':
+				end, err := scanBracket(expr, next, '{', '}')
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(expr[i:next])
+				out.WriteString(injectIntoBraces(expr[next:end], matcher))
+				i = end
+			default:
+				out.WriteString("{" + matcher + "}")
+			}
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String(), nil
+}
+
+// CallsFunction reports whether the PromQL expression expr calls any of the
+// functions. Like InjectLabelMatcher, it only tokenizes expr.
+func CallsFunction(expr string, functions ...string) (bool, error) {
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			end, err := scanString(expr, i)
+			if err != nil {
+				return false, err
+			}
+			i = end
+		case c == '#':
+			end := strings.IndexByte(expr[i:], '\n')
+			if end < 0 {
+				return false, nil
+			}
+			i += end
+		case isIdentStart(c) && (i == 0 || !isIdentChar(expr[i-1]) && expr[i-1] != '.'):
+			end := i
+			for end < len(expr) && isIdentChar(expr[end]) {
+				end++
+			}
+			next := skipSpace(expr, end)
+			if next < len(expr) && expr[next] == '(' {
+				for _, fn := range functions {
+					if expr[i:end] == fn {
+						return true, nil
+					}
+				}
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+	return false, nil
+}
+
+func injectIntoBraces(s, matcher string) string {
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return "{" + matcher + "}"
+	}
+	return "{" + matcher + "," + s[1:]
+}
+
+func scanString(s string, start int) (int, error) {
+	q := s[start]
+	for i := start + 1; i < len(s); i++ {
+		if s[i] == '\\' && q != '`' {
+			i++
+			continue
+		}
+		if s[i] == q {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at %d in %q", start, s)
+}
+
+func scanBracket(s string, start int, open, close byte) (int, error) {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'', '`':
+			end, err := scanString(s, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end - 1
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unbalanced %c at %d in %q", open, start, s)
+}
+
+func skipSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
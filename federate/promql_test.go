@@ -0,0 +1,150 @@
+package federate
+
+import (
+	"testing"
+)
+
+func TestInjectLabelMatcher(t *testing.T) {
+	const m = `namespace=~"a|b"`
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{
+			name: "metric",
+			expr: `up`,
+			want: `up{namespace=~"a|b"}`,
+		},
+		{
+			name: "metric with matchers",
+			expr: `up{job="x"}`,
+			want: `up{namespace=~"a|b",job="x"}`,
+		},
+		{
+			name: "selector without metric name",
+			expr: `{__name__="up"}`,
+			want: `{namespace=~"a|b",__name__="up"}`,
+		},
+		{
+			name: "empty braces",
+			expr: `up{}`,
+			want: `up{namespace=~"a|b"}`,
+		},
+		{
+			name: "function and range",
+			expr: `rate(http_requests_total[5m])`,
+			want: `rate(http_requests_total{namespace=~"a|b"}[5m])`,
+		},
+		{
+			name: "aggregation by",
+			expr: `sum by (job) (rate(x_total[5m]))`,
+			want: `sum by (job) (rate(x_total{namespace=~"a|b"}[5m]))`,
+		},
+		{
+			name: "aggregation without after",
+			expr: `sum(x) without (instance)`,
+			want: `sum(x{namespace=~"a|b"}) without (instance)`,
+		},
+		{
+			name: "on and group_left with labels",
+			expr: `a * on(pod) group_left(node) b`,
+			want: `a{namespace=~"a|b"} * on(pod) group_left(node) b{namespace=~"a|b"}`,
+		},
+		{
+			name: "ignoring and bare group_right",
+			expr: `a / ignoring(code) group_right b + c`,
+			want: `a{namespace=~"a|b"} / ignoring(code) group_right b{namespace=~"a|b"} + c{namespace=~"a|b"}`,
+		},
+		{
+			name: "bare group_left followed by a function",
+			expr: `kube_pod_info * on(pod) group_left kube_pod_labels + rate(x_total[5m])`,
+			want: `kube_pod_info{namespace=~"a|b"} * on(pod) group_left kube_pod_labels{namespace=~"a|b"} + rate(x_total{namespace=~"a|b"}[5m])`,
+		},
+		{
+			name: "set operators and bool",
+			expr: `a and b or c unless d > bool 1`,
+			want: `a{namespace=~"a|b"} and b{namespace=~"a|b"} or c{namespace=~"a|b"} unless d{namespace=~"a|b"} > bool 1`,
+		},
+		{
+			name: "subquery",
+			expr: `max_over_time(rate(x_total[1m])[5m:30s])`,
+			want: `max_over_time(rate(x_total{namespace=~"a|b"}[1m])[5m:30s])`,
+		},
+		{
+			name: "offset and at",
+			expr: `x offset 5m + y @ 1609746000 + z @ end()`,
+			want: `x{namespace=~"a|b"} offset 5m + y{namespace=~"a|b"} @ 1609746000 + z{namespace=~"a|b"} @ end()`,
+		},
+		{
+			name: "numbers",
+			expr: `x > 1e3 and y < 0x1F and z != .5`,
+			want: `x{namespace=~"a|b"} > 1e3 and y{namespace=~"a|b"} < 0x1F and z{namespace=~"a|b"} != .5`,
+		},
+		{
+			name: "strings",
+			expr: `label_replace(up, "dst", "$1", "src", "(by|on) x{")`,
+			want: `label_replace(up{namespace=~"a|b"}, "dst", "$1", "src", "(by|on) x{")`,
+		},
+		{
+			name: "braces with string",
+			expr: "up{job=`a}b`}",
+			want: "up{namespace=~\"a|b\",job=`a}b`}",
+		},
+		{
+			name: "comment",
+			expr: "up # not a metric\n+ down",
+			want: "up{namespace=~\"a|b\"} # not a metric\n+ down{namespace=~\"a|b\"}",
+		},
+		{
+			name: "recording rule name",
+			expr: `job:http_requests:rate5m`,
+			want: `job:http_requests:rate5m{namespace=~"a|b"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := InjectLabelMatcher(tt.expr, m)
+			if err != nil {
+				t.Fatalf("InjectLabelMatcher() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("InjectLabelMatcher() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectLabelMatcherInvalid(t *testing.T) {
+	for _, expr := range []string{`up{job="x"`, `rate(x[5m)`, `up{job="x}`} {
+		if _, err := InjectLabelMatcher(expr, `namespace="a"`); err == nil {
+			t.Errorf("InjectLabelMatcher(%s) expected error", expr)
+		}
+	}
+}
+
+func TestCallsFunction(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: `absent(up{job="x"})`, want: true},
+		{expr: `sum(rate(x[5m])) > 0 or absent_over_time(up[5m])`, want: true},
+		{expr: `absent (up)`, want: true},
+		{expr: `up{job="absent(x)"}`, want: false},
+		{expr: `not_absent(up)`, want: false},
+		{expr: `absent_metric > 0`, want: false},
+		{expr: "up # absent(up)\n", want: false},
+		{expr: `rate(x[5m])`, want: false},
+	}
+	for _, tt := range tests {
+		got, err := CallsFunction(tt.expr, "absent", "absent_over_time")
+		if err != nil {
+			t.Errorf("CallsFunction(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CallsFunction(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
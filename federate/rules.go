@@ -0,0 +1,203 @@
+package federate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+// ReconcilePrometheusRule federates a PrometheusRule labeled
+// mona.PrometheusValueFederated. The default Prometheus gets the rule
+// labeled for its RuleSelector. Every project Prometheus gets a copy in its
+// namespace, where each expression only sees the namespaces of the project.
+// Rules calling absent or absent_over_time are left out of the copies.
+func ReconcilePrometheusRule(ctx context.Context, kc client.Client, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var rule monitoringv1.PrometheusRule
+	if err := kc.Get(ctx, req.NamespacedName, &rule); err != nil {
+		if apierrors.IsNotFound(err) {
+			// the PrometheusRule is gone, remove its copies
+			return ctrl.Result{}, prune(kc, monitoringv1.PrometheusRuleKind, req.NamespacedName, nil)
+		}
+		log.Error(err, "unable to fetch PrometheusRule")
+		return ctrl.Result{}, err
+	}
+
+	// has federate label
+	val, found := rule.Labels[mona.PrometheusKey]
+	if !found || val != mona.PrometheusValueFederated {
+		return ctrl.Result{}, prune(kc, monitoringv1.PrometheusRuleKind, req.NamespacedName, nil)
+	}
+
+	if !tenancy.Enabled(kc) {
+		return ctrl.Result{}, nil
+	}
+
+	var promList monitoringv1.PrometheusList
+	if err := kc.List(context.TODO(), &promList); err != nil {
+		log.Error(err, "unable to list Prometheus")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	var errList []error
+	var desired []client.Object
+	for _, prom := range promList.Items {
+		isDefault := tenancy.IsDefaultPrometheus(prom)
+
+		if !isDefault && prom.Namespace == req.Namespace {
+			err := fmt.Errorf("federated prometheus rule can't be in the same namespace with project Prometheus %s/%s", prom.Namespace, prom.Name)
+			log.Error(err, "bad prometheus rule")
+			return ctrl.Result{}, nil // don't retry until rule changes
+		}
+
+		if isDefault {
+			if err := updatePrometheusRuleLabels(kc, prom, &rule); err != nil {
+				errList = append(errList, err)
+			}
+		} else {
+			desired = append(desired, &monitoringv1.PrometheusRule{ObjectMeta: metav1.ObjectMeta{Namespace: prom.Namespace, Name: copyName(rule.Namespace, rule.Name)}})
+
+			if err := copyPrometheusRule(kc, prom, &rule); err != nil {
+				errList = append(errList, err)
+			}
+		}
+	}
+	if len(errList) == 0 {
+		if err := prune(kc, monitoringv1.PrometheusRuleKind, req.NamespacedName, desired); err != nil {
+			errList = append(errList, err)
+		}
+	}
+
+	return ctrl.Result{}, errors.NewAggregate(errList)
+}
+
+func updatePrometheusRuleLabels(kc client.Client, prom *monitoringv1.Prometheus, src *monitoringv1.PrometheusRule) error {
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, src, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.PrometheusRule)
+
+		labels, _ := meta_util.LabelsForLabelSelector(prom.Spec.RuleSelector)
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels)
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s PrometheusRule %s/%s", vt, src.Namespace, src.Name)
+	return nil
+}
+
+// absentFunctions return a series when their argument has none, so they
+// can't be scoped to the namespaces of a project.
+var absentFunctions = []string{"absent", "absent_over_time"}
+
+func copyPrometheusRule(kc client.Client, prom *monitoringv1.Prometheus, src *monitoringv1.PrometheusRule) error {
+	namespaces, err := tenancy.TenantNamespaces(kc, prom)
+	if err != nil {
+		return err
+	}
+	m, err := tenancy.NamespaceMatcher(kc, prom, namespaces, false)
+	if err != nil {
+		return err
+	}
+	matcher := m.PromQL()
+
+	spec := *src.Spec.DeepCopy()
+	groups := spec.Groups[:0]
+	for _, g := range spec.Groups {
+		rules := g.Rules[:0]
+		for _, r := range g.Rules {
+			if r.Expr.Type != intstr.String {
+				rules = append(rules, r)
+				continue
+			}
+			// absent() of a project matcher fires in every project without
+			// the series, so those rules only run in the default Prometheus.
+			absent, err := CallsFunction(r.Expr.StrVal, absentFunctions...)
+			if err != nil {
+				return fmt.Errorf("PrometheusRule %s/%s group %s: %w", src.Namespace, src.Name, g.Name, err)
+			}
+			if absent {
+				klog.Infof("skipping rule %s%s of PrometheusRule %s/%s for Prometheus %s/%s, it calls absent", r.Alert, r.Record, src.Namespace, src.Name, prom.Namespace, prom.Name)
+				continue
+			}
+			expr, err := InjectLabelMatcher(r.Expr.StrVal, matcher)
+			if err != nil {
+				return fmt.Errorf("PrometheusRule %s/%s group %s: %w", src.Namespace, src.Name, g.Name, err)
+			}
+			r.Expr = intstr.FromString(expr)
+			rules = append(rules, r)
+		}
+		if len(rules) > 0 {
+			g.Rules = rules
+			groups = append(groups, g)
+		}
+	}
+	spec.Groups = groups
+
+	target := monitoringv1.PrometheusRule{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      copyName(src.Namespace, src.Name),
+			Namespace: prom.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.PrometheusRule)
+
+		ref := metav1.NewControllerRef(prom, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "Prometheus",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+
+		labels, _ := meta_util.LabelsForLabelSelector(prom.Spec.RuleSelector)
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels, SourceLabels(monitoringv1.PrometheusRuleKind, client.ObjectKeyFromObject(src)))
+		delete(obj.Labels, mona.PrometheusKey)
+
+		obj.Spec = spec
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s PrometheusRule %s/%s", vt, target.Namespace, target.Name)
+	return nil
+}
+
+// Prometheus or namespace -> []prometheusRules
+func PrometheusRulesForPrometheus(kc client.Client, obj client.Object) []reconcile.Request {
+	var list monitoringv1.PrometheusRuleList
+	err := kc.List(context.TODO(), &list, client.MatchingLabels{
+		mona.PrometheusKey: mona.PrometheusValueFederated,
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	var req []reconcile.Request
+	for _, rule := range list.Items {
+		req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(rule)})
+	}
+	return req
+}
@@ -0,0 +1,84 @@
+package federate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+func TestCopyPrometheusRule(t *testing.T) {
+	prom := &monitoringv1.Prometheus{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "t1-monitoring",
+			Name:        "prom",
+			UID:         "prom-uid",
+			Annotations: map[string]string{tenancy.AnnotationKeyTenantNamespaces: "app"},
+		},
+		Spec: monitoringv1.PrometheusSpec{
+			RuleSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"release": "t1"}},
+		},
+	}
+	src := &monitoringv1.PrometheusRule{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "demo",
+			Name:      "alerts",
+			Labels: map[string]string{
+				mona.PrometheusKey: mona.PrometheusValueFederated,
+				// added by the reconciler for the RuleSelector of the default Prometheus
+				"release": "cluster",
+				"team":    "db",
+			},
+		},
+		Spec: monitoringv1.PrometheusRuleSpec{
+			Groups: []monitoringv1.RuleGroup{
+				{
+					Name: "db",
+					Rules: []monitoringv1.Rule{
+						{Alert: "Down", Expr: intstr.FromString(`up == 0`)},
+						{Alert: "Missing", Expr: intstr.FromString(`absent(up{job="db"})`)},
+					},
+				},
+				{
+					Name:  "absent",
+					Rules: []monitoringv1.Rule{{Alert: "Stale", Expr: intstr.FromString(`absent_over_time(up[5m])`)}},
+				},
+			},
+		},
+	}
+	kc := testutil.NewFakeClient(t, prom, src)
+
+	if err := copyPrometheusRule(kc, prom, src); err != nil {
+		t.Fatal(err)
+	}
+
+	var target monitoringv1.PrometheusRule
+	if err := kc.Get(context.TODO(), client.ObjectKey{Namespace: prom.Namespace, Name: copyName(src.Namespace, src.Name)}, &target); err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := SourceLabels(monitoringv1.PrometheusRuleKind, client.ObjectKeyFromObject(src))
+	wantLabels["release"] = "t1"
+	if !reflect.DeepEqual(target.Labels, wantLabels) {
+		t.Errorf("copy labels = %v, want %v", target.Labels, wantLabels)
+	}
+	wantGroups := []monitoringv1.RuleGroup{
+		{
+			Name:  "db",
+			Rules: []monitoringv1.Rule{{Alert: "Down", Expr: intstr.FromString(`up{namespace=~"app"} == 0`)}},
+		},
+	}
+	if !reflect.DeepEqual(target.Spec.Groups, wantGroups) {
+		t.Errorf("copy groups = %+v, want %+v", target.Spec.Groups, wantGroups)
+	}
+	if len(src.Spec.Groups[0].Rules) != 2 {
+		t.Errorf("copyPrometheusRule() modified the source rules: %+v", src.Spec.Groups)
+	}
+}
@@ -0,0 +1,409 @@
+package federate
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+const (
+	// AnnotationKeyMode on a federated ServiceMonitor selects how project
+	// Prometheus get its metrics: ModeCopy copies the ServiceMonitor and the
+	// objects it refers to next to each project Prometheus, ModeFederate
+	// scrapes the /federate endpoint of the cluster Prometheus instead.
+	AnnotationKeyMode = "federate.k8s.appscode.com/mode"
+
+	ModeCopy     = "copy"
+	ModeFederate = "federate"
+
+	// operatedServiceName is the headless Service the operator creates for
+	// every Prometheus in a namespace.
+	operatedServiceName = "prometheus-operated"
+	// prometheusPort is the port Prometheus listens on in its pods.
+	prometheusPort = 9090
+)
+
+// useFederateMode reports whether project Prometheus scrape svcMon through
+// the /federate endpoint of the cluster Prometheus.
+func useFederateMode(svcMon *monitoringv1.ServiceMonitor) bool {
+	return svcMon.Annotations[AnnotationKeyMode] == ModeFederate
+}
+
+// federateJobs returns the job label values of the series the cluster
+// Prometheus scrapes for svcMon from srcServices: the value of the JobLabel
+// label of each Service, or else its name.
+func federateJobs(svcMon *monitoringv1.ServiceMonitor, srcServices map[client.ObjectKey]core.Service) []string {
+	jobs := sets.NewString()
+	for _, svc := range srcServices {
+		if v, ok := svc.Labels[svcMon.Spec.JobLabel]; ok && svcMon.Spec.JobLabel != "" {
+			jobs.Insert(v)
+		} else {
+			jobs.Insert(svc.Name)
+		}
+	}
+	return jobs.List()
+}
+
+// clusterPrometheus returns the cluster Prometheus, or nil if there is none.
+func clusterPrometheus(kc client.Client) (*monitoringv1.Prometheus, error) {
+	var prom monitoringv1.Prometheus
+	err := kc.Get(context.TODO(), tenancy.DefaultPrometheusKey(), &prom)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &prom, nil
+}
+
+// webPortName returns the name of the container port prom serves its api on.
+func webPortName(prom *monitoringv1.Prometheus) string {
+	if prom.Spec.PortName != "" {
+		return prom.Spec.PortName
+	}
+	return "web"
+}
+
+// webScheme returns the scheme prom serves its api with.
+func webScheme(prom *monitoringv1.Prometheus) string {
+	if prom.Spec.Web != nil && prom.Spec.Web.TLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// webServicePort returns the port of svc that forwards to the api of prom.
+func webServicePort(svc *core.Service, prom *monitoringv1.Prometheus) (core.ServicePort, bool) {
+	name := webPortName(prom)
+	for _, port := range svc.Spec.Ports {
+		if port.Name == name || port.TargetPort.StrVal == name || port.TargetPort.IntVal == prometheusPort {
+			return port, true
+		}
+	}
+	return core.ServicePort{}, false
+}
+
+// clusterPrometheusService returns the Service in front of the pods of the
+// cluster Prometheus clusterProm only, along with its api port.
+// prometheus-operated is headless and shared by every Prometheus in the
+// namespace, so it is never used.
+func clusterPrometheusService(kc client.Client, clusterProm *monitoringv1.Prometheus) (*core.Service, core.ServicePort, error) {
+	var list core.ServiceList
+	if err := kc.List(context.TODO(), &list, client.InNamespace(clusterProm.Namespace)); err != nil {
+		return nil, core.ServicePort{}, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	for i := range list.Items {
+		svc := &list.Items[i]
+		if svc.Name == operatedServiceName || len(clusterIPs(svc)) == 0 || isCopy(svc) ||
+			svc.Spec.Selector["prometheus"] != clusterProm.Name {
+			continue
+		}
+		if port, ok := webServicePort(svc, clusterProm); ok {
+			return svc, port, nil
+		}
+	}
+	return nil, core.ServicePort{}, fmt.Errorf("no Service selects only the pods of Prometheus %s/%s", clusterProm.Namespace, clusterProm.Name)
+}
+
+// federateServiceName returns the name of the Service in front of the cluster
+// Prometheus svc that the /federate ServiceMonitors of a project Prometheus
+// scrape.
+func federateServiceName(svc *core.Service) string {
+	return hashedName(svc.Name+"-federate", "federate:"+svc.Namespace+"/"+svc.Name)
+}
+
+// federateToPrometheus makes the project Prometheus prom scrape the series of
+// svcMon from the /federate endpoint of the cluster Prometheus, only for the
+// namespaces of the project. It writes a ServiceMonitor per federated
+// ServiceMonitor, next to prom, and a Service in front of the cluster
+// Prometheus that all of them share. The Prometheus objects are never
+// changed, as project Prometheus are often managed by Helm. It returns the
+// objects it produced for svcMon.
+func federateToPrometheus(
+	kc client.Client,
+	prom *monitoringv1.Prometheus,
+	svcMon *monitoringv1.ServiceMonitor,
+	srcServices map[client.ObjectKey]core.Service,
+) ([]client.Object, []error) {
+	clusterProm, err := clusterPrometheus(kc)
+	if err != nil {
+		return nil, []error{err}
+	} else if clusterProm == nil {
+		return nil, []error{fmt.Errorf("no cluster Prometheus to federate from")}
+	}
+	clusterSvc, port, err := clusterPrometheusService(kc, clusterProm)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	namespaces, err := tenancy.TenantNamespaces(kc, prom)
+	if err != nil {
+		return nil, []error{err}
+	}
+	jobs := federateJobs(svcMon, srcServices)
+	if len(jobs) == 0 || len(namespaces) == 0 {
+		return nil, nil
+	}
+	m, err := tenancy.NamespaceMatcher(kc, prom, namespaces, false)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	if err := ensureFederateService(kc, prom, clusterProm, clusterSvc); err != nil {
+		return nil, []error{err}
+	}
+
+	target := monitoringv1.ServiceMonitor{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      copyName(svcMon.Namespace, svcMon.Name),
+			Namespace: prom.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &target, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*monitoringv1.ServiceMonitor)
+
+		ref := metav1.NewControllerRef(prom, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    "Prometheus",
+		})
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+
+		labels, _ := meta_util.LabelsForLabelSelector(prom.Spec.ServiceMonitorSelector)
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels, SourceLabels(monitoringv1.ServiceMonitorsKind, client.ObjectKeyFromObject(svcMon)))
+
+		e := monitoringv1.Endpoint{
+			Port:        port.Name,
+			Scheme:      webScheme(clusterProm),
+			Path:        path.Join("/", clusterProm.Spec.RoutePrefix, "federate"),
+			HonorLabels: true, // keep original labels
+			Params: map[string][]string{
+				"match[]": {
+					fmt.Sprintf(`{job=~%s,%s}`, strconv.Quote(tenancy.LiteralRegex(jobs)), m.PromQL()),
+				},
+			},
+			Interval: federateInterval(svcMon),
+		}
+		if e.Scheme == "https" {
+			e.TLSConfig = &monitoringv1.TLSConfig{
+				SafeTLSConfig: monitoringv1.SafeTLSConfig{
+					ServerName: fmt.Sprintf("%s.%s.svc", clusterSvc.Name, clusterSvc.Namespace),
+				},
+			}
+		}
+		obj.Spec = monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{e},
+			Selector: metav1.LabelSelector{
+				MatchLabels: SourceLabels(monitoringv1.PrometheusesKind, client.ObjectKeyFromObject(clusterProm)),
+			},
+		}
+
+		return obj
+	})
+	if err != nil {
+		return nil, []error{err}
+	}
+	klog.Infof("%s ServiceMonitor %s/%s", vt, target.Namespace, target.Name)
+	return []client.Object{&target}, nil
+}
+
+// federateInterval returns the shortest scrape interval of the endpoints of
+// svcMon, or "" for the default interval of the project Prometheus.
+func federateInterval(svcMon *monitoringv1.ServiceMonitor) monitoringv1.Duration {
+	var result monitoringv1.Duration
+	var shortest time.Duration
+	for _, e := range svcMon.Spec.Endpoints {
+		d, err := model.ParseDuration(string(e.Interval))
+		if err != nil || d <= 0 {
+			continue
+		}
+		if shortest == 0 || time.Duration(d) < shortest {
+			shortest, result = time.Duration(d), e.Interval
+		}
+	}
+	return result
+}
+
+// ensureFederateService writes a Service and Endpoints next to prom that
+// point to clusterSvc, the Service of the cluster Prometheus clusterProm.
+// Project Prometheus ignore namespace selectors, so they can only scrape
+// Services in their own namespace. The Service is owned by prom and shared
+// by every /federate ServiceMonitor of prom.
+func ensureFederateService(kc client.Client, prom, clusterProm *monitoringv1.Prometheus, clusterSvc *core.Service) error {
+	ref := metav1.NewControllerRef(prom, schema.GroupVersionKind{
+		Group:   monitoring.GroupName,
+		Version: monitoringv1.Version,
+		Kind:    "Prometheus",
+	})
+	labels := SourceLabels(monitoringv1.PrometheusesKind, client.ObjectKeyFromObject(clusterProm))
+
+	svc := core.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      federateServiceName(clusterSvc),
+			Namespace: prom.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &svc, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Service)
+
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels)
+
+		obj.Spec.Type = core.ServiceTypeClusterIP
+		for _, port := range clusterSvc.Spec.Ports {
+			obj.Spec.Ports = UpsertServicePort(obj.Spec.Ports, port)
+		}
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s Service %s/%s", vt, svc.Namespace, svc.Name)
+
+	var subset core.EndpointSubset
+	for _, ip := range clusterIPs(clusterSvc) {
+		subset.Addresses = append(subset.Addresses, core.EndpointAddress{IP: ip})
+	}
+	for _, port := range clusterSvc.Spec.Ports {
+		subset.Ports = append(subset.Ports, core.EndpointPort{
+			Name:     port.Name,
+			Port:     port.Port,
+			Protocol: port.Protocol,
+		})
+	}
+
+	ep := core.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+		},
+	}
+	vt, err = cu.CreateOrPatch(context.TODO(), kc, &ep, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Endpoints)
+
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, labels)
+		obj.Subsets = []core.EndpointSubset{subset}
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s Endpoints %s/%s", vt, ep.Namespace, ep.Name)
+	return nil
+}
+
+// pruneFederateServices deletes the Services and Endpoints written by
+// ensureFederateService that no /federate ServiceMonitor in their namespace
+// selects anymore, eg. after every ServiceMonitor of a project Prometheus
+// left ModeFederate or the project went away. They are labeled with the
+// cluster Prometheus, not with a federated ServiceMonitor, so prune does not
+// see them.
+func pruneFederateServices(kc client.Client) error {
+	var svcMonList monitoringv1.ServiceMonitorList
+	if err := kc.List(context.TODO(), &svcMonList, client.MatchingLabels{
+		LabelKeySourceKind: monitoringv1.ServiceMonitorsKind,
+	}); err != nil {
+		return err
+	}
+	inUse := sets.NewString()
+	for _, svcMon := range svcMonList.Items {
+		sel := svcMon.Spec.Selector.MatchLabels
+		if sel[LabelKeySourceKind] != monitoringv1.PrometheusesKind {
+			continue
+		}
+		inUse.Insert(federateServiceID(svcMon.Namespace, sel))
+	}
+
+	lists := []client.ObjectList{&core.ServiceList{}, &core.EndpointsList{}}
+	for _, list := range lists {
+		if err := kc.List(context.TODO(), list, client.MatchingLabels{
+			LabelKeySourceKind: monitoringv1.PrometheusesKind,
+		}); err != nil {
+			return err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			obj, ok := item.(client.Object)
+			if !ok {
+				return fmt.Errorf("unexpected item type %T in %T", item, list)
+			}
+			if inUse.Has(federateServiceID(obj.GetNamespace(), obj.GetLabels())) {
+				continue
+			}
+			id, err := objectID(kc, obj)
+			if err != nil {
+				return err
+			}
+			err = kc.Delete(context.TODO(), obj)
+			if err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			klog.Infof("pruned %s", id)
+		}
+	}
+	return nil
+}
+
+// federateServiceID identifies the federate Service in namespace ns for the
+// cluster Prometheus named by the tracking labels.
+func federateServiceID(ns string, labels map[string]string) string {
+	return ns + "/" + labels[LabelKeySourceNamespace] + "/" + labels[LabelKeySourceName]
+}
+
+// ServiceMonitorsForClusterPrometheusService maps a Service in front of the
+// cluster Prometheus to the federated ServiceMonitors in ModeFederate.
+func ServiceMonitorsForClusterPrometheusService(kc client.Client, obj client.Object) []reconcile.Request {
+	svc, ok := obj.(*core.Service)
+	if !ok || svc.Spec.Selector["prometheus"] == "" || isCopy(svc) {
+		return nil
+	}
+	key := tenancy.DefaultPrometheusKey()
+	if key.Namespace != svc.Namespace || key.Name != svc.Spec.Selector["prometheus"] {
+		return nil
+	}
+
+	var list monitoringv1.ServiceMonitorList
+	err := kc.List(context.TODO(), &list, client.MatchingLabels{
+		mona.PrometheusKey: mona.PrometheusValueFederated,
+	})
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+	var req []reconcile.Request
+	for _, svcMon := range list.Items {
+		if useFederateMode(svcMon) {
+			req = append(req, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(svcMon)})
+		}
+	}
+	return req
+}
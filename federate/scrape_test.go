@@ -0,0 +1,86 @@
+package federate
+
+import (
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestWebServicePort(t *testing.T) {
+	prom := &monitoringv1.Prometheus{}
+	tests := []struct {
+		name     string
+		portName string
+		ports    []core.ServicePort
+		want     string
+		found    bool
+	}{
+		{
+			name:  "port named web",
+			ports: []core.ServicePort{{Name: "reloader", Port: 8080}, {Name: "web", Port: 9090}},
+			want:  "web",
+			found: true,
+		},
+		{
+			name:  "target port named web",
+			ports: []core.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromString("web")}},
+			want:  "http",
+			found: true,
+		},
+		{
+			name:  "target port number",
+			ports: []core.ServicePort{{Name: "http-web", Port: 9090, TargetPort: intstr.FromInt(9090)}},
+			want:  "http-web",
+			found: true,
+		},
+		{
+			name:     "custom port name",
+			portName: "proxy",
+			ports:    []core.ServicePort{{Name: "web", Port: 8080, TargetPort: intstr.FromInt(8080)}, {Name: "proxy", Port: 8081}},
+			want:     "proxy",
+			found:    true,
+		},
+		{
+			name:  "no api port",
+			ports: []core.ServicePort{{Name: "reloader", Port: 8080, TargetPort: intstr.FromInt(8080)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prom.Spec.PortName = tt.portName
+			svc := &core.Service{Spec: core.ServiceSpec{Ports: tt.ports}}
+			port, found := webServicePort(svc, prom)
+			if found != tt.found || port.Name != tt.want {
+				t.Errorf("webServicePort() = %s, %v, want %s, %v", port.Name, found, tt.want, tt.found)
+			}
+		})
+	}
+}
+
+func TestWebScheme(t *testing.T) {
+	prom := &monitoringv1.Prometheus{}
+	if got := webScheme(prom); got != "http" {
+		t.Errorf("webScheme() = %s, want http", got)
+	}
+	prom.Spec.Web = &monitoringv1.PrometheusWebSpec{}
+	prom.Spec.Web.TLSConfig = &monitoringv1.WebTLSConfig{}
+	if got := webScheme(prom); got != "https" {
+		t.Errorf("webScheme() with web tls = %s, want https", got)
+	}
+}
+
+func TestFederateInterval(t *testing.T) {
+	svcMon := &monitoringv1.ServiceMonitor{
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Endpoints: []monitoringv1.Endpoint{{Interval: "1m"}, {}, {Interval: "15s"}, {Interval: "bad"}},
+		},
+	}
+	if got := federateInterval(svcMon); got != "15s" {
+		t.Errorf("federateInterval() = %s, want 15s", got)
+	}
+	if got := federateInterval(&monitoringv1.ServiceMonitor{}); got != "" {
+		t.Errorf("federateInterval() without endpoints = %s, want empty", got)
+	}
+}
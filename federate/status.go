@@ -0,0 +1,108 @@
+package federate
+
+import (
+	"context"
+	"encoding/json"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// AnnotationKeyStatus on a federated ServiceMonitor or PodMonitor holds the
+// JSON encoded []TargetResult of its last reconciliation.
+const AnnotationKeyStatus = "federate.k8s.appscode.com/status"
+
+const (
+	EventReasonFederated        = "Federated"
+	EventReasonFederationFailed = "FederationFailed"
+)
+
+var federationFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "federate_failures_total",
+		Help: "Number of times federating a source object into a Prometheus failed.",
+	},
+	[]string{"kind", "prometheus"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(federationFailures)
+}
+
+// TargetResult is the outcome of federating a source object into one
+// Prometheus. Prometheus is empty if the sources could not be collected.
+type TargetResult struct {
+	Prometheus string   `json:"prometheus,omitempty"`
+	Objects    []string `json:"objects,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func newTargetResult(kc client.Client, prom *monitoringv1.Prometheus, objects []client.Object, errs []error) TargetResult {
+	var result TargetResult
+	if prom != nil {
+		result.Prometheus = client.ObjectKeyFromObject(prom).String()
+	}
+	for _, obj := range objects {
+		id, err := objectID(kc, obj)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result.Objects = append(result.Objects, id)
+	}
+	if err := errors.NewAggregate(errs); err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// report counts the failed results and records them on src, a source
+// ServiceMonitor or PodMonitor of the given kind. The results are written
+// into the AnnotationKeyStatus annotation and, when they change, as Events.
+func report(kc client.Client, recorder record.EventRecorder, kind string, src client.Object, results []TargetResult) {
+	for _, r := range results {
+		if r.Error != "" {
+			federationFailures.WithLabelValues(kind, r.Prometheus).Inc()
+		}
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		klog.Error(err)
+		return
+	}
+	if src.GetAnnotations()[AnnotationKeyStatus] == string(data) {
+		return
+	}
+
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, src, func(obj client.Object, createOp bool) client.Object {
+		obj.SetAnnotations(meta_util.OverwriteKeys(obj.GetAnnotations(), map[string]string{
+			AnnotationKeyStatus: string(data),
+		}))
+		return obj
+	})
+	if err != nil {
+		klog.Error(err)
+	} else {
+		klog.Infof("%s %s %s/%s", vt, kind, src.GetNamespace(), src.GetName())
+	}
+
+	if recorder == nil {
+		return
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			recorder.Eventf(src, core.EventTypeWarning, EventReasonFederationFailed, "Prometheus %s: %s", r.Prometheus, r.Error)
+		} else {
+			recorder.Eventf(src, core.EventTypeNormal, EventReasonFederated, "Prometheus %s: %d objects", r.Prometheus, len(r.Objects))
+		}
+	}
+}
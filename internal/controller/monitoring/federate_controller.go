@@ -0,0 +1,220 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package monitoring
+
+import (
+	"context"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/record"
+	mona "kmodules.xyz/monitoring-agent-api/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/tamalsaha/rancid-syncer/federate"
+)
+
+// federated passes events for objects labeled for federation. Updates that
+// remove the label pass too, so the copies get pruned.
+var federated = predicate.Funcs{
+	CreateFunc: func(e event.CreateEvent) bool {
+		return isFederated(e.Object)
+	},
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return isFederated(e.ObjectOld) || isFederated(e.ObjectNew)
+	},
+	DeleteFunc: func(e event.DeleteEvent) bool {
+		return isFederated(e.Object)
+	},
+	GenericFunc: func(e event.GenericEvent) bool {
+		return isFederated(e.Object)
+	},
+}
+
+func isFederated(obj client.Object) bool {
+	return obj.GetLabels()[mona.PrometheusKey] == mona.PrometheusValueFederated
+}
+
+// FederateReconciler copies every ServiceMonitor labeled for federation into
+// the namespace of each project Prometheus, along with the Services, Endpoints
+// Secrets and ConfigMaps it refers to. Copies that are no longer desired are deleted.
+//
+// The results are recorded as Events and in an annotation of the source
+// ServiceMonitor.
+type FederateReconciler struct {
+	client.Client
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheuses,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=services;endpoints;secrets;configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+func (r *FederateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return federate.Reconcile(ctx, r, r.Recorder, req)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *FederateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	mapFn := func(fn func(kc client.Client, obj client.Object) []reconcile.Request) handler.EventHandler {
+		return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return fn(r, obj)
+		})
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("federate").
+		For(&monitoringv1.ServiceMonitor{}, builder.WithPredicates(federated)).
+		Watches(&source.Kind{Type: &core.Service{}}, mapFn(federate.ServiceMonitorsForService)).
+		Watches(&source.Kind{Type: &core.Service{}}, mapFn(federate.ServiceMonitorsForClusterPrometheusService)).
+		Watches(&source.Kind{Type: &discovery.EndpointSlice{}}, mapFn(federate.ServiceMonitorsForEndpointSlice)).
+		Watches(&source.Kind{Type: &core.Secret{}}, mapFn(federate.ServiceMonitorsForCredential)).
+		Watches(&source.Kind{Type: &core.ConfigMap{}}, mapFn(federate.ServiceMonitorsForCredential)).
+		Watches(&source.Kind{Type: &core.Namespace{}}, mapFn(federate.ServiceMonitorsForNamespace), builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		Watches(&source.Kind{Type: &monitoringv1.Prometheus{}}, mapFn(federate.ServiceMonitorsForPrometheus), builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// PodMonitorFederateReconciler publishes the pods of every PodMonitor labeled
+// for federation next to each project Prometheus, and scrapes them through a
+// ServiceMonitor converted from the PodMonitor.
+type PodMonitorFederateReconciler struct {
+	client.Client
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=podmonitors,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+func (r *PodMonitorFederateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return federate.ReconcilePodMonitor(ctx, r, r.Recorder, req)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PodMonitorFederateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	mapFn := func(fn func(kc client.Client, obj client.Object) []reconcile.Request) handler.EventHandler {
+		return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return fn(r, obj)
+		})
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("federate-podmonitor").
+		For(&monitoringv1.PodMonitor{}, builder.WithPredicates(federated)).
+		Watches(&source.Kind{Type: &core.Pod{}}, mapFn(federate.PodMonitorsForPod)).
+		Watches(&source.Kind{Type: &core.Secret{}}, mapFn(federate.PodMonitorsForCredential)).
+		Watches(&source.Kind{Type: &core.ConfigMap{}}, mapFn(federate.PodMonitorsForCredential)).
+		Watches(&source.Kind{Type: &core.Namespace{}}, mapFn(federate.PodMonitorsForPrometheus), builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		Watches(&source.Kind{Type: &monitoringv1.Prometheus{}}, mapFn(federate.PodMonitorsForPrometheus), builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// PrometheusRuleFederateReconciler copies every PrometheusRule labeled for
+// federation into the namespace of each project Prometheus, restricted to the
+// namespaces of the project.
+type PrometheusRuleFederateReconciler struct {
+	client.Client
+}
+
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheusrules,verbs=get;list;watch;create;update;patch;delete
+
+func (r *PrometheusRuleFederateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return federate.ReconcilePrometheusRule(ctx, r, req)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PrometheusRuleFederateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	mapFn := handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		return federate.PrometheusRulesForPrometheus(r, obj)
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("federate-prometheusrule").
+		For(&monitoringv1.PrometheusRule{}, builder.WithPredicates(federated)).
+		Watches(&source.Kind{Type: &core.Namespace{}}, mapFn, builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		Watches(&source.Kind{Type: &monitoringv1.Prometheus{}}, mapFn, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// ProjectIDReconciler labels every series scraped by the cluster Prometheus
+// with the id of the project of its namespace, through metric relabel configs
+// on the ServiceMonitors the cluster Prometheus selects. ServiceMonitors
+// managed by another tool are left alone.
+type ProjectIDReconciler struct {
+	client.Client
+}
+
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheuses,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+func (r *ProjectIDReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return federate.ReconcileProjectID(ctx, r, req)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ProjectIDReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	mapFn := handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		return federate.ServiceMonitorsForProjectID(r, obj)
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("project-id").
+		For(&monitoringv1.ServiceMonitor{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{}))).
+		Watches(&source.Kind{Type: &core.Namespace{}}, mapFn, builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		Watches(&source.Kind{Type: &monitoringv1.Prometheus{}}, mapFn, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// PodMonitorProjectIDReconciler does for the PodMonitors the cluster
+// Prometheus selects what ProjectIDReconciler does for its ServiceMonitors.
+type PodMonitorProjectIDReconciler struct {
+	client.Client
+}
+
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=podmonitors,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheuses,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+func (r *PodMonitorProjectIDReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return federate.ReconcilePodMonitorProjectID(ctx, r, req)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PodMonitorProjectIDReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	mapFn := handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		return federate.PodMonitorsForProjectID(r, obj)
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("podmonitor-project-id").
+		For(&monitoringv1.PodMonitor{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{}))).
+		Watches(&source.Kind{Type: &core.Namespace{}}, mapFn, builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		Watches(&source.Kind{Type: &monitoringv1.Prometheus{}}, mapFn, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package monitoring
+
+import (
+	"context"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/tamalsaha/rancid-syncer/trickster"
+)
+
+// TricksterReconciler keeps the trickster kubeconfig Secret of every
+// namespace set up by `rancid-syncer prometheus setup` in sync with the
+// service account token. Deleting the token Secret rotates both. The
+// trickster Role of each Prometheus owning the service account is
+// recomputed whenever the Services next to it change.
+type TricksterReconciler struct {
+	client.Client
+	// Server is the api server url written into the kubeconfig.
+	Server string
+}
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=services/proxy,verbs=get
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheuses;alertmanagers,verbs=get;list;watch
+
+func (r *TricksterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	proms, err := trickster.PrometheusesForServiceAccount(r, req.Namespace)
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var sa core.ServiceAccount
+	if err := r.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: trickster.ServiceAccountName}, &sa); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	for _, prom := range proms {
+		if err := trickster.EnsureRBAC(r, prom); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if err := trickster.EnsureTokenSecret(r, &sa); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	caData, tokenData, err := trickster.ReadToken(r, req.Namespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if tokenData == nil {
+		// the token controller updates the Secret, which triggers another reconcile
+		log.Info("waiting for service account token", "namespace", req.Namespace)
+		return ctrl.Result{}, nil
+	}
+
+	_, err = trickster.EnsureKubeconfigSecret(r, r.Server, &sa, caData, tokenData)
+	return ctrl.Result{}, err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+//
+// The trickster Secrets and service accounts are watched through a cache of
+// their own, restricted to trickster.OwnedLabels, instead of every Secret of
+// the cluster. Services and Prometheuses only trigger a reconcile in the
+// namespaces that have a trickster service account.
+func (r *TricksterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	owned := cache.ObjectSelector{Label: labels.SelectorFromSet(trickster.OwnedLabels)}
+	ownedCache, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(),
+		SelectorsByObject: cache.SelectorsByObject{
+			&core.Secret{}:         owned,
+			&core.ServiceAccount{}: owned,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := mgr.Add(ownedCache); err != nil {
+		return err
+	}
+
+	c, err := controller.New("trickster", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	err = c.Watch(source.NewKindWithCache(&core.Secret{}, ownedCache), &handler.EnqueueRequestForObject{}, predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetName() == trickster.TokenSecretName || obj.GetName() == trickster.KubeconfigSecretName
+	}))
+	if err != nil {
+		return err
+	}
+
+	hasServiceAccount := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		var sa core.ServiceAccount
+		return ownedCache.Get(context.TODO(), client.ObjectKey{Namespace: obj.GetNamespace(), Name: trickster.ServiceAccountName}, &sa) == nil
+	})
+	if err := c.Watch(&source.Kind{Type: &core.Service{}}, handler.EnqueueRequestsFromMapFunc(requestForNamespace), hasServiceAccount); err != nil {
+		return err
+	}
+	return c.Watch(&source.Kind{Type: &monitoringv1.Prometheus{}}, handler.EnqueueRequestsFromMapFunc(requestForNamespace), hasServiceAccount)
+}
+
+// requestForNamespace maps an object to the trickster token Secret in its namespace.
+func requestForNamespace(obj client.Object) []reconcile.Request {
+	return []reconcile.Request{
+		{NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: trickster.TokenSecretName}},
+	}
+}
@@ -0,0 +1,33 @@
+// Package testutil holds helpers shared by the unit tests of the packages.
+package testutil
+
+import (
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	managementv1alpha1 "kmodules.xyz/resource-metadata/apis/management/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	chartsapi "x-helm.dev/apimachinery/apis/charts/v1alpha1"
+)
+
+// NewFakeClient returns a fake client that knows the Kubernetes, Prometheus
+// operator, ProjectQuota and chart preset types, loaded with objs.
+func NewFakeClient(t *testing.T, objs ...client.Object) client.Client {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{
+		clientgoscheme.AddToScheme,
+		monitoringv1.AddToScheme,
+		managementv1alpha1.AddToScheme,
+		chartsapi.AddToScheme,
+	} {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
@@ -5,24 +5,19 @@ import (
 	"fmt"
 	"os"
 	"sort"
-	"strings"
-	"time"
 
-	"github.com/google/uuid"
 	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	openvizapi "go.openviz.dev/apimachinery/apis/openviz/v1alpha1"
 	"gomodules.xyz/pointer"
 	core "k8s.io/api/core/v1"
-	rbac "k8s.io/api/rbac/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -36,119 +31,53 @@ import (
 	meta_util "kmodules.xyz/client-go/meta"
 	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
 	mona "kmodules.xyz/monitoring-agent-api/api/v1"
-	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+	mgmtapi "kmodules.xyz/resource-metadata/apis/management/v1alpha1"
 	rsapi "kmodules.xyz/resource-metadata/apis/meta/v1alpha1"
 	"kmodules.xyz/resource-metadata/apis/shared"
 	"kmodules.xyz/resource-metadata/client/clientset/versioned"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
-	"sigs.k8s.io/yaml"
 	chartsapi "x-helm.dev/apimachinery/apis/charts/v1alpha1"
+
+	"github.com/tamalsaha/rancid-syncer/projects"
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+	"github.com/tamalsaha/rancid-syncer/trickster"
 )
 
-func NewClient() (*rest.Config, versioned.Interface, client.Client, error) {
+func NewClient(cfg *rest.Config) (versioned.Interface, client.Client, error) {
 	scheme := runtime.NewScheme()
 	_ = clientgoscheme.AddToScheme(scheme)
 	_ = monitoringv1.AddToScheme(scheme)
 	_ = chartsapi.AddToScheme(scheme)
+	_ = appcatalog.AddToScheme(scheme)
+	_ = mgmtapi.AddToScheme(scheme)
 
 	ctrl.SetLogger(klogr.New())
-	cfg := ctrl.GetConfigOrDie()
 	cfg.QPS = 100
 	cfg.Burst = 100
 
 	rmc, err := versioned.NewForConfig(cfg)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 
 	mapper, err := apiutil.NewDynamicRESTMapper(cfg)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 
 	kc, err := client.New(cfg, client.Options{
 		Scheme: scheme,
 		Mapper: mapper,
-		//Opts: client.WarningHandlerOptions{
-		//	SuppressWarnings:   false,
-		//	AllowDuplicateLogs: false,
-		//},
 	})
-	return cfg, rmc, kc, err
+	return rmc, kc, err
 }
 
 func main() {
-	if err := useKubebuilderClient(); err != nil {
-		panic(err)
-	}
-}
-
-func useKubebuilderClient() error {
-	fmt.Println("Using kubebuilder client")
-	cfg, rmc, kc, err := NewClient()
-	if err != nil {
-		return err
-	}
-
-	projects, err := ListRancherProjects(kc)
-	if err != nil {
-		return err
-	}
-	data, err := yaml.Marshal(projects)
-	if err != nil {
-		return err
-	}
-	fmt.Println(string(data))
-	os.Exit(1)
-
-	var prom monitoringv1.Prometheus
-	err = kc.Get(context.TODO(), types.NamespacedName{
-		//Name:      "cattle-project-p-mrbgq-mon-prometheus",
-		//Namespace: "cattle-project-p-mrbgq-monitoring",
-
-		Namespace: "cattle-monitoring-system",
-		Name:      "rancher-monitoring-prometheus",
-	}, &prom)
-	if err != nil {
-		return err
-	}
-	ns, err := NamespaceForPreset(kc, &prom)
-	if err != nil {
-		return err
-	}
-	fmt.Println(ns)
-	os.Exit(1)
-
-	pcfg, err := SetupClusterForPrometheus(cfg, kc, rmc, types.NamespacedName{
-		Namespace: "cattle-monitoring-system",
-		Name:      "rancher-monitoring-prometheus",
-	})
-	if err != nil {
-		return err
-	}
-	data, err = yaml.Marshal(pcfg)
-	if err != nil {
-		return err
-	}
-	fmt.Println(string(data))
-	// os.Exit(1)
-	// -----------------------------------------------------------
-
-	svc, err := FindServiceForPrometheus(rmc, types.NamespacedName{
-		Namespace: "cattle-monitoring-system",
-		Name:      "rancher-monitoring-prometheus",
-	})
-	if err != nil {
-		return err
+	if err := NewRootCmd().Execute(); err != nil {
+		os.Exit(1)
 	}
-	fmt.Println(svc.Name)
-
-	rancher := clustermanger.IsRancherManaged(kc.RESTMapper())
-	fmt.Println("IsRancherManaged", rancher)
-
-	return nil
 }
 
 func FindServiceForPrometheus(rmc versioned.Interface, key types.NamespacedName) (*core.Service, error) {
@@ -200,7 +129,6 @@ func FindServiceForPrometheus(rmc versioned.Interface, key types.NamespacedName)
 
 const (
 	portPrometheus = "http-web"
-	saTrickster    = "trickster"
 )
 
 func SetupClusterForPrometheus(cfg *rest.Config, kc client.Client, rmc versioned.Interface, key types.NamespacedName) (*mona.PrometheusConfig, error) {
@@ -219,10 +147,21 @@ func SetupClusterForPrometheus(cfg *rest.Config, kc client.Client, rmc versioned
 	}
 
 	key = client.ObjectKeyFromObject(&prom)
-	isDefault, err := clustermanger.IsDefault(kc, cm, gvk, key)
+	isDefault := key == tenancy.DefaultPrometheus
+	if tenancy.DefaultPrometheus.Name == "" {
+		isDefault, err = clustermanger.IsDefault(kc, cm, gvk, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// only the primary Prometheus of a project gets the default presets and AppBinding
+	proms, err := projects.ProjectPrometheuses(kc, &prom)
 	if err != nil {
 		return nil, err
 	}
+	primary := len(proms) == 0 || client.ObjectKeyFromObject(proms[0]) == key
+	isDefault = isDefault && primary
 
 	svc, err := FindServiceForPrometheus(rmc, key)
 	if err != nil {
@@ -230,149 +169,102 @@ func SetupClusterForPrometheus(cfg *rest.Config, kc client.Client, rmc versioned
 	}
 
 	// https://github.com/bytebuilders/installer/blob/master/charts/monitoring-config/templates/trickster/trickster.yaml
-	sa := core.ServiceAccount{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      saTrickster,
-			Namespace: key.Namespace,
-		},
+	sa, err := trickster.EnsureServiceAccount(kc, &prom)
+	if err != nil {
+		return nil, err
 	}
-	savt, err := cu.CreateOrPatch(context.TODO(), kc, &sa, func(in client.Object, createOp bool) client.Object {
-		obj := in.(*core.ServiceAccount)
-		ref := metav1.NewControllerRef(&prom, schema.GroupVersionKind{
-			Group:   monitoring.GroupName,
-			Version: monitoringv1.Version,
-			Kind:    "Prometheus",
-		})
-		obj.OwnerReferences = []metav1.OwnerReference{*ref}
 
-		return obj
-	})
+	err = trickster.EnsureTokenSecret(kc, sa)
 	if err != nil {
 		return nil, err
 	}
-	klog.Infof("%s service account %s/%s", savt, sa.Namespace, sa.Name)
 
-	role := rbac.Role{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      saTrickster,
-			Namespace: key.Namespace,
-		},
+	err = trickster.EnsureRBAC(kc, &prom)
+	if err != nil {
+		return nil, err
 	}
-	rolevt, err := cu.CreateOrPatch(context.TODO(), kc, &role, func(in client.Object, createOp bool) client.Object {
-		obj := in.(*rbac.Role)
-		ref := metav1.NewControllerRef(&prom, schema.GroupVersionKind{
-			Group:   monitoring.GroupName,
-			Version: monitoringv1.Version,
-			Kind:    "Prometheus",
-		})
-		obj.OwnerReferences = []metav1.OwnerReference{*ref}
 
-		obj.Rules = []rbac.PolicyRule{
-			{
-				APIGroups: []string{""},
-				Resources: []string{"services/proxy"},
-				Verbs:     []string{"*"},
-			},
-		}
-
-		return obj
-	})
+	err = CreatePreset(kc, cm, &prom, isDefault, primary)
 	if err != nil {
 		return nil, err
 	}
-	klog.Infof("%s role %s/%s", rolevt, role.Namespace, role.Name)
 
-	rb := rbac.RoleBinding{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      saTrickster,
-			Namespace: key.Namespace,
-		},
+	// create Prometheus AppBinding
+	vt, err := CreatePrometheusAppBinding(kc, &prom, svc, isDefault)
+	if err != nil {
+		return nil, err
 	}
-	rbvt, err := cu.CreateOrPatch(context.TODO(), kc, &rb, func(in client.Object, createOp bool) client.Object {
-		obj := in.(*rbac.RoleBinding)
-		ref := metav1.NewControllerRef(&prom, schema.GroupVersionKind{
-			Group:   rbac.GroupName,
-			Version: "v1",
-			Kind:    "Role",
-		})
-		obj.OwnerReferences = []metav1.OwnerReference{*ref}
-
-		obj.RoleRef = rbac.RoleRef{
-			APIGroup: rbac.GroupName,
-			Kind:     "Role",
-			Name:     role.Name,
+	if isDefault {
+		if vt == kutil.VerbCreated {
+			if err := RegisterPrometheus(); err != nil {
+				return nil, err
+			}
 		}
 
-		obj.Subjects = []rbac.Subject{
-			{
-				Kind:      "ServiceAccount",
-				Name:      sa.Name,
-				Namespace: sa.Namespace,
-			},
-		}
+		// create Grafana AppBinding
+	}
 
-		return obj
+	var caData, tokenData []byte
+	err = wait.PollImmediate(kutil.RetryInterval, kutil.ReadinessTimeout, func() (done bool, err error) {
+		caData, tokenData, err = trickster.ReadToken(kc, sa.Namespace)
+		return tokenData != nil, err
 	})
 	if err != nil {
 		return nil, err
 	}
-	klog.Infof("%s role binding %s/%s", rbvt, rb.Namespace, rb.Name)
+	_, err = trickster.EnsureKubeconfigSecret(kc, cfg.Host, sa, caData, tokenData)
+	if err != nil {
+		return nil, err
+	}
+	return newPrometheusConfig(cfg, svc, caData, tokenData), nil
+}
 
-	err = CreatePreset(kc, cm, &prom, isDefault)
+// SetupProjectPrometheuses sets up every Prometheus in the project of the
+// Prometheus at key, primary first, and returns their connection configs in
+// the same order. Outside Rancher, only the Prometheus at key is set up.
+func SetupProjectPrometheuses(cfg *rest.Config, kc client.Client, rmc versioned.Interface, key types.NamespacedName) ([]*mona.PrometheusConfig, error) {
+	var prom monitoringv1.Prometheus
+	err := kc.Get(context.TODO(), key, &prom)
 	if err != nil {
 		return nil, err
 	}
+	proms, err := projects.ProjectPrometheuses(kc, &prom)
+	if err != nil {
+		return nil, err
+	}
+	if len(proms) == 0 {
+		proms = []*monitoringv1.Prometheus{&prom}
+	}
 
-	if isDefault {
-		// create Prometheus AppBinding
-		vt, err := CreatePrometheusAppBinding(kc, &prom, svc)
+	result := make([]*mona.PrometheusConfig, 0, len(proms))
+	for _, p := range proms {
+		pcfg, err := SetupClusterForPrometheus(cfg, kc, rmc, client.ObjectKeyFromObject(p))
 		if err != nil {
 			return nil, err
 		}
-		if vt == kutil.VerbCreated {
-			RegisterPrometheus()
-		}
-
-		// create Grafana AppBinding
+		result = append(result, pcfg)
 	}
+	return result, nil
+}
 
-	var caData, tokenData []byte
-	err = wait.PollImmediate(kutil.RetryInterval, kutil.ReadinessTimeout, func() (done bool, err error) {
-		var sacc core.ServiceAccount
-		err = kc.Get(context.TODO(), client.ObjectKeyFromObject(&sa), &sacc)
-		if apierrors.IsNotFound(err) {
-			return false, nil
-		} else if err != nil {
-			return false, err
-		}
-		if len(sacc.Secrets) == 0 {
-			return false, nil
-		}
-
-		skey := client.ObjectKey{
-			Namespace: sa.Namespace,
-			Name:      sacc.Secrets[0].Name,
-		}
-		var s core.Secret
-		err = kc.Get(context.TODO(), skey, &s)
-		if apierrors.IsNotFound(err) {
-			return false, nil
-		} else if err != nil {
-			return false, err
-		}
-
-		var caFound, tokenFound bool
-		caData, caFound = s.Data["ca.crt"]
-		tokenData, tokenFound = s.Data["token"]
-		return caFound && tokenFound, nil
-	})
+// GetPrometheusConfig returns the config to connect to a Prometheus already set up by
+// SetupClusterForPrometheus, without changing anything in the cluster.
+func GetPrometheusConfig(cfg *rest.Config, kc client.Client, rmc versioned.Interface, key types.NamespacedName) (*mona.PrometheusConfig, error) {
+	svc, err := FindServiceForPrometheus(rmc, key)
 	if err != nil {
 		return nil, err
 	}
+	caData, tokenData, err := trickster.ReadToken(kc, key.Namespace)
 	if err != nil {
 		return nil, err
 	}
+	if tokenData == nil {
+		return nil, fmt.Errorf("token for service account %s/%s is not ready, run prometheus setup first", key.Namespace, trickster.ServiceAccountName)
+	}
+	return newPrometheusConfig(cfg, svc, caData, tokenData), nil
+}
 
+func newPrometheusConfig(cfg *rest.Config, svc *core.Service, caData, tokenData []byte) *mona.PrometheusConfig {
 	var pcfg mona.PrometheusConfig
 	pcfg.Service = mona.ServiceSpec{
 		Scheme:    "http",
@@ -395,7 +287,7 @@ func SetupClusterForPrometheus(cfg *rest.Config, kc client.Client, rmc versioned
 	pcfg.BearerToken = string(tokenData)
 	pcfg.TLS.Ca = string(caData)
 
-	return &pcfg, nil
+	return &pcfg
 }
 
 const presetsMonitoring = "monitoring-presets"
@@ -404,7 +296,14 @@ var defaultPresetsLabels = map[string]string{
 	"charts.x-helm.dev/is-default-preset": "true",
 }
 
-func CreatePreset(kc client.Client, cm kmapi.ClusterManager, p *monitoringv1.Prometheus, isDefault bool) error {
+// CreatePreset creates the monitoring presets for p. On Rancher, only the
+// default Prometheus gets the ClusterChartPreset and only the primary
+// Prometheus of a project gets the default ChartPreset; the other ones get a
+// ChartPreset named after them. With a configured default Prometheus, only it
+// gets the ClusterChartPreset and every other Prometheus gets the default
+// ChartPreset in the namespaces of its tenant. Otherwise, p gets the
+// ClusterChartPreset.
+func CreatePreset(kc client.Client, cm kmapi.ClusterManager, p *monitoringv1.Prometheus, isDefault, primary bool) error {
 	presets := GeneratePresetForPrometheus(*p)
 	presetBytes, err := json.Marshal(presets)
 	if err != nil {
@@ -421,13 +320,18 @@ func CreatePreset(kc client.Client, cm kmapi.ClusterManager, p *monitoringv1.Pro
 			}
 		} else {
 			// create ChartPreset
-			err2 := CreateProjectPreset(kc, p, presetBytes)
+			err2 := CreateProjectPreset(kc, p, presetBytes, primary)
 			if err2 != nil {
 				return err2
 			}
 		}
 		return nil
-	} // create ClusterChartPreset
+	}
+	if tenancy.Enabled(kc) && !tenancy.IsDefaultPrometheus(p) {
+		// create ChartPresets
+		return CreateTenantPresets(kc, p, presetBytes)
+	}
+	// create ClusterChartPreset
 	err = CreateClusterPreset(kc, presetBytes)
 	return err
 }
@@ -442,7 +346,7 @@ func CreateClusterPreset(kc client.Client, presetBytes []byte) error {
 	vt, err := cu.CreateOrPatch(context.TODO(), kc, &ccp, func(in client.Object, createOp bool) client.Object {
 		obj := in.(*chartsapi.ClusterChartPreset)
 
-		obj.Labels = defaultPresetsLabels
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, defaultPresetsLabels, trickster.OwnedLabels)
 		obj.Spec = chartsapi.ClusterChartPresetSpec{
 			Values: &runtime.RawExtension{
 				Raw: presetBytes,
@@ -458,18 +362,25 @@ func CreateClusterPreset(kc client.Client, presetBytes []byte) error {
 	return nil
 }
 
-func CreateProjectPreset(kc client.Client, p *monitoringv1.Prometheus, presetBytes []byte) error {
+func CreateProjectPreset(kc client.Client, p *monitoringv1.Prometheus, presetBytes []byte, primary bool) error {
+	name := presetsMonitoring
+	if !primary {
+		name = presetsMonitoring + "-" + p.Name
+	}
 	cp := chartsapi.ChartPreset{
 		TypeMeta: metav1.TypeMeta{},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      presetsMonitoring,
+			Name:      name,
 			Namespace: p.Namespace,
 		},
 	}
 	vt, err := cu.CreateOrPatch(context.TODO(), kc, &cp, func(in client.Object, createOp bool) client.Object {
 		obj := in.(*chartsapi.ChartPreset)
 
-		obj.Labels = defaultPresetsLabels
+		if primary {
+			obj.Labels = meta_util.OverwriteKeys(obj.Labels, defaultPresetsLabels)
+		}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, trickster.OwnedLabels)
 		obj.Spec = chartsapi.ClusterChartPresetSpec{
 			Values: &runtime.RawExtension{
 				Raw: presetBytes,
@@ -485,6 +396,69 @@ func CreateProjectPreset(kc client.Client, p *monitoringv1.Prometheus, presetByt
 	return nil
 }
 
+// The default ChartPresets of a tenant Prometheus are labeled with it, so
+// the ones in namespaces that left the tenant can be found and removed.
+const (
+	labelKeyPresetPrometheusNamespace = "monitoring.appscode.com/preset-prometheus-namespace"
+	labelKeyPresetPrometheusName      = "monitoring.appscode.com/preset-prometheus-name"
+)
+
+// CreateTenantPresets creates the default ChartPreset for the tenant
+// Prometheus p in every namespace of its tenant and deletes the ones it
+// created before in namespaces that are no longer in the tenant.
+func CreateTenantPresets(kc client.Client, p *monitoringv1.Prometheus, presetBytes []byte) error {
+	namespaces, err := tenancy.TenantNamespaces(kc, p)
+	if err != nil {
+		return err
+	}
+	promLabels := map[string]string{
+		labelKeyPresetPrometheusNamespace: p.Namespace,
+		labelKeyPresetPrometheusName:      p.Name,
+	}
+
+	for _, ns := range namespaces {
+		cp := chartsapi.ChartPreset{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      presetsMonitoring,
+				Namespace: ns,
+			},
+		}
+		vt, err := cu.CreateOrPatch(context.TODO(), kc, &cp, func(in client.Object, createOp bool) client.Object {
+			obj := in.(*chartsapi.ChartPreset)
+
+			obj.Labels = meta_util.OverwriteKeys(obj.Labels, defaultPresetsLabels, trickster.OwnedLabels, promLabels)
+			obj.Spec = chartsapi.ClusterChartPresetSpec{
+				Values: &runtime.RawExtension{
+					Raw: presetBytes,
+				},
+			}
+
+			return obj
+		})
+		if err != nil {
+			return err
+		}
+		klog.Infof("%s ChartPreset %s/%s", vt, cp.Namespace, cp.Name)
+	}
+
+	var cpList chartsapi.ChartPresetList
+	if err := kc.List(context.TODO(), &cpList, client.MatchingLabels(promLabels)); err != nil {
+		return err
+	}
+	keep := sets.NewString(namespaces...)
+	for i := range cpList.Items {
+		cp := &cpList.Items[i]
+		if keep.Has(cp.Namespace) {
+			continue
+		}
+		if err := kc.Delete(context.TODO(), cp); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		klog.Infof("deleted ChartPreset %s/%s", cp.Namespace, cp.Name)
+	}
+	return nil
+}
+
 func GeneratePresetForPrometheus(p monitoringv1.Prometheus) mona.MonitoringPresets {
 	var preset mona.MonitoringPresets
 
@@ -505,11 +479,18 @@ func GeneratePresetForPrometheus(p monitoringv1.Prometheus) mona.MonitoringPrese
 	return preset
 }
 
-func CreatePrometheusAppBinding(kc client.Client, p *monitoringv1.Prometheus, svc *core.Service) (kutil.VerbType, error) {
+// CreatePrometheusAppBinding creates the AppBinding for p. The default
+// Prometheus gets the default-prometheus AppBinding; the other ones get an
+// AppBinding named after them.
+func CreatePrometheusAppBinding(kc client.Client, p *monitoringv1.Prometheus, svc *core.Service, isDefault bool) (kutil.VerbType, error) {
+	name := p.Name
+	if isDefault {
+		name = "default-prometheus"
+	}
 	ab := appcatalog.AppBinding{
 		TypeMeta: metav1.TypeMeta{},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "default-prometheus",
+			Name:      name,
 			Namespace: p.Namespace,
 		},
 	}
@@ -517,10 +498,13 @@ func CreatePrometheusAppBinding(kc client.Client, p *monitoringv1.Prometheus, sv
 	vt, err := cu.CreateOrPatch(context.TODO(), kc, &ab, func(in client.Object, createOp bool) client.Object {
 		obj := in.(*appcatalog.AppBinding)
 
-		if obj.Annotations == nil {
-			obj.Annotations = make(map[string]string)
+		if isDefault {
+			if obj.Annotations == nil {
+				obj.Annotations = make(map[string]string)
+			}
+			obj.Annotations["monitoring.appscode.com/is-default-prometheus"] = "true"
 		}
-		obj.Annotations["monitoring.appscode.com/is-default-prometheus"] = "true"
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, trickster.OwnedLabels)
 
 		obj.Spec.Type = "Prometheus"
 		obj.Spec.AppRef = &kmapi.TypedObjectReference{
@@ -577,6 +561,7 @@ func CreateGrafanaAppBinding(kc client.Client, key types.NamespacedName, config
 			obj.Annotations = make(map[string]string)
 		}
 		obj.Annotations["monitoring.appscode.com/is-default-grafana"] = "true"
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, trickster.OwnedLabels)
 
 		obj.Spec.Type = "Grafana"
 		obj.Spec.AppRef = nil
@@ -632,6 +617,7 @@ func CreateGrafanaAppBinding(kc client.Client, key types.NamespacedName, config
 				Kind:    "AppBinding",
 			})
 			obj.OwnerReferences = []metav1.OwnerReference{*ref}
+			obj.Labels = meta_util.OverwriteKeys(obj.Labels, trickster.OwnedLabels)
 
 			obj.StringData = map[string]string{
 				"token": config.BearerToken,
@@ -668,270 +654,14 @@ func NamespaceForPreset(kc client.Client, prom *monitoringv1.Prometheus) (string
 		return "", fmt.Errorf("failed to select AppBinding namespace for Prometheus %s/%s", prom.Namespace, prom.Name)
 	}
 	sort.Slice(namespaces, func(i, j int) bool {
-		return namespaces[i].CreationTimestamp.Before(&namespaces[j].CreationTimestamp)
+		if !namespaces[i].CreationTimestamp.Equal(&namespaces[j].CreationTimestamp) {
+			return namespaces[i].CreationTimestamp.Before(&namespaces[j].CreationTimestamp)
+		}
+		return namespaces[i].Name < namespaces[j].Name
 	})
 	return namespaces[0].Name, nil
 }
 
-/*
-apiVersion: helm.cattle.io/v1alpha1
-kind: ProjectHelmChart
-metadata:
-  name: project-monitoring
-  namespace: cattle-project-p-tkgpc
-
-status:
-  dashboardValues:
-    alertmanagerURL: >-
-      https://172.234.33.183/k8s/clusters/c-m-mhqtw2cs/api/v1/namespaces/cattle-project-p-tkgpc-monitoring/services/http:cattle-project-p-tkgpc-mon-alertmanager:9093/proxy
-    grafanaURL: >-
-      https://172.234.33.183/k8s/clusters/c-m-mhqtw2cs/api/v1/namespaces/cattle-project-p-tkgpc-monitoring/services/http:cattle-project-p-tkgpc-monitoring-grafana:80/proxy
-    prometheusURL: >-
-      https://172.234.33.183/k8s/clusters/c-m-mhqtw2cs/api/v1/namespaces/cattle-project-p-tkgpc-monitoring/services/http:cattle-project-p-tkgpc-mon-prometheus:9090/proxy
-
-*/
-
-func ListRancherProjects(kc client.Client) ([]rscoreapi.Project, error) {
-	var list core.NamespaceList
-	err := kc.List(context.TODO(), &list)
-	if meta.IsNoMatchError(err) {
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-
-	projects := map[string]rscoreapi.Project{}
-	now := time.Now()
-	for _, ns := range list.Items {
-		projectId, exists := ns.Labels[clustermeta.LabelKeyRancherFieldProjectId]
-		if !exists {
-			continue
-		}
-
-		project, exists := projects[projectId]
-		if !exists {
-			project = rscoreapi.Project{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:              projectId,
-					CreationTimestamp: metav1.NewTime(now),
-					UID:               types.UID(uuid.Must(uuid.NewUUID()).String()),
-					Labels: map[string]string{
-						clustermeta.LabelKeyRancherFieldProjectId: projectId,
-					},
-				},
-				Spec: rscoreapi.ProjectSpec{
-					Type:       rscoreapi.ProjectUser,
-					Namespaces: nil,
-					NamespaceSelector: &metav1.LabelSelector{
-						MatchLabels: map[string]string{
-							clustermeta.LabelKeyRancherFieldProjectId: projectId,
-						},
-					},
-				},
-			}
-		}
-
-		if ns.CreationTimestamp.Before(&project.CreationTimestamp) {
-			project.CreationTimestamp = ns.CreationTimestamp
-		}
-
-		if ns.Name == metav1.NamespaceDefault {
-			project.Spec.Type = rscoreapi.ProjectDefault
-		} else if ns.Name == metav1.NamespaceSystem {
-			project.Spec.Type = rscoreapi.ProjectSystem
-		}
-		project.Spec.Namespaces = append(project.Spec.Namespaces, ns.Name)
-
-		projects[projectId] = project
-	}
-
-	for projectId, prj := range projects {
-		var hasUseNs bool
-		presets := prj.Spec.Presets
-		for _, ns := range prj.Spec.Namespaces {
-			if !strings.HasPrefix(ns, "cattle-project-p-") {
-				hasUseNs = true
-			}
-
-			if prj.Spec.Type == rscoreapi.ProjectSystem {
-				if ns == metav1.NamespaceSystem {
-					var ccps chartsapi.ClusterChartPresetList
-					err := kc.List(context.TODO(), &ccps)
-					if err != nil && !meta.IsNoMatchError(err) {
-						return nil, err
-					}
-					for _, x := range ccps.Items {
-						presets = append(presets, shared.SourceLocator{
-							Resource: kmapi.ResourceID{
-								Group:   chartsapi.GroupVersion.Group,
-								Version: chartsapi.GroupVersion.Version,
-								Kind:    chartsapi.ResourceKindClusterChartPreset,
-							},
-							Ref: kmapi.ObjectReference{
-								Name: x.Name,
-							},
-						})
-					}
-				}
-			} else {
-				var cps chartsapi.ChartPresetList
-				err := kc.List(context.TODO(), &cps, client.InNamespace(ns))
-				if err != nil && !meta.IsNoMatchError(err) {
-					return nil, err
-				}
-				for _, x := range cps.Items {
-					presets = append(presets, shared.SourceLocator{
-						Resource: kmapi.ResourceID{
-							Group:   chartsapi.GroupVersion.Group,
-							Version: chartsapi.GroupVersion.Version,
-							Kind:    chartsapi.ResourceKindChartPreset,
-						},
-						Ref: kmapi.ObjectReference{
-							Name:      x.Name,
-							Namespace: x.Namespace,
-						},
-					})
-				}
-			}
-		}
-
-		// drop projects where all namespaces start with cattle-project-p
-		if !hasUseNs {
-			delete(projects, projectId)
-			continue
-		}
-
-		sort.Slice(presets, func(i, j int) bool {
-			if presets[i].Ref.Namespace != presets[j].Ref.Namespace {
-				return presets[i].Ref.Namespace < presets[j].Ref.Namespace
-			}
-			return presets[i].Ref.Name < presets[j].Ref.Name
-		})
-
-		prj.Spec.Presets = presets
-		projects[projectId] = prj
-	}
-
-	if clustermeta.IsRancherManaged(kc.RESTMapper()) {
-		sysProjectId, _, err := clustermeta.GetSystemProjectId(kc)
-		if err != nil {
-			return nil, err
-		}
-
-		var promList monitoringv1.PrometheusList
-		err = kc.List(context.TODO(), &promList)
-		if err != nil && !meta.IsNoMatchError(err) {
-			return nil, err
-		}
-		for _, prom := range promList.Items {
-			var projectId string
-			if prom.Namespace == "cattle-monitoring-system" {
-				projectId = sysProjectId
-			} else {
-				if prom.Spec.ServiceMonitorNamespaceSelector != nil {
-					projectId = prom.Spec.ServiceMonitorNamespaceSelector.MatchLabels[clustermeta.LabelKeyRancherHelmProjectId]
-				}
-			}
-
-			prj, found := projects[projectId]
-			if !found {
-				continue
-			}
-
-			if prj.Spec.Monitoring == nil {
-				prj.Spec.Monitoring = &rscoreapi.ProjectMonitoring{}
-			}
-			prj.Spec.Monitoring.PrometheusRef = &kmapi.ObjectReference{
-				Namespace: prom.Namespace,
-				Name:      prom.Name,
-			}
-
-			alertmanager, err := FindSiblingAlertManagerForPrometheus(kc, client.ObjectKeyFromObject(prom))
-			if err != nil {
-				return nil, err
-			}
-			prj.Spec.Monitoring.AlertmanagerRef = &kmapi.ObjectReference{
-				Namespace: alertmanager.Namespace,
-				Name:      alertmanager.Name,
-			}
-
-			if projectId == sysProjectId {
-				prj.Spec.Monitoring.AlertmanagerURL = alertmanager.Spec.ExternalURL
-				prj.Spec.Monitoring.PrometheusURL = prom.Spec.ExternalURL
-				prj.Spec.Monitoring.GrafanaURL = strings.Replace(
-					prj.Spec.Monitoring.PrometheusURL,
-					"/services/http:rancher-monitoring-prometheus:9090/proxy",
-					"/services/http:rancher-monitoring-grafana:80/proxy/?orgId=1",
-					1)
-			} else {
-				prj.Spec.Monitoring.AlertmanagerURL,
-					prj.Spec.Monitoring.GrafanaURL,
-					prj.Spec.Monitoring.PrometheusURL = DetectProjectMonitoringURLs(kc, prom.Namespace)
-			}
-
-			projects[projectId] = prj
-		}
-	}
-
-	result := make([]rscoreapi.Project, 0, len(projects))
-	for _, p := range projects {
-		result = append(result, p)
-	}
-	return result, nil
-}
-
-func FindSiblingAlertManagerForPrometheus(kc client.Client, key types.NamespacedName) (*monitoringv1.Alertmanager, error) {
-	var list monitoringv1.AlertmanagerList
-	err := kc.List(context.TODO(), &list, client.InNamespace(key.Namespace))
-	if err != nil {
-		return nil, err
-	}
-	if len(list.Items) > 1 {
-		klog.Warningln("multiple alert manager found in namespace %s", key.Namespace)
-	}
-	if len(list.Items) == 0 {
-		return nil, nil
-	}
-	return &list.Items[0], nil
-}
-
-func DetectProjectMonitoringURLs(kc client.Client, promNS string) (alertmanagerURL, grafanaURL, prometheusURL string) {
-	var prjHelm unstructured.Unstructured
-	prjHelm.SetAPIVersion("helm.cattle.io/v1alpha1")
-	prjHelm.SetKind("ProjectHelmChart")
-	key := client.ObjectKey{
-		Name:      "project-monitoring",
-		Namespace: strings.TrimSuffix(promNS, "-monitoring"),
-	}
-	err := kc.Get(context.TODO(), key, &prjHelm)
-	if err != nil {
-		return
-	}
-
-	alertmanagerURL, _, _ = unstructured.NestedString(prjHelm.UnstructuredContent(), "status", "dashboardValues", "alertmanagerURL")
-	grafanaURL, _, _ = unstructured.NestedString(prjHelm.UnstructuredContent(), "status", "dashboardValues", "grafanaURL")
-	prometheusURL, _, _ = unstructured.NestedString(prjHelm.UnstructuredContent(), "status", "dashboardValues", "prometheusURL")
-	return
-}
-
-var gr = schema.GroupResource{
-	Group:    rscoreapi.SchemeGroupVersion.Group,
-	Resource: rscoreapi.ResourceProjects,
-}
-
-func GetRancherProject(kc client.Client, projectId string) (*rscoreapi.Project, error) {
-	projects, err := ListRancherProjects(kc)
-	if err != nil {
-		return nil, err
-	}
-	for _, prj := range projects {
-		if prj.Name == projectId {
-			return &prj, nil
-		}
-	}
-	return nil, apierrors.NewNotFound(gr, projectId)
-}
-
 func FindServiceForPrometheus2(kc client.Client, prom *monitoringv1.Prometheus) (*core.Service, error) {
 	var svc core.Service
 	err := kc.Get(context.TODO(), client.ObjectKeyFromObject(prom), &svc)
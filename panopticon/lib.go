@@ -14,7 +14,8 @@ import (
 	meta_util "kmodules.xyz/client-go/meta"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sort"
-	"strings"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
 )
 
 /*
@@ -116,11 +117,31 @@ func CreateServiceMonitor(kc client.Client, prom *monitoringv1.Prometheus, panop
 		if err != nil {
 			return nil, err
 		}
+	} else if tenancy.Enabled(kc) && !tenancy.IsDefaultPrometheus(prom) {
+		namespaces, err = tenancy.TenantNamespaces(kc, prom)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keep *tenancy.Matcher
+	if len(namespaces) > 0 {
+		m, err := tenancy.NamespaceMatcher(kc, prom, namespaces, false)
+		if err != nil {
+			return nil, err
+		}
+		keep = &m
 	}
 
 	vt, err := cu.CreateOrPatch(context.TODO(), kc, &svcmon, func(in client.Object, createOp bool) client.Object {
 		obj := in.(*monitoringv1.ServiceMonitor)
 
+		// keep hand-edited metric relabelings
+		metricRelabelConfigs := map[string][]*monitoringv1.RelabelConfig{}
+		for _, e := range obj.Spec.Endpoints {
+			metricRelabelConfigs[e.Port] = e.MetricRelabelConfigs
+		}
+
 		obj.Labels = meta_util.OverwriteKeys(obj.Labels, svcmonLabels)
 		ref := metav1.NewControllerRef(prom, promGVK)
 		obj.OwnerReferences = []metav1.OwnerReference{*ref}
@@ -135,7 +156,7 @@ func CreateServiceMonitor(kc client.Client, prom *monitoringv1.Prometheus, panop
 		}
 
 		relabelConfigs := make([]*monitoringv1.RelabelConfig, 0, 2)
-		if len(namespaces) > 0 {
+		if keep != nil {
 			/*
 			  params:
 			    match[]:
@@ -145,8 +166,8 @@ func CreateServiceMonitor(kc client.Client, prom *monitoringv1.Prometheus, panop
 			      job=""}'
 			*/
 			relabelConfigs = append(relabelConfigs, &monitoringv1.RelabelConfig{
-				SourceLabels: []monitoringv1.LabelName{"namespace"}, // app_namespace ?
-				Regex:        strings.Join(namespaces, "|"),
+				SourceLabels: []monitoringv1.LabelName{monitoringv1.LabelName(keep.Label)}, // app_namespace ?
+				Regex:        keep.Regex,
 				Action:       "keep",
 			})
 		}
@@ -183,6 +204,9 @@ func CreateServiceMonitor(kc client.Client, prom *monitoringv1.Prometheus, panop
 				BearerTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
 			},
 		}
+		for i, e := range obj.Spec.Endpoints {
+			obj.Spec.Endpoints[i].MetricRelabelConfigs = metricRelabelConfigs[e.Port]
+		}
 
 		return obj
 	})
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+
+	"github.com/tamalsaha/rancid-syncer/projects"
+)
+
+// https://kubernetes.io/docs/tasks/extend-kubernetes/configure-aggregation-layer/#authentication-flow
+const (
+	authConfigMapNamespace = metav1.NamespaceSystem
+	authConfigMapName      = "extension-apiserver-authentication"
+)
+
+// Authorizer authenticates requests proxied by the kube-aggregator using the
+// request header client certificate and delegates authorization to the
+// kube-apiserver via SubjectAccessReview.
+type Authorizer struct {
+	kc kubernetes.Interface
+
+	ClientCAs     *x509.CertPool
+	allowedNames  []string
+	userHeaders   []string
+	groupHeaders  []string
+	extraPrefixes []string
+}
+
+func NewAuthorizer(kc kubernetes.Interface) (*Authorizer, error) {
+	cm, err := kc.CoreV1().ConfigMaps(authConfigMapNamespace).Get(context.TODO(), authConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Authorizer{
+		kc:        kc,
+		ClientCAs: x509.NewCertPool(),
+	}
+	caData, found := cm.Data["requestheader-client-ca-file"]
+	if !found || !a.ClientCAs.AppendCertsFromPEM([]byte(caData)) {
+		return nil, fmt.Errorf("missing requestheader-client-ca-file in configmap %s/%s", cm.Namespace, cm.Name)
+	}
+	for key, dst := range map[string]*[]string{
+		"requestheader-allowed-names":        &a.allowedNames,
+		"requestheader-username-headers":     &a.userHeaders,
+		"requestheader-group-headers":        &a.groupHeaders,
+		"requestheader-extra-headers-prefix": &a.extraPrefixes,
+	} {
+		if v := cm.Data[key]; v != "" {
+			if err := json.Unmarshal([]byte(v), dst); err != nil {
+				return nil, fmt.Errorf("failed to parse %s in configmap %s/%s: %w", key, cm.Namespace, cm.Name, err)
+			}
+		}
+	}
+	return a, nil
+}
+
+func (a *Authorizer) Authorize(r *http.Request, verb, name string) error {
+	user, groups, extra, err := a.authenticate(r)
+	if err != nil {
+		return err
+	}
+
+	gv := projects.SchemeGroupVersion
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:     verb,
+				Group:    gv.Group,
+				Version:  gv.Version,
+				Resource: rscoreapi.ResourceProjects,
+				Name:     name,
+			},
+			User:   user,
+			Groups: groups,
+			Extra:  extra,
+		},
+	}
+	sar, err = a.kc.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), sar, metav1.CreateOptions{})
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	if !sar.Status.Allowed {
+		return apierrors.NewForbidden(gr(), name, fmt.Errorf("%s", sar.Status.Reason))
+	}
+	return nil
+}
+
+func (a *Authorizer) authenticate(r *http.Request) (string, []string, map[string]authorizationv1.ExtraValue, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil, nil, apierrors.NewUnauthorized("missing request header client certificate")
+	}
+	if len(a.allowedNames) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if !contains(a.allowedNames, cn) {
+			return "", nil, nil, apierrors.NewUnauthorized(fmt.Sprintf("client certificate %q is not allowed to proxy requests", cn))
+		}
+	}
+
+	var user string
+	for _, h := range a.userHeaders {
+		if user = r.Header.Get(h); user != "" {
+			break
+		}
+	}
+	if user == "" {
+		return "", nil, nil, apierrors.NewUnauthorized("missing user header")
+	}
+
+	var groups []string
+	for _, h := range a.groupHeaders {
+		groups = append(groups, r.Header.Values(h)...)
+	}
+
+	extra := map[string]authorizationv1.ExtraValue{}
+	for key, values := range r.Header {
+		for _, prefix := range a.extraPrefixes {
+			if strings.HasPrefix(strings.ToLower(key), strings.ToLower(prefix)) {
+				k := strings.ToLower(strings.TrimPrefix(strings.ToLower(key), strings.ToLower(prefix)))
+				extra[k] = append(extra[k], values...)
+			}
+		}
+	}
+	return user, groups, extra, nil
+}
+
+func contains(arr []string, x string) bool {
+	for _, s := range arr {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/cert"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/klogr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	chartsapi "x-helm.dev/apimachinery/apis/charts/v1alpha1"
+
+	"github.com/tamalsaha/rancid-syncer/projects"
+)
+
+func main() {
+	var (
+		secureAddr   = ":8443"
+		certFile     string
+		keyFile      string
+		resyncPeriod = 10 * time.Minute
+		urls         = projects.URLOptions{Mode: projects.URLModeProxy}
+	)
+	pflag.StringVar(&secureAddr, "secure-addr", secureAddr, "The address the aggregated api server binds to.")
+	pflag.StringVar(&certFile, "tls-cert-file", certFile, "File containing the serving certificate. A self-signed certificate is generated if empty.")
+	pflag.StringVar(&keyFile, "tls-private-key-file", keyFile, "File containing the serving private key.")
+	pflag.DurationVar(&resyncPeriod, "resync-period", resyncPeriod, "Interval after which projects are recomputed even if no watched object changed.")
+	pflag.StringVar((*string)(&urls.Mode), "monitoring-url-mode", string(urls.Mode), "How project monitoring URLs are computed when Rancher does not report them. One of proxy, ingress.")
+	pflag.StringVar(&urls.ServerURL, "rancher-server-url", urls.ServerURL, "Rancher server URL used for proxy URLs. Detected from rancher-monitoring if empty.")
+	pflag.StringVar(&urls.ClusterID, "rancher-cluster-id", urls.ClusterID, "Rancher cluster id used for proxy URLs. Detected from rancher-monitoring if empty.")
+	pflag.Parse()
+
+	if err := run(secureAddr, certFile, keyFile, resyncPeriod, urls); err != nil {
+		klog.ErrorS(err, "project apiserver failed")
+		os.Exit(1)
+	}
+}
+
+func run(secureAddr, certFile, keyFile string, resyncPeriod time.Duration, urls projects.URLOptions) error {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = monitoringv1.AddToScheme(scheme)
+	_ = chartsapi.AddToScheme(scheme)
+
+	ctrl.SetLogger(klogr.New())
+	cfg := ctrl.GetConfigOrDie()
+	cfg.QPS = 100
+	cfg.Burst = 100
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:             scheme,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return err
+	}
+
+	kc, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	authz, err := NewAuthorizer(kc)
+	if err != nil {
+		return err
+	}
+
+	if err := projects.SetupIndexes(context.TODO(), mgr.GetFieldIndexer()); err != nil {
+		return err
+	}
+	storage := projects.NewStorage()
+	index := projects.NewIndex(mgr.GetClient(), mgr.GetCache(), resyncPeriod, urls)
+	index.AddHandler(storage.Apply)
+	if err := mgr.Add(index); err != nil {
+		return err
+	}
+
+	servingCert, err := loadServingCert(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:    secureAddr,
+		Handler: &Server{storage: storage, authz: authz, ready: index.HasSynced},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{servingCert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    authz.ClientCAs,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		go func() {
+			<-ctx.Done()
+			_ = srv.Shutdown(context.Background())
+		}()
+		klog.InfoS("serving projects", "addr", secureAddr)
+		if err := srv.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}))
+	if err != nil {
+		return err
+	}
+
+	return mgr.Start(ctrl.SetupSignalHandler())
+}
+
+func loadServingCert(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" && keyFile != "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	host, _ := os.Hostname()
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey(host, nil, nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/klog/v2"
+	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+
+	"github.com/tamalsaha/rancid-syncer/projects"
+)
+
+var (
+	groupPath   = "/apis/" + projects.SchemeGroupVersion.Group
+	versionPath = groupPath + "/" + projects.SchemeGroupVersion.Version
+)
+
+type Server struct {
+	storage *projects.Storage
+	authz   *Authorizer
+	// ready reports whether the project index is built, so the storage
+	// doesn't serve empty lists while the caches sync.
+	ready func() bool
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz", "/livez":
+		_, _ = w.Write([]byte("ok"))
+		return
+	case "/readyz":
+		if !s.ready() {
+			http.Error(w, "project index is not built yet", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeError(w, apierrors.NewMethodNotSupported(gr(), r.Method))
+		return
+	}
+
+	verb, name, err := s.parseRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if verb == "" {
+		s.serveDiscovery(w, r)
+		return
+	}
+
+	if err := s.authz.Authorize(r, verb, name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch verb {
+	case "get":
+		prj, err := s.storage.Get(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if wantsTable(r) {
+			writeObject(w, http.StatusOK, toTable([]rscoreapi.Project{*prj}))
+			return
+		}
+		writeObject(w, http.StatusOK, prj)
+	case "list":
+		opts, err := listOptions(r, "")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		list := s.storage.List(opts)
+		if wantsTable(r) {
+			writeObject(w, http.StatusOK, toTable(list.Items))
+			return
+		}
+		writeObject(w, http.StatusOK, list)
+	case "watch":
+		s.serveWatch(w, r, name)
+	}
+}
+
+// parseRequest returns an empty verb for discovery requests.
+func (s *Server) parseRequest(r *http.Request) (verb, name string, err error) {
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	switch p {
+	case "/apis", groupPath, versionPath:
+		return "", "", nil
+	}
+	if !strings.HasPrefix(p, versionPath+"/") {
+		return "", "", apierrors.NewNotFound(gr(), p)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(p, versionPath+"/"), "/")
+	watching := isWatch(r)
+	if parts[0] == "watch" {
+		watching = true
+		parts = parts[1:]
+	}
+	if len(parts) == 0 || len(parts) > 2 || parts[0] != rscoreapi.ResourceProjects {
+		return "", "", apierrors.NewNotFound(gr(), p)
+	}
+	if len(parts) == 2 {
+		name = parts[1]
+	}
+
+	switch {
+	case watching:
+		return "watch", name, nil
+	case name != "":
+		return "get", name, nil
+	default:
+		return "list", "", nil
+	}
+}
+
+func (s *Server) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	gv := projects.SchemeGroupVersion
+	version := metav1.GroupVersionForDiscovery{
+		GroupVersion: gv.String(),
+		Version:      gv.Version,
+	}
+	group := metav1.APIGroup{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "APIGroup",
+		},
+		Name:             gv.Group,
+		Versions:         []metav1.GroupVersionForDiscovery{version},
+		PreferredVersion: version,
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/apis":
+		writeObject(w, http.StatusOK, &metav1.APIGroupList{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "APIGroupList",
+			},
+			Groups: []metav1.APIGroup{group},
+		})
+	case groupPath:
+		writeObject(w, http.StatusOK, &group)
+	case versionPath:
+		writeObject(w, http.StatusOK, &metav1.APIResourceList{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "APIResourceList",
+			},
+			GroupVersion: gv.String(),
+			APIResources: []metav1.APIResource{
+				{
+					Name:         rscoreapi.ResourceProjects,
+					SingularName: rscoreapi.ResourceProject,
+					Namespaced:   false,
+					Kind:         rscoreapi.ResourceKindProject,
+					Verbs:        []string{"get", "list", "watch"},
+				},
+			},
+		})
+	}
+}
+
+func (s *Server) serveWatch(w http.ResponseWriter, r *http.Request, name string) {
+	opts, err := listOptions(r, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	if v := r.URL.Query().Get("timeoutSeconds"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, apierrors.NewBadRequest("invalid timeoutSeconds "+v))
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(sec)*time.Second)
+		defer cancel()
+	}
+
+	watcher, err := s.storage.Watch(ctx, r.URL.Query().Get("resourceVersion"), opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer watcher.Stop()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, apierrors.NewInternalError(fmt.Errorf("unable to start watch, streaming not supported")))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			err := enc.Encode(&metav1.WatchEvent{
+				Type:   string(e.Type),
+				Object: runtime.RawExtension{Object: e.Object},
+			})
+			if err != nil {
+				klog.ErrorS(err, "failed to write watch event")
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func isWatch(r *http.Request) bool {
+	v := r.URL.Query().Get("watch")
+	return v == "true" || v == "1"
+}
+
+func listOptions(r *http.Request, name string) (projects.ListOptions, error) {
+	var opts projects.ListOptions
+
+	q := r.URL.Query()
+	if v := q.Get("labelSelector"); v != "" {
+		sel, err := labels.Parse(v)
+		if err != nil {
+			return opts, apierrors.NewBadRequest(err.Error())
+		}
+		opts.LabelSelector = sel
+	}
+	if v := q.Get("fieldSelector"); v != "" {
+		sel, err := fields.ParseSelector(v)
+		if err != nil {
+			return opts, apierrors.NewBadRequest(err.Error())
+		}
+		opts.FieldSelector = sel
+	}
+	if name != "" {
+		nameSel := fields.OneTermEqualSelector("metadata.name", name)
+		if opts.FieldSelector != nil {
+			opts.FieldSelector = fields.AndSelectors(opts.FieldSelector, nameSel)
+		} else {
+			opts.FieldSelector = nameSel
+		}
+	}
+	return opts, nil
+}
+
+func wantsTable(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.Contains(accept, "as=Table") {
+			return true
+		}
+	}
+	return false
+}
+
+func toTable(items []rscoreapi.Project) *metav1.Table {
+	table := &metav1.Table{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: metav1.SchemeGroupVersion.String(),
+			Kind:       "Table",
+		},
+		ColumnDefinitions: []metav1.TableColumnDefinition{
+			{Name: "Name", Type: "string", Format: "name"},
+			{Name: "Type", Type: "string"},
+			{Name: "Namespaces", Type: "integer"},
+			{Name: "Age", Type: "date"},
+		},
+	}
+	for _, prj := range items {
+		table.Rows = append(table.Rows, metav1.TableRow{
+			Cells: []any{
+				prj.Name,
+				string(prj.Spec.Type),
+				len(prj.Spec.Namespaces),
+				duration.HumanDuration(time.Since(prj.CreationTimestamp.Time)),
+			},
+			Object: runtime.RawExtension{
+				Object: &metav1.PartialObjectMetadata{
+					TypeMeta: metav1.TypeMeta{
+						APIVersion: metav1.SchemeGroupVersion.String(),
+						Kind:       "PartialObjectMetadata",
+					},
+					ObjectMeta: prj.ObjectMeta,
+				},
+			},
+		})
+	}
+	return table
+}
+
+func writeObject(w http.ResponseWriter, code int, obj any) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		klog.ErrorS(err, "failed to encode response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok {
+		status = apierrors.NewInternalError(err)
+	}
+	s := status.Status()
+	s.TypeMeta = metav1.TypeMeta{
+		APIVersion: "v1",
+		Kind:       "Status",
+	}
+	writeObject(w, int(s.Code), &s)
+}
+
+func gr() schema.GroupResource {
+	return projects.SchemeGroupVersion.WithResource(rscoreapi.ResourceProjects).GroupResource()
+}
@@ -0,0 +1,407 @@
+package projects
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+	clustermeta "kmodules.xyz/client-go/cluster"
+	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	chartsapi "x-helm.dev/apimachinery/apis/charts/v1alpha1"
+)
+
+const (
+	// IndexNamespaceProjectId indexes Namespaces by their Rancher project label.
+	IndexNamespaceProjectId = "projectId"
+	// IndexPrometheusProjectId indexes project Prometheus objects by the project they monitor.
+	IndexPrometheusProjectId = "prometheusProjectId"
+	// IndexPrometheusAlertmanagerNamespace indexes Prometheus objects by the
+	// namespaces of the Alertmanager Services they send alerts to.
+	IndexPrometheusAlertmanagerNamespace = "prometheusAlertmanagerNamespace"
+)
+
+// SetupIndexes registers the field indexes used by Index. ChartPresets and
+// Prometheus objects are also looked up by their own namespace, and
+// Alertmanagers and ProjectHelmCharts only by namespace, which the cache
+// already indexes.
+func SetupIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+	err := indexer.IndexField(ctx, &core.Namespace{}, IndexNamespaceProjectId, func(obj client.Object) []string {
+		if projectId, found := obj.GetLabels()[clustermeta.LabelKeyRancherFieldProjectId]; found {
+			return []string{projectId}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = indexer.IndexField(ctx, &monitoringv1.Prometheus{}, IndexPrometheusProjectId, func(obj client.Object) []string {
+		if projectId := PrometheusProjectId(obj.(*monitoringv1.Prometheus)); projectId != "" {
+			return []string{projectId}
+		}
+		return nil
+	})
+	if meta.IsNoMatchError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return indexer.IndexField(ctx, &monitoringv1.Prometheus{}, IndexPrometheusAlertmanagerNamespace, func(obj client.Object) []string {
+		return alertmanagerNamespaces(obj.(*monitoringv1.Prometheus))
+	})
+}
+
+// alertmanagerNamespaces returns the namespaces of the Alertmanager Services
+// prom sends alerts to.
+func alertmanagerNamespaces(prom *monitoringv1.Prometheus) []string {
+	if prom.Spec.Alerting == nil {
+		return nil
+	}
+	var result []string
+	for _, ep := range prom.Spec.Alerting.Alertmanagers {
+		ns := ep.Namespace
+		if ns == "" {
+			ns = prom.Namespace
+		}
+		if !contains(result, ns) {
+			result = append(result, ns)
+		}
+	}
+	return result
+}
+
+// Index keeps every Rancher project computed from a shared informer cache.
+// Changes to Namespaces, presets, monitoring objects and the Services and
+// Ingresses in front of them only rebuild the affected projects, and lookups
+// never hit the api server.
+type Index struct {
+	kc           client.Client
+	cache        cache.Cache
+	queue        workqueue.RateLimitingInterface
+	resyncPeriod time.Duration
+	urls         URLOptions
+	// builder is created once the cache is synced, so the cluster identity
+	// and the Rancher server are detected once instead of on every rebuild.
+	builder *builder
+	// synced is set once every project in the synced cache has been built.
+	synced atomic.Bool
+
+	mu       sync.RWMutex
+	projects map[string]*rscoreapi.Project
+	handlers []func(name string, prj *rscoreapi.Project)
+}
+
+var _ manager.Runnable = &Index{}
+
+// NewIndex returns an Index that reads through kc, which must be backed by
+// c and have the indexes from SetupIndexes.
+func NewIndex(kc client.Client, c cache.Cache, resyncPeriod time.Duration, urls URLOptions) *Index {
+	return &Index{
+		kc:           kc,
+		cache:        c,
+		queue:        workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "projects"),
+		resyncPeriod: resyncPeriod,
+		urls:         urls,
+		projects:     map[string]*rscoreapi.Project{},
+	}
+}
+
+// AddHandler registers fn to be called with the new state of a project
+// every time it is rebuilt. prj is nil when the project is removed.
+// Handlers must be added before the Index is started.
+func (idx *Index) AddHandler(fn func(name string, prj *rscoreapi.Project)) {
+	idx.handlers = append(idx.handlers, fn)
+}
+
+func (idx *Index) Get(projectId string) (*rscoreapi.Project, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	prj, found := idx.projects[projectId]
+	if !found {
+		return nil, apierrors.NewNotFound(gr, projectId)
+	}
+	return prj.DeepCopy(), nil
+}
+
+func (idx *Index) List() []rscoreapi.Project {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	result := make([]rscoreapi.Project, 0, len(idx.projects))
+	for _, prj := range idx.projects {
+		result = append(result, *prj.DeepCopy())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// HasSynced reports whether the caches are synced and every project has
+// been built once. Until then, Get and List may miss projects.
+func (idx *Index) HasSynced() bool {
+	return idx.synced.Load()
+}
+
+func (idx *Index) NeedLeaderElection() bool {
+	return false
+}
+
+func (idx *Index) Start(ctx context.Context) error {
+	defer idx.queue.ShutDown()
+
+	if err := idx.watch(ctx); err != nil {
+		return err
+	}
+	if !idx.cache.WaitForCacheSync(ctx) {
+		return errors.New("failed to sync project caches")
+	}
+	b, err := newBuilder(idx.kc, true, idx.urls)
+	if err != nil {
+		return err
+	}
+	idx.builder = b
+	if err := idx.buildAll(); err != nil {
+		return err
+	}
+	idx.synced.Store(true)
+
+	go func() {
+		for idx.processNextItem() {
+		}
+	}()
+
+	ticker := time.NewTicker(idx.resyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			idx.resync()
+		}
+	}
+}
+
+// resync enqueues every known project, so changes the informers missed are
+// eventually picked up.
+func (idx *Index) resync() {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	for projectId := range idx.projects {
+		idx.queue.Add(projectId)
+	}
+}
+
+// buildAll builds every project of the synced cache. A project that fails to
+// build is retried by the queue, like any other change.
+func (idx *Index) buildAll() error {
+	var nsList core.NamespaceList
+	if err := idx.kc.List(context.TODO(), &nsList); err != nil {
+		return err
+	}
+	projectIds := sets.NewString()
+	for i := range nsList.Items {
+		projectIds.Insert(idx.projectsForNamespace(&nsList.Items[i])...)
+	}
+	for _, projectId := range projectIds.List() {
+		if err := idx.rebuild(projectId); err != nil {
+			klog.ErrorS(err, "failed to build project", "project", projectId)
+			idx.queue.AddRateLimited(projectId)
+		}
+	}
+	return nil
+}
+
+func (idx *Index) processNextItem() bool {
+	key, quit := idx.queue.Get()
+	if quit {
+		return false
+	}
+	defer idx.queue.Done(key)
+
+	projectId := key.(string)
+	if err := idx.rebuild(projectId); err != nil {
+		klog.ErrorS(err, "failed to rebuild project", "project", projectId)
+		idx.queue.AddRateLimited(key)
+		return true
+	}
+	idx.queue.Forget(key)
+	return true
+}
+
+func (idx *Index) rebuild(projectId string) error {
+	var nsList core.NamespaceList
+	err := idx.kc.List(context.TODO(), &nsList, client.MatchingFields{IndexNamespaceProjectId: projectId})
+	if err != nil {
+		return err
+	}
+
+	var prj *rscoreapi.Project
+	if len(nsList.Items) > 0 {
+		prj, err = idx.builder.build(projectId, nsList.Items)
+		if err != nil {
+			return err
+		}
+	}
+
+	idx.mu.Lock()
+	if prj == nil {
+		delete(idx.projects, projectId)
+	} else {
+		idx.projects[projectId] = prj
+	}
+	idx.mu.Unlock()
+
+	for _, fn := range idx.handlers {
+		if prj == nil {
+			fn(projectId, nil)
+		} else {
+			fn(projectId, prj.DeepCopy())
+		}
+	}
+	return nil
+}
+
+// watch enqueues the projects affected by a change to any object that contributes to a project.
+func (idx *Index) watch(ctx context.Context) error {
+	var prjHelm unstructured.Unstructured
+	prjHelm.SetAPIVersion("helm.cattle.io/v1alpha1")
+	prjHelm.SetKind("ProjectHelmChart")
+
+	sources := map[client.Object]func(obj client.Object) []string{
+		&core.Namespace{}:               idx.projectsForNamespace,
+		&chartsapi.ChartPreset{}:        idx.projectsForNamespacedObject,
+		&chartsapi.ClusterChartPreset{}: idx.projectsForClusterObject,
+		&monitoringv1.Prometheus{}:      idx.projectsForPrometheus,
+		&monitoringv1.Alertmanager{}:    idx.projectsForAlertmanager,
+		&core.Service{}:                 idx.projectsForService,
+		&networkingv1.Ingress{}:         idx.projectsForService,
+		&prjHelm:                        idx.projectsForProjectHelmChart,
+	}
+	for obj, fn := range sources {
+		informer, err := idx.cache.GetInformer(ctx, obj)
+		if meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		informer.AddEventHandler(idx.enqueueFor(fn))
+	}
+	return nil
+}
+
+func (idx *Index) enqueueFor(fn func(obj client.Object) []string) toolscache.ResourceEventHandler {
+	enqueue := func(o interface{}) {
+		if tombstone, ok := o.(toolscache.DeletedFinalStateUnknown); ok {
+			o = tombstone.Obj
+		}
+		obj, ok := o.(client.Object)
+		if !ok {
+			return
+		}
+		for _, projectId := range fn(obj) {
+			idx.queue.Add(projectId)
+		}
+	}
+	return toolscache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			enqueue(oldObj)
+			enqueue(newObj)
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+func (idx *Index) projectsForNamespace(obj client.Object) []string {
+	if projectId, found := obj.GetLabels()[clustermeta.LabelKeyRancherFieldProjectId]; found {
+		return []string{projectId}
+	}
+	return nil
+}
+
+func (idx *Index) projectsForNamespacedObject(obj client.Object) []string {
+	var ns core.Namespace
+	if err := idx.kc.Get(context.TODO(), client.ObjectKey{Name: obj.GetNamespace()}, &ns); err != nil {
+		return nil
+	}
+	return idx.projectsForNamespace(&ns)
+}
+
+func (idx *Index) projectsForClusterObject(_ client.Object) []string {
+	var ns core.Namespace
+	if err := idx.kc.Get(context.TODO(), client.ObjectKey{Name: metav1.NamespaceSystem}, &ns); err != nil {
+		return nil
+	}
+	return idx.projectsForNamespace(&ns)
+}
+
+func (idx *Index) projectsForPrometheus(obj client.Object) []string {
+	if obj.GetNamespace() == clustermeta.NamespaceRancherMonitoring {
+		return idx.projectsForClusterObject(obj)
+	}
+	if prom, ok := obj.(*monitoringv1.Prometheus); ok {
+		if projectId := PrometheusProjectId(prom); projectId != "" {
+			return []string{projectId}
+		}
+	}
+	return nil
+}
+
+// projectsForAlertmanager returns the projects of every Prometheus that sends
+// alerts to a Service in the namespace of the Alertmanager.
+func (idx *Index) projectsForAlertmanager(obj client.Object) []string {
+	var list monitoringv1.PrometheusList
+	err := idx.kc.List(context.TODO(), &list, client.MatchingFields{IndexPrometheusAlertmanagerNamespace: obj.GetNamespace()})
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, prom := range list.Items {
+		result = append(result, idx.projectsForPrometheus(prom)...)
+	}
+	return result
+}
+
+// projectsForService returns the projects whose monitoring URLs may point to
+// a Service, or to an Ingress in front of one: those of the Prometheus in its
+// namespace and of the Prometheus that send alerts to it.
+func (idx *Index) projectsForService(obj client.Object) []string {
+	return append(idx.projectsForPrometheusesIn(obj.GetNamespace()), idx.projectsForAlertmanager(obj)...)
+}
+
+func (idx *Index) projectsForProjectHelmChart(obj client.Object) []string {
+	return idx.projectsForPrometheusesIn(obj.GetNamespace() + "-monitoring")
+}
+
+func (idx *Index) projectsForPrometheusesIn(ns string) []string {
+	var list monitoringv1.PrometheusList
+	if err := idx.kc.List(context.TODO(), &list, client.InNamespace(ns)); err != nil {
+		return nil
+	}
+	var result []string
+	for _, prom := range list.Items {
+		result = append(result, idx.projectsForPrometheus(prom)...)
+	}
+	return result
+}
@@ -0,0 +1,431 @@
+package projects
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	clustermeta "kmodules.xyz/client-go/cluster"
+	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	chartsapi "x-helm.dev/apimachinery/apis/charts/v1alpha1"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+)
+
+// indexedClient adds the field indexes registered by SetupIndexes to a fake
+// client, which ignores field selectors.
+type indexedClient struct {
+	client.Client
+	indexes map[string]client.IndexerFunc
+}
+
+func (c *indexedClient) IndexField(_ context.Context, _ client.Object, field string, fn client.IndexerFunc) error {
+	c.indexes[field] = fn
+	return nil
+}
+
+func (c *indexedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if err := c.Client.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	if listOpts.FieldSelector == nil || listOpts.FieldSelector.Empty() {
+		return nil
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	var kept []runtime.Object
+	for _, item := range items {
+		obj := item.(client.Object)
+		matches := true
+		for _, r := range listOpts.FieldSelector.Requirements() {
+			fn, found := c.indexes[r.Field]
+			matches = matches && found && contains(fn(obj), r.Value)
+		}
+		if matches {
+			kept = append(kept, item)
+		}
+	}
+	return meta.SetList(list, kept)
+}
+
+func namespace(name, projectId string) *core.Namespace {
+	ns := &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, UID: k8stypes.UID("uid-" + name)}}
+	if projectId != "" {
+		ns.Labels = map[string]string{clustermeta.LabelKeyRancherFieldProjectId: projectId}
+	}
+	return ns
+}
+
+func projectPrometheus(ns, projectId string) *monitoringv1.Prometheus {
+	return &monitoringv1.Prometheus{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "prom"},
+		Spec: monitoringv1.PrometheusSpec{
+			CommonPrometheusFields: monitoringv1.CommonPrometheusFields{
+				ServiceMonitorNamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{clustermeta.LabelKeyRancherHelmProjectId: projectId},
+				},
+			},
+			Alerting: &monitoringv1.AlertingSpec{
+				Alertmanagers: []monitoringv1.AlertmanagerEndpoints{{Namespace: "alerting", Name: "am"}},
+			},
+		},
+	}
+}
+
+// newTestIndex returns an Index over a fake client loaded with objs, ready
+// to build projects without being started.
+func newTestIndex(t *testing.T, objs ...client.Object) (*Index, client.Client) {
+	t.Helper()
+
+	kc := &indexedClient{
+		Client:  testutil.NewFakeClient(t, objs...),
+		indexes: map[string]client.IndexerFunc{},
+	}
+	if err := SetupIndexes(context.TODO(), kc); err != nil {
+		t.Fatal(err)
+	}
+	idx := NewIndex(kc, nil, time.Hour, URLOptions{})
+	b, err := newBuilder(kc, true, idx.urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.builder = b
+	t.Cleanup(idx.queue.ShutDown)
+	return idx, kc
+}
+
+// drain rebuilds every queued project and returns their ids.
+func drain(idx *Index) []string {
+	var keys []string
+	for idx.queue.Len() > 0 {
+		key, _ := idx.queue.Get()
+		keys = append(keys, key.(string))
+		idx.queue.Done(key)
+		idx.queue.Forget(key)
+		_ = idx.rebuild(key.(string))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func projectNamespaces(idx *Index) map[string][]string {
+	result := map[string][]string{}
+	for _, prj := range idx.List() {
+		result[prj.Name] = prj.Spec.Namespaces
+	}
+	return result
+}
+
+func TestIndexBuildAll(t *testing.T) {
+	idx, _ := newTestIndex(t,
+		namespace(metav1.NamespaceSystem, "p-sys"),
+		namespace("demo", "p-1"),
+		namespace("demo-2", "p-1"),
+		namespace("cattle-project-p-2", "p-2"),
+		namespace("unlabeled", ""),
+	)
+
+	var built []string
+	idx.AddHandler(func(name string, prj *rscoreapi.Project) {
+		if prj != nil {
+			built = append(built, name)
+		}
+	})
+	if err := idx.buildAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"p-1":   {"demo", "demo-2"},
+		"p-sys": {metav1.NamespaceSystem},
+	}
+	if got := projectNamespaces(idx); !reflect.DeepEqual(got, want) {
+		t.Errorf("projects = %v, want %v", got, want)
+	}
+	if want := []string{"p-1", "p-sys"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("handlers called for %v, want %v", built, want)
+	}
+	// p-2 only has cattle-project-p-* namespaces
+	if _, err := idx.Get("p-2"); !apierrors.IsNotFound(err) {
+		t.Errorf("Get(p-2) error = %v, want not found", err)
+	}
+	prj, err := idx.Get("p-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prj.Spec.Type != rscoreapi.ProjectUser {
+		t.Errorf("Get(p-1) type = %s, want %s", prj.Spec.Type, rscoreapi.ProjectUser)
+	}
+	if prj, _ := idx.Get("p-sys"); prj.Spec.Type != rscoreapi.ProjectSystem {
+		t.Errorf("Get(p-sys) type = %s, want %s", prj.Spec.Type, rscoreapi.ProjectSystem)
+	}
+}
+
+func TestIndexEventProjects(t *testing.T) {
+	var prjHelm unstructured.Unstructured
+	prjHelm.SetAPIVersion("helm.cattle.io/v1alpha1")
+	prjHelm.SetKind("ProjectHelmChart")
+	prjHelm.SetNamespace("cattle-project-p-1")
+	prjHelm.SetName("monitoring")
+
+	idx, _ := newTestIndex(t,
+		namespace(metav1.NamespaceSystem, "p-sys"),
+		namespace("demo", "p-1"),
+		namespace("cattle-project-p-1-monitoring", "p-sys"),
+		projectPrometheus("cattle-project-p-1-monitoring", "p-1"),
+	)
+
+	tests := []struct {
+		name string
+		fn   func(obj client.Object) []string
+		obj  client.Object
+		want []string
+	}{
+		{
+			name: "labeled namespace",
+			fn:   idx.projectsForNamespace,
+			obj:  namespace("demo", "p-1"),
+			want: []string{"p-1"},
+		},
+		{
+			name: "unlabeled namespace",
+			fn:   idx.projectsForNamespace,
+			obj:  namespace("unlabeled", ""),
+		},
+		{
+			name: "ChartPreset",
+			fn:   idx.projectsForNamespacedObject,
+			obj:  &chartsapi.ChartPreset{ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "preset"}},
+			want: []string{"p-1"},
+		},
+		{
+			name: "ChartPreset in a missing namespace",
+			fn:   idx.projectsForNamespacedObject,
+			obj:  &chartsapi.ChartPreset{ObjectMeta: metav1.ObjectMeta{Namespace: "missing", Name: "preset"}},
+		},
+		{
+			name: "ClusterChartPreset",
+			fn:   idx.projectsForClusterObject,
+			obj:  &chartsapi.ClusterChartPreset{ObjectMeta: metav1.ObjectMeta{Name: "preset"}},
+			want: []string{"p-sys"},
+		},
+		{
+			name: "project Prometheus",
+			fn:   idx.projectsForPrometheus,
+			obj:  projectPrometheus("cattle-project-p-1-monitoring", "p-1"),
+			want: []string{"p-1"},
+		},
+		{
+			name: "cluster Prometheus",
+			fn:   idx.projectsForPrometheus,
+			obj:  &monitoringv1.Prometheus{ObjectMeta: metav1.ObjectMeta{Namespace: clustermeta.NamespaceRancherMonitoring, Name: "prom"}},
+			want: []string{"p-sys"},
+		},
+		{
+			name: "Alertmanager a Prometheus sends alerts to",
+			fn:   idx.projectsForAlertmanager,
+			obj:  &monitoringv1.Alertmanager{ObjectMeta: metav1.ObjectMeta{Namespace: "alerting", Name: "am"}},
+			want: []string{"p-1"},
+		},
+		{
+			name: "unused Alertmanager",
+			fn:   idx.projectsForAlertmanager,
+			obj:  &monitoringv1.Alertmanager{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "am"}},
+		},
+		{
+			name: "Service next to a Prometheus",
+			fn:   idx.projectsForService,
+			obj:  &core.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "cattle-project-p-1-monitoring", Name: "prom"}},
+			want: []string{"p-1"},
+		},
+		{
+			name: "ProjectHelmChart",
+			fn:   idx.projectsForProjectHelmChart,
+			obj:  &prjHelm,
+			want: []string{"p-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fn(tt.obj); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("projects = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		// event makes a change through kc and sends its event to idx
+		event func(t *testing.T, kc client.Client, idx *Index)
+		want  []string
+		// projects after the queued projects are rebuilt
+		projects map[string][]string
+	}{
+		{
+			name: "add",
+			event: func(t *testing.T, kc client.Client, idx *Index) {
+				h := idx.enqueueFor(idx.projectsForNamespace)
+				ns := namespace("new", "p-3")
+				if err := kc.Create(context.TODO(), ns); err != nil {
+					t.Fatal(err)
+				}
+				h.OnAdd(ns)
+			},
+			want: []string{"p-3"},
+			projects: map[string][]string{
+				"p-1": {"demo", "moving"},
+				"p-2": {"other"},
+				"p-3": {"new"},
+			},
+		},
+		{
+			name: "update moves a namespace",
+			event: func(t *testing.T, kc client.Client, idx *Index) {
+				h := idx.enqueueFor(idx.projectsForNamespace)
+				old := namespace("moving", "p-1")
+				ns := namespace("moving", "p-2")
+				if err := kc.Update(context.TODO(), ns); err != nil {
+					t.Fatal(err)
+				}
+				h.OnUpdate(old, ns)
+			},
+			want: []string{"p-1", "p-2"},
+			projects: map[string][]string{
+				"p-1": {"demo"},
+				"p-2": {"moving", "other"},
+			},
+		},
+		{
+			name: "update moves a Prometheus",
+			event: func(t *testing.T, kc client.Client, idx *Index) {
+				h := idx.enqueueFor(idx.projectsForPrometheus)
+				old := projectPrometheus("monitoring", "p-1")
+				prom := projectPrometheus("monitoring", "p-2")
+				if err := kc.Create(context.TODO(), prom); err != nil {
+					t.Fatal(err)
+				}
+				h.OnUpdate(old, prom)
+			},
+			want: []string{"p-1", "p-2"},
+			projects: map[string][]string{
+				"p-1": {"demo", "moving"},
+				"p-2": {"other"},
+			},
+		},
+		{
+			name: "delete the last namespace",
+			event: func(t *testing.T, kc client.Client, idx *Index) {
+				h := idx.enqueueFor(idx.projectsForNamespace)
+				ns := namespace("other", "p-2")
+				if err := kc.Delete(context.TODO(), ns); err != nil {
+					t.Fatal(err)
+				}
+				h.OnDelete(toolscache.DeletedFinalStateUnknown{Key: ns.Name, Obj: ns})
+			},
+			want: []string{"p-2"},
+			projects: map[string][]string{
+				"p-1": {"demo", "moving"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx, kc := newTestIndex(t,
+				namespace("demo", "p-1"),
+				namespace("moving", "p-1"),
+				namespace("other", "p-2"),
+				namespace(metav1.NamespaceSystem, ""),
+			)
+			if err := idx.buildAll(); err != nil {
+				t.Fatal(err)
+			}
+
+			removed := map[string]bool{}
+			idx.AddHandler(func(name string, prj *rscoreapi.Project) {
+				removed[name] = prj == nil
+			})
+			tt.event(t, kc, idx)
+			if got := drain(idx); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("queued projects = %v, want %v", got, tt.want)
+			}
+			if got := projectNamespaces(idx); !reflect.DeepEqual(got, tt.projects) {
+				t.Errorf("projects = %v, want %v", got, tt.projects)
+			}
+			for name, gone := range removed {
+				if _, found := tt.projects[name]; found == gone {
+					t.Errorf("handler for %s called with removed = %v", name, gone)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexResync(t *testing.T) {
+	idx, kc := newTestIndex(t,
+		namespace("demo", "p-1"),
+		namespace("other", "p-2"),
+		namespace(metav1.NamespaceSystem, ""),
+	)
+	if err := idx.buildAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a change the informers missed
+	if err := kc.Create(context.TODO(), namespace("demo-2", "p-1")); err != nil {
+		t.Fatal(err)
+	}
+	idx.resync()
+	if got, want := drain(idx), []string{"p-1", "p-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resync queued %v, want %v", got, want)
+	}
+	want := map[string][]string{
+		"p-1": {"demo", "demo-2"},
+		"p-2": {"other"},
+	}
+	if got := projectNamespaces(idx); !reflect.DeepEqual(got, want) {
+		t.Errorf("projects after resync = %v, want %v", got, want)
+	}
+}
+
+func TestAlertmanagerNamespaces(t *testing.T) {
+	prom := &monitoringv1.Prometheus{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "cattle-project-p-1-monitoring", Name: "prom"},
+		Spec: monitoringv1.PrometheusSpec{
+			Alerting: &monitoringv1.AlertingSpec{
+				Alertmanagers: []monitoringv1.AlertmanagerEndpoints{
+					{Name: "am"},
+					{Namespace: "monitoring", Name: "am-1"},
+					{Namespace: "monitoring", Name: "am-2"},
+				},
+			},
+		},
+	}
+	want := []string{"cattle-project-p-1-monitoring", "monitoring"}
+	if got := alertmanagerNamespaces(prom); !reflect.DeepEqual(got, want) {
+		t.Errorf("alertmanagerNamespaces() = %v, want %v", got, want)
+	}
+
+	prom.Spec.Alerting = nil
+	if got := alertmanagerNamespaces(prom); got != nil {
+		t.Errorf("alertmanagerNamespaces() without alerting = %v, want nil", got)
+	}
+}
@@ -0,0 +1,628 @@
+package projects
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	kmapi "kmodules.xyz/client-go/api/v1"
+	clustermeta "kmodules.xyz/client-go/cluster"
+	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+	"kmodules.xyz/resource-metadata/apis/shared"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	chartsapi "x-helm.dev/apimachinery/apis/charts/v1alpha1"
+)
+
+/*
+apiVersion: helm.cattle.io/v1alpha1
+kind: ProjectHelmChart
+metadata:
+  name: project-monitoring
+  namespace: cattle-project-p-tkgpc
+
+status:
+  dashboardValues:
+    alertmanagerURL: >-
+      https://172.234.33.183/k8s/clusters/c-m-mhqtw2cs/api/v1/namespaces/cattle-project-p-tkgpc-monitoring/services/http:cattle-project-p-tkgpc-mon-alertmanager:9093/proxy
+    grafanaURL: >-
+      https://172.234.33.183/k8s/clusters/c-m-mhqtw2cs/api/v1/namespaces/cattle-project-p-tkgpc-monitoring/services/http:cattle-project-p-tkgpc-monitoring-grafana:80/proxy
+    prometheusURL: >-
+      https://172.234.33.183/k8s/clusters/c-m-mhqtw2cs/api/v1/namespaces/cattle-project-p-tkgpc-monitoring/services/http:cattle-project-p-tkgpc-mon-prometheus:9090/proxy
+
+*/
+
+// ListRancherProjects computes every Rancher project straight from the api
+// server, for one-off use. Prometheus objects and ChartPresets are listed
+// once for all projects. Long running servers should use an Index instead.
+func ListRancherProjects(kc client.Client) ([]rscoreapi.Project, error) {
+	var list core.NamespaceList
+	err := kc.List(context.TODO(), &list)
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]core.Namespace{}
+	for _, ns := range list.Items {
+		projectId, exists := ns.Labels[clustermeta.LabelKeyRancherFieldProjectId]
+		if !exists {
+			continue
+		}
+		groups[projectId] = append(groups[projectId], ns)
+	}
+
+	b, err := newBuilder(kc, false, URLOptions{})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]rscoreapi.Project, 0, len(groups))
+	for projectId, namespaces := range groups {
+		prj, err := b.build(projectId, namespaces)
+		if err != nil {
+			return nil, err
+		}
+		if prj != nil {
+			result = append(result, *prj)
+		}
+	}
+	return result, nil
+}
+
+// builder computes a single project from its namespaces. When indexed is
+// true, kc must be backed by a cache that has the indexes from SetupIndexes.
+// Otherwise every Prometheus and ChartPreset is listed once, on first use,
+// and shared by the projects the builder computes.
+type builder struct {
+	kc           client.Client
+	indexed      bool
+	rancher      bool
+	clusterUID   string
+	sysProjectId string
+	urls         URLOptions
+
+	promsByProject map[string][]*monitoringv1.Prometheus
+	presetsByNS    map[string][]chartsapi.ChartPreset
+}
+
+func newBuilder(kc client.Client, indexed bool, urls URLOptions) (*builder, error) {
+	b := &builder{
+		kc:      kc,
+		indexed: indexed,
+		rancher: clustermeta.IsRancherManaged(kc.RESTMapper()),
+		urls:    urls,
+	}
+	var err error
+	b.clusterUID, err = clustermeta.ClusterUID(kc)
+	if err != nil {
+		return nil, err
+	}
+	if b.rancher {
+		b.sysProjectId, _, err = clustermeta.GetSystemProjectId(kc)
+		if err != nil {
+			return nil, err
+		}
+		if err = b.detectRancherServer(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// build returns nil if the project has no user namespaces.
+func (b *builder) build(projectId string, namespaces []core.Namespace) (*rscoreapi.Project, error) {
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+
+	prj := rscoreapi.Project{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              projectId,
+			CreationTimestamp: namespaces[0].CreationTimestamp,
+			UID:               ProjectUID(b.clusterUID, projectId),
+			Labels: map[string]string{
+				clustermeta.LabelKeyRancherFieldProjectId: projectId,
+				LabelKeyClusterUID:                        b.clusterUID,
+			},
+		},
+		Spec: rscoreapi.ProjectSpec{
+			Type:       rscoreapi.ProjectUser,
+			Namespaces: nil,
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					clustermeta.LabelKeyRancherFieldProjectId: projectId,
+				},
+			},
+		},
+	}
+
+	var hasUseNs bool
+	for _, ns := range namespaces {
+		if ns.CreationTimestamp.Before(&prj.CreationTimestamp) {
+			prj.CreationTimestamp = ns.CreationTimestamp
+		}
+
+		if ns.Name == metav1.NamespaceDefault {
+			prj.Spec.Type = rscoreapi.ProjectDefault
+		} else if ns.Name == metav1.NamespaceSystem {
+			prj.Spec.Type = rscoreapi.ProjectSystem
+		}
+		prj.Spec.Namespaces = append(prj.Spec.Namespaces, ns.Name)
+
+		if !strings.HasPrefix(ns.Name, "cattle-project-p-") {
+			hasUseNs = true
+		}
+	}
+
+	// drop projects where all namespaces start with cattle-project-p
+	if !hasUseNs {
+		return nil, nil
+	}
+
+	presets, err := b.presets(&prj)
+	if err != nil {
+		return nil, err
+	}
+	prj.Spec.Presets = presets
+
+	if b.rancher {
+		err = b.monitoring(&prj)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &prj, nil
+}
+
+func (b *builder) presets(prj *rscoreapi.Project) ([]shared.SourceLocator, error) {
+	var presets []shared.SourceLocator
+	for _, ns := range prj.Spec.Namespaces {
+		if prj.Spec.Type == rscoreapi.ProjectSystem {
+			if ns == metav1.NamespaceSystem {
+				var ccps chartsapi.ClusterChartPresetList
+				err := b.kc.List(context.TODO(), &ccps)
+				if err != nil && !meta.IsNoMatchError(err) {
+					return nil, err
+				}
+				for _, x := range ccps.Items {
+					presets = append(presets, shared.SourceLocator{
+						Resource: kmapi.ResourceID{
+							Group:   chartsapi.GroupVersion.Group,
+							Version: chartsapi.GroupVersion.Version,
+							Kind:    chartsapi.ResourceKindClusterChartPreset,
+						},
+						Ref: kmapi.ObjectReference{
+							Name: x.Name,
+						},
+					})
+				}
+			}
+		} else {
+			cps, err := b.chartPresets(ns)
+			if err != nil {
+				return nil, err
+			}
+			for _, x := range cps {
+				presets = append(presets, shared.SourceLocator{
+					Resource: kmapi.ResourceID{
+						Group:   chartsapi.GroupVersion.Group,
+						Version: chartsapi.GroupVersion.Version,
+						Kind:    chartsapi.ResourceKindChartPreset,
+					},
+					Ref: kmapi.ObjectReference{
+						Name:      x.Name,
+						Namespace: x.Namespace,
+					},
+				})
+			}
+		}
+	}
+
+	sort.Slice(presets, func(i, j int) bool {
+		if presets[i].Ref.Namespace != presets[j].Ref.Namespace {
+			return presets[i].Ref.Namespace < presets[j].Ref.Namespace
+		}
+		return presets[i].Ref.Name < presets[j].Ref.Name
+	})
+	return presets, nil
+}
+
+// chartPresets returns the ChartPresets in the namespace ns.
+func (b *builder) chartPresets(ns string) ([]chartsapi.ChartPreset, error) {
+	if b.indexed {
+		var cps chartsapi.ChartPresetList
+		err := b.kc.List(context.TODO(), &cps, client.InNamespace(ns))
+		if err != nil && !meta.IsNoMatchError(err) {
+			return nil, err
+		}
+		return cps.Items, nil
+	}
+
+	if b.presetsByNS == nil {
+		var cps chartsapi.ChartPresetList
+		err := b.kc.List(context.TODO(), &cps)
+		if err != nil && !meta.IsNoMatchError(err) {
+			return nil, err
+		}
+		b.presetsByNS = map[string][]chartsapi.ChartPreset{}
+		for _, x := range cps.Items {
+			b.presetsByNS[x.Namespace] = append(b.presetsByNS[x.Namespace], x)
+		}
+	}
+	return b.presetsByNS[ns], nil
+}
+
+func (b *builder) prometheuses(projectId string) ([]*monitoringv1.Prometheus, error) {
+	if projectId != b.sysProjectId && !b.indexed {
+		if err := b.loadPrometheuses(); err != nil {
+			return nil, err
+		}
+		return b.promsByProject[projectId], nil
+	}
+
+	var promList monitoringv1.PrometheusList
+	var err error
+	if projectId == b.sysProjectId {
+		err = b.kc.List(context.TODO(), &promList, client.InNamespace(clustermeta.NamespaceRancherMonitoring))
+	} else {
+		err = b.kc.List(context.TODO(), &promList, client.MatchingFields{IndexPrometheusProjectId: projectId})
+	}
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := make([]*monitoringv1.Prometheus, 0, len(promList.Items))
+	for _, prom := range promList.Items {
+		if projectId == b.sysProjectId ||
+			(prom.Namespace != clustermeta.NamespaceRancherMonitoring && PrometheusProjectId(prom) == projectId) {
+			result = append(result, prom)
+		}
+	}
+	SortPrometheuses(result)
+	return result, nil
+}
+
+// loadPrometheuses groups every project Prometheus by the project it
+// monitors, once.
+func (b *builder) loadPrometheuses() error {
+	if b.promsByProject != nil {
+		return nil
+	}
+
+	var promList monitoringv1.PrometheusList
+	err := b.kc.List(context.TODO(), &promList)
+	if err != nil && !meta.IsNoMatchError(err) {
+		return err
+	}
+	b.promsByProject = map[string][]*monitoringv1.Prometheus{}
+	for _, prom := range promList.Items {
+		if prom.Namespace == clustermeta.NamespaceRancherMonitoring {
+			continue
+		}
+		if projectId := PrometheusProjectId(prom); projectId != "" {
+			b.promsByProject[projectId] = append(b.promsByProject[projectId], prom)
+		}
+	}
+	for _, proms := range b.promsByProject {
+		SortPrometheuses(proms)
+	}
+	return nil
+}
+
+func (b *builder) monitoring(prj *rscoreapi.Project) error {
+	projectId := prj.Name
+
+	promList, err := b.prometheuses(projectId)
+	if err != nil {
+		return err
+	}
+	delete(prj.Annotations, AnnotationKeyPrometheuses)
+	delete(prj.Annotations, AnnotationKeyAlertmanagers)
+	if len(promList) > 1 {
+		refs := make([]string, 0, len(promList)-1)
+		for _, prom := range promList[1:] {
+			refs = append(refs, prom.Namespace+"/"+prom.Name)
+		}
+		if prj.Annotations == nil {
+			prj.Annotations = map[string]string{}
+		}
+		prj.Annotations[AnnotationKeyPrometheuses] = strings.Join(refs, ",")
+	}
+	if len(promList) > 0 {
+		prom := promList[0]
+		prj.Spec.Monitoring = &rscoreapi.ProjectMonitoring{
+			PrometheusRef: &kmapi.ObjectReference{
+				Namespace: prom.Namespace,
+				Name:      prom.Name,
+			},
+		}
+
+		alertmanagers, err := FindAlertmanagersForPrometheus(b.kc, prom)
+		if err != nil {
+			return err
+		}
+		if len(alertmanagers) > 0 {
+			prj.Spec.Monitoring.AlertmanagerRef = &kmapi.ObjectReference{
+				Namespace: alertmanagers[0].Namespace,
+				Name:      alertmanagers[0].Name,
+			}
+		}
+		if len(alertmanagers) > 1 {
+			refs := make([]string, 0, len(alertmanagers))
+			for _, am := range alertmanagers {
+				refs = append(refs, am.Namespace+"/"+am.Name)
+			}
+			if prj.Annotations == nil {
+				prj.Annotations = map[string]string{}
+			}
+			prj.Annotations[AnnotationKeyAlertmanagers] = strings.Join(refs, ",")
+		}
+
+		var alertmanagerURL, grafanaURL, prometheusURL string
+		if projectId == b.sysProjectId {
+			prometheusURL = prom.Spec.ExternalURL
+			if len(alertmanagers) > 0 {
+				alertmanagerURL = alertmanagers[0].Spec.ExternalURL
+			}
+		} else {
+			alertmanagerURL, grafanaURL, prometheusURL = DetectProjectMonitoringURLs(b.kc, prom.Namespace)
+		}
+
+		amURL, gURL, pURL, err := b.monitoringURLs(prom, alertmanagers)
+		if err != nil {
+			return err
+		}
+		if b.urls.Mode == URLModeIngress {
+			alertmanagerURL, grafanaURL, prometheusURL = firstNonEmpty(amURL, alertmanagerURL), firstNonEmpty(gURL, grafanaURL), firstNonEmpty(pURL, prometheusURL)
+		} else {
+			alertmanagerURL, grafanaURL, prometheusURL = firstNonEmpty(alertmanagerURL, amURL), firstNonEmpty(grafanaURL, gURL), firstNonEmpty(prometheusURL, pURL)
+		}
+		prj.Spec.Monitoring.AlertmanagerURL = alertmanagerURL
+		prj.Spec.Monitoring.GrafanaURL = grafanaURL
+		prj.Spec.Monitoring.PrometheusURL = prometheusURL
+	}
+	return nil
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, x := range s {
+		if x != "" {
+			return x
+		}
+	}
+	return ""
+}
+
+const (
+	// AnnotationKeyPrimaryPrometheus set to "true" on a Prometheus makes it the
+	// primary Prometheus of its project, instead of the oldest one.
+	AnnotationKeyPrimaryPrometheus = "core.k8s.appscode.com/primary-prometheus"
+	// AnnotationKeyPrometheuses lists the additional Prometheuses of a project
+	// as comma separated namespace/name pairs, in order, when there is more
+	// than one. Spec.Monitoring.PrometheusRef always points to the primary.
+	AnnotationKeyPrometheuses = "core.k8s.appscode.com/prometheuses"
+)
+
+// IsPrimaryPrometheus reports whether prom is annotated as the primary Prometheus of its project.
+func IsPrimaryPrometheus(prom *monitoringv1.Prometheus) bool {
+	return prom.Annotations[AnnotationKeyPrimaryPrometheus] == "true"
+}
+
+// SortPrometheuses orders the Prometheuses of a project with the primary
+// first: the ones annotated as primary, then the oldest, then by namespace
+// and name.
+func SortPrometheuses(proms []*monitoringv1.Prometheus) {
+	sort.Slice(proms, func(i, j int) bool {
+		if pi, pj := IsPrimaryPrometheus(proms[i]), IsPrimaryPrometheus(proms[j]); pi != pj {
+			return pi
+		}
+		if !proms[i].CreationTimestamp.Equal(&proms[j].CreationTimestamp) {
+			return proms[i].CreationTimestamp.Before(&proms[j].CreationTimestamp)
+		}
+		if proms[i].Namespace != proms[j].Namespace {
+			return proms[i].Namespace < proms[j].Namespace
+		}
+		return proms[i].Name < proms[j].Name
+	})
+}
+
+// ProjectPrometheuses returns every Prometheus in the Rancher project
+// monitored by prom, including prom, with the primary first. It returns nil
+// if the cluster is not managed by Rancher or prom is not a project Prometheus.
+func ProjectPrometheuses(kc client.Client, prom *monitoringv1.Prometheus) ([]*monitoringv1.Prometheus, error) {
+	if !clustermeta.IsRancherManaged(kc.RESTMapper()) {
+		return nil, nil
+	}
+	b := &builder{kc: kc}
+	var err error
+	b.sysProjectId, _, err = clustermeta.GetSystemProjectId(kc)
+	if err != nil {
+		return nil, err
+	}
+
+	projectId := PrometheusProjectId(prom)
+	if prom.Namespace == clustermeta.NamespaceRancherMonitoring {
+		projectId = b.sysProjectId
+	}
+	if projectId == "" {
+		return nil, nil
+	}
+	return b.prometheuses(projectId)
+}
+
+// LabelKeyClusterUID records the UID of the cluster a project belongs to.
+// Together with the project UID it identifies a project across clusters.
+const LabelKeyClusterUID = "core.k8s.appscode.com/cluster-uid"
+
+// ProjectUID derives the UID of a project from the cluster UID and the
+// project id, so it stays the same across restarts and for every replica.
+func ProjectUID(clusterUID, projectId string) types.UID {
+	space, err := uuid.Parse(clusterUID)
+	if err != nil {
+		space = uuid.NewSHA1(uuid.NameSpaceOID, []byte(clusterUID))
+	}
+	return types.UID(uuid.NewSHA1(space, []byte(projectId)).String())
+}
+
+// PrometheusProjectId returns the Rancher project monitored by a project Prometheus.
+func PrometheusProjectId(prom *monitoringv1.Prometheus) string {
+	if prom.Spec.ServiceMonitorNamespaceSelector != nil {
+		return prom.Spec.ServiceMonitorNamespaceSelector.MatchLabels[clustermeta.LabelKeyRancherHelmProjectId]
+	}
+	return ""
+}
+
+// AnnotationKeyAlertmanagers lists every Alertmanager used by the project
+// Prometheus as comma separated namespace/name pairs, when there is more than
+// one. Spec.Monitoring.AlertmanagerRef always points to the first of them.
+const AnnotationKeyAlertmanagers = "core.k8s.appscode.com/alertmanagers"
+
+// FindAlertmanagersForPrometheus follows the Services in
+// prom.spec.alerting.alertmanagers back to the Alertmanagers whose pods they
+// select. Services may live in any namespace. Missing Services are skipped,
+// so the result is empty if nothing can be resolved.
+func FindAlertmanagersForPrometheus(kc client.Client, prom *monitoringv1.Prometheus) ([]*monitoringv1.Alertmanager, error) {
+	if prom.Spec.Alerting == nil {
+		return nil, nil
+	}
+	_, err := kc.RESTMapper().RESTMapping(schema.GroupKind{
+		Group: monitoring.GroupName,
+		Kind:  monitoringv1.AlertmanagersKind,
+	}, monitoringv1.Version)
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	seen := map[types.NamespacedName]bool{}
+	var result []*monitoringv1.Alertmanager
+	for _, ep := range prom.Spec.Alerting.Alertmanagers {
+		ns := ep.Namespace
+		if ns == "" {
+			ns = prom.Namespace
+		}
+
+		var svc core.Service
+		err := kc.Get(context.TODO(), client.ObjectKey{Namespace: ns, Name: ep.Name}, &svc)
+		if apierrors.IsNotFound(err) {
+			klog.Warningf("alertmanager service %s/%s used by prometheus %s/%s not found", ns, ep.Name, prom.Namespace, prom.Name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+
+		var list monitoringv1.AlertmanagerList
+		if err := kc.List(context.TODO(), &list, client.InNamespace(ns)); err != nil {
+			return nil, err
+		}
+		sel := labels.SelectorFromSet(svc.Spec.Selector)
+		for i := range list.Items {
+			am := &list.Items[i]
+			key := client.ObjectKeyFromObject(am)
+			if seen[key] || !sel.Matches(labels.Set(AlertmanagerPodLabels(am))) {
+				continue
+			}
+			seen[key] = true
+			result = append(result, am)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// AlertmanagerPodLabels returns the labels prometheus-operator sets on the pods of an Alertmanager.
+func AlertmanagerPodLabels(am *monitoringv1.Alertmanager) map[string]string {
+	result := map[string]string{}
+	if am.Spec.PodMetadata != nil {
+		for k, v := range am.Spec.PodMetadata.Labels {
+			result[k] = v
+		}
+	}
+	result["app.kubernetes.io/name"] = "alertmanager"
+	result["app.kubernetes.io/managed-by"] = "prometheus-operator"
+	result["app.kubernetes.io/instance"] = am.Name
+	result["alertmanager"] = am.Name
+	return result
+}
+
+func DetectProjectMonitoringURLs(kc client.Client, promNS string) (alertmanagerURL, grafanaURL, prometheusURL string) {
+	var prjHelm unstructured.Unstructured
+	prjHelm.SetAPIVersion("helm.cattle.io/v1alpha1")
+	prjHelm.SetKind("ProjectHelmChart")
+	key := client.ObjectKey{
+		Name:      "project-monitoring",
+		Namespace: strings.TrimSuffix(promNS, "-monitoring"),
+	}
+	err := kc.Get(context.TODO(), key, &prjHelm)
+	if err != nil {
+		return
+	}
+
+	alertmanagerURL, _, _ = unstructured.NestedString(prjHelm.UnstructuredContent(), "status", "dashboardValues", "alertmanagerURL")
+	grafanaURL, _, _ = unstructured.NestedString(prjHelm.UnstructuredContent(), "status", "dashboardValues", "grafanaURL")
+	prometheusURL, _, _ = unstructured.NestedString(prjHelm.UnstructuredContent(), "status", "dashboardValues", "prometheusURL")
+	return
+}
+
+// SchemeGroupVersion is the group-version the project apiserver serves
+// Projects under. An APIService owns a whole group-version and kube-ui-server
+// already serves v1alpha1.core.k8s.appscode.com, so the Projects, with the
+// schema of rscoreapi.Project, get a group of their own.
+var SchemeGroupVersion = schema.GroupVersion{Group: "rancher.k8s.appscode.com", Version: "v1alpha1"}
+
+var gr = schema.GroupResource{
+	Group:    SchemeGroupVersion.Group,
+	Resource: rscoreapi.ResourceProjects,
+}
+
+// GetRancherProject computes a single Rancher project straight from the api
+// server, for one-off use. Long running servers should use Index.Get instead.
+func GetRancherProject(kc client.Client, projectId string) (*rscoreapi.Project, error) {
+	var list core.NamespaceList
+	err := kc.List(context.TODO(), &list, client.MatchingLabels{
+		clustermeta.LabelKeyRancherFieldProjectId: projectId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, apierrors.NewNotFound(gr, projectId)
+	}
+
+	b, err := newBuilder(kc, false, URLOptions{})
+	if err != nil {
+		return nil, err
+	}
+	prj, err := b.build(projectId, list.Items)
+	if err != nil {
+		return nil, err
+	}
+	if prj == nil {
+		return nil, apierrors.NewNotFound(gr, projectId)
+	}
+	return prj, nil
+}
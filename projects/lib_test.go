@@ -0,0 +1,40 @@
+package projects
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const testClusterUID = "2b6a5c9e-3f1d-4a8e-9c7b-1d2e3f4a5b6c"
+
+func TestProjectUID(t *testing.T) {
+	// the uid must never change for a project, clients key on it
+	tests := []struct {
+		clusterUID string
+		projectId  string
+		want       types.UID
+	}{
+		{testClusterUID, "p-abc12", "c5632cae-d150-556c-812e-207e82b6a9c9"},
+		{"local", "p-abc12", "686de139-6906-5455-8f10-dc6b3129e54e"},
+	}
+	for _, tt := range tests {
+		if got := ProjectUID(tt.clusterUID, tt.projectId); got != tt.want {
+			t.Errorf("ProjectUID(%q, %q) = %s, want %s", tt.clusterUID, tt.projectId, got, tt.want)
+		}
+	}
+}
+
+func TestProjectUIDUnique(t *testing.T) {
+	uids := map[types.UID]string{}
+	for _, clusterUID := range []string{testClusterUID, "3c7b6d0f-4e2e-4b9f-8d8c-2e3f4a5b6c7d", "local"} {
+		for _, projectId := range []string{"p-abc12", "p-abc13", "default"} {
+			uid := ProjectUID(clusterUID, projectId)
+			key := clusterUID + "/" + projectId
+			if other, found := uids[uid]; found {
+				t.Errorf("%s and %s have the same uid %s", key, other, uid)
+			}
+			uids[uid] = key
+		}
+	}
+}
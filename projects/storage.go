@@ -0,0 +1,283 @@
+package projects
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog/v2"
+	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+)
+
+const (
+	// number of events kept around so that watches can resume from an older resourceVersion
+	historySize = 256
+	// number of events buffered per watcher before it is considered too slow and closed
+	watcherBufferSize = 100
+)
+
+// Storage keeps the current set of Rancher projects in memory and serves
+// get, list and watch on them. Every change applied to it bumps a
+// monotonically increasing resourceVersion, so clients can resume watches
+// and informers see stable objects between changes.
+type Storage struct {
+	mu       sync.RWMutex
+	rv       uint64
+	items    map[string]*rscoreapi.Project
+	history  []watch.Event
+	watchers map[int]*watcher
+	nextID   int
+}
+
+func NewStorage() *Storage {
+	return &Storage{
+		items:    map[string]*rscoreapi.Project{},
+		watchers: map[int]*watcher{},
+	}
+}
+
+// Apply records the new state of a project and emits a watch event if it
+// changed. A nil prj deletes the project. Apply has the signature expected
+// by Index.AddHandler.
+func (s *Storage) Apply(name string, prj *rscoreapi.Project) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := s.items[name]
+	if prj == nil {
+		if !exists {
+			return
+		}
+		s.rv++
+		obj := old.DeepCopy()
+		obj.ResourceVersion = strconv.FormatUint(s.rv, 10)
+		delete(s.items, name)
+		s.emit(watch.Event{Type: watch.Deleted, Object: obj})
+		return
+	}
+
+	prj = prj.DeepCopy()
+	if exists {
+		// the oldest namespace may have been moved out of the project
+		if old.CreationTimestamp.Before(&prj.CreationTimestamp) {
+			prj.CreationTimestamp = old.CreationTimestamp
+		}
+		if apiequality.Semantic.DeepEqual(old.Labels, prj.Labels) &&
+			apiequality.Semantic.DeepEqual(old.Annotations, prj.Annotations) &&
+			apiequality.Semantic.DeepEqual(old.Spec, prj.Spec) {
+			return
+		}
+	}
+
+	s.rv++
+	prj.TypeMeta = metav1.TypeMeta{
+		APIVersion: SchemeGroupVersion.String(),
+		Kind:       rscoreapi.ResourceKindProject,
+	}
+	prj.ResourceVersion = strconv.FormatUint(s.rv, 10)
+	s.items[name] = prj
+
+	if exists {
+		s.emit(watch.Event{Type: watch.Modified, Object: prj.DeepCopy()})
+	} else {
+		s.emit(watch.Event{Type: watch.Added, Object: prj.DeepCopy()})
+	}
+}
+
+// emit must be called with s.mu held.
+func (s *Storage) emit(e watch.Event) {
+	s.history = append(s.history, e)
+	if len(s.history) > historySize {
+		s.history = s.history[len(s.history)-historySize:]
+	}
+	for id, w := range s.watchers {
+		if !w.send(e) {
+			klog.Warningf("closing slow project watcher %d", id)
+			delete(s.watchers, id)
+			w.close()
+		}
+	}
+}
+
+func (s *Storage) Get(name string) (*rscoreapi.Project, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prj, found := s.items[name]
+	if !found {
+		return nil, apierrors.NewNotFound(gr, name)
+	}
+	return prj.DeepCopy(), nil
+}
+
+func (s *Storage) List(opts ListOptions) *rscoreapi.ProjectList {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := &rscoreapi.ProjectList{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: SchemeGroupVersion.String(),
+			Kind:       rscoreapi.ResourceKindProject + "List",
+		},
+		ListMeta: metav1.ListMeta{
+			ResourceVersion: strconv.FormatUint(s.rv, 10),
+		},
+		Items: make([]rscoreapi.Project, 0, len(s.items)),
+	}
+	for _, prj := range s.items {
+		if opts.Matches(prj) {
+			list.Items = append(list.Items, *prj.DeepCopy())
+		}
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	return list
+}
+
+// Watch streams changes after resourceVersion. An empty or "0"
+// resourceVersion starts with a synthetic ADDED event for every existing
+// project. A resourceVersion that is older than the retained history
+// returns a 410 Gone error, so the client has to list again.
+func (s *Storage) Watch(ctx context.Context, resourceVersion string, opts ListOptions) (watch.Interface, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var initial []watch.Event
+	if resourceVersion == "" || resourceVersion == "0" {
+		names := make([]string, 0, len(s.items))
+		for name := range s.items {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			initial = append(initial, watch.Event{Type: watch.Added, Object: s.items[name].DeepCopy()})
+		}
+	} else {
+		rv, err := strconv.ParseUint(resourceVersion, 10, 64)
+		if err != nil {
+			return nil, apierrors.NewBadRequest("invalid resourceVersion " + resourceVersion)
+		}
+		if rv > s.rv {
+			return nil, apierrors.NewTimeoutError("too large resource version "+resourceVersion, 1)
+		}
+		if rv < s.rv && (len(s.history) == 0 || rv+1 < eventRV(s.history[0])) {
+			return nil, apierrors.NewResourceExpired("too old resource version " + resourceVersion)
+		}
+		for _, e := range s.history {
+			if eventRV(e) > rv {
+				initial = append(initial, e)
+			}
+		}
+	}
+
+	id := s.nextID
+	s.nextID++
+	w := newWatcher(opts, len(initial))
+	for _, e := range initial {
+		w.send(e)
+	}
+	s.watchers[id] = w
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.done:
+		}
+		s.stopWatcher(id)
+	}()
+	return w, nil
+}
+
+func (s *Storage) stopWatcher(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w, found := s.watchers[id]; found {
+		delete(s.watchers, id)
+		w.close()
+	}
+}
+
+func eventRV(e watch.Event) uint64 {
+	rv, _ := strconv.ParseUint(e.Object.(*rscoreapi.Project).ResourceVersion, 10, 64)
+	return rv
+}
+
+// ListOptions filters projects by label and by metadata.name field selectors.
+type ListOptions struct {
+	LabelSelector labels.Selector
+	FieldSelector fields.Selector
+}
+
+func (opts ListOptions) Matches(prj *rscoreapi.Project) bool {
+	if opts.LabelSelector != nil && !opts.LabelSelector.Matches(labels.Set(prj.Labels)) {
+		return false
+	}
+	if opts.FieldSelector != nil && !opts.FieldSelector.Matches(fields.Set{"metadata.name": prj.Name}) {
+		return false
+	}
+	return true
+}
+
+type watcher struct {
+	opts      ListOptions
+	result    chan watch.Event
+	done      chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+var _ watch.Interface = &watcher{}
+
+func newWatcher(opts ListOptions, initial int) *watcher {
+	return &watcher{
+		opts:   opts,
+		result: make(chan watch.Event, watcherBufferSize+initial),
+		done:   make(chan struct{}),
+	}
+}
+
+// send returns false if the watcher buffer is full. It must be called with
+// Storage.mu held.
+func (w *watcher) send(e watch.Event) bool {
+	if !w.opts.Matches(e.Object.(*rscoreapi.Project)) {
+		return true
+	}
+	select {
+	case <-w.done:
+		return true
+	default:
+	}
+	select {
+	case w.result <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// close must be called with Storage.mu held, so that it never races with send.
+func (w *watcher) close() {
+	w.Stop()
+	w.closeOnce.Do(func() {
+		close(w.result)
+	})
+}
+
+func (w *watcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *watcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
@@ -0,0 +1,151 @@
+package projects
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	rscoreapi "kmodules.xyz/resource-metadata/apis/core/v1alpha1"
+)
+
+func newProject(name string, labels map[string]string) *rscoreapi.Project {
+	return &rscoreapi.Project{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+}
+
+func nextEvent(t *testing.T, w watch.Interface) watch.Event {
+	t.Helper()
+	select {
+	case e, ok := <-w.ResultChan():
+		if !ok {
+			t.Fatal("watch closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for watch event")
+	}
+	return watch.Event{}
+}
+
+func expectEvent(t *testing.T, w watch.Interface, typ watch.EventType, name, rv string) {
+	t.Helper()
+	e := nextEvent(t, w)
+	prj := e.Object.(*rscoreapi.Project)
+	if e.Type != typ || prj.Name != name || prj.ResourceVersion != rv {
+		t.Fatalf("got %s %s@%s, want %s %s@%s", e.Type, prj.Name, prj.ResourceVersion, typ, name, rv)
+	}
+}
+
+func TestStorageApply(t *testing.T) {
+	s := NewStorage()
+
+	s.Apply("p-1", newProject("p-1", map[string]string{"a": "1"}))
+	s.Apply("p-1", newProject("p-1", map[string]string{"a": "1"}))
+	if rv := s.List(ListOptions{}).ResourceVersion; rv != "1" {
+		t.Errorf("unchanged apply bumped resourceVersion to %s", rv)
+	}
+
+	s.Apply("p-1", newProject("p-1", map[string]string{"a": "2"}))
+	prj, err := s.Get("p-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prj.ResourceVersion != "2" || prj.Kind != rscoreapi.ResourceKindProject {
+		t.Errorf("got %s@%s, want %s@2", prj.Kind, prj.ResourceVersion, rscoreapi.ResourceKindProject)
+	}
+
+	s.Apply("p-1", nil)
+	if _, err := s.Get("p-1"); !apierrors.IsNotFound(err) {
+		t.Errorf("got %v, want NotFound", err)
+	}
+	if rv := s.List(ListOptions{}).ResourceVersion; rv != "3" {
+		t.Errorf("delete resourceVersion = %s, want 3", rv)
+	}
+}
+
+func TestStorageWatch(t *testing.T) {
+	s := NewStorage()
+	s.Apply("p-2", newProject("p-2", nil))
+	s.Apply("p-1", newProject("p-1", nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// "0" starts with every existing project, sorted by name
+	w, err := s.Watch(ctx, "0", ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, watch.Added, "p-1", "2")
+	expectEvent(t, w, watch.Added, "p-2", "1")
+
+	s.Apply("p-1", newProject("p-1", map[string]string{"a": "1"}))
+	expectEvent(t, w, watch.Modified, "p-1", "3")
+	s.Apply("p-2", nil)
+	expectEvent(t, w, watch.Deleted, "p-2", "4")
+
+	// resuming replays only the events after the resourceVersion
+	w2, err := s.Watch(ctx, "2", ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w2, watch.Modified, "p-1", "3")
+	expectEvent(t, w2, watch.Deleted, "p-2", "4")
+
+	// resuming at the current resourceVersion waits for new events
+	w3, err := s.Watch(ctx, "4", ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Apply("p-3", newProject("p-3", nil))
+	expectEvent(t, w3, watch.Added, "p-3", "5")
+
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-w.ResultChan():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("watch not closed after the context was cancelled")
+		}
+	}
+}
+
+func TestStorageWatchResourceVersion(t *testing.T) {
+	s := NewStorage()
+	for i := 0; i < historySize+10; i++ {
+		s.Apply("p-1", newProject("p-1", map[string]string{"i": strconv.Itoa(i)}))
+	}
+
+	tests := []struct {
+		rv    string
+		check func(error) bool
+	}{
+		{"1", apierrors.IsResourceExpired},
+		{"9", apierrors.IsResourceExpired},
+		{"x", apierrors.IsBadRequest},
+		{strconv.Itoa(historySize + 11), apierrors.IsTimeout},
+		{"10", func(err error) bool { return err == nil }},
+		{strconv.Itoa(historySize + 10), func(err error) bool { return err == nil }},
+	}
+	for _, tt := range tests {
+		w, err := s.Watch(context.Background(), tt.rv, ListOptions{})
+		if !tt.check(err) {
+			t.Errorf("Watch(%s) returned error %v", tt.rv, err)
+		}
+		if w != nil {
+			w.Stop()
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package projects
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	clustermeta "kmodules.xyz/client-go/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type URLMode string
+
+const (
+	// URLModeProxy links to services through the Rancher server cluster proxy,
+	// the same way Rancher fills ProjectHelmChart.status.dashboardValues.
+	URLModeProxy URLMode = "proxy"
+	// URLModeIngress links to services through the Ingresses that route to them.
+	URLModeIngress URLMode = "ingress"
+)
+
+// URLOptions configures how project monitoring URLs are computed. Empty
+// ServerURL and ClusterID are detected from the rancher-monitoring Prometheus
+// external url.
+type URLOptions struct {
+	Mode      URLMode
+	ServerURL string
+	ClusterID string
+}
+
+// https://172.234.33.183/k8s/clusters/c-m-mhqtw2cs/api/v1/namespaces/...
+var rancherProxyURL = regexp.MustCompile(`^(https?://[^/]+(?:/.*?)?)/k8s/clusters/([^/]+)/`)
+
+func (o URLOptions) proxyBase() string {
+	if o.ServerURL == "" || o.ClusterID == "" {
+		return ""
+	}
+	return strings.TrimSuffix(o.ServerURL, "/") + "/k8s/clusters/" + o.ClusterID
+}
+
+func (b *builder) detectRancherServer() error {
+	if b.urls.ServerURL != "" && b.urls.ClusterID != "" {
+		return nil
+	}
+
+	var promList monitoringv1.PrometheusList
+	err := b.kc.List(context.TODO(), &promList, client.InNamespace(clustermeta.NamespaceRancherMonitoring))
+	if meta.IsNoMatchError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, prom := range promList.Items {
+		m := rancherProxyURL.FindStringSubmatch(prom.Spec.ExternalURL)
+		if m == nil {
+			continue
+		}
+		if b.urls.ServerURL == "" {
+			b.urls.ServerURL = m[1]
+		}
+		if b.urls.ClusterID == "" {
+			b.urls.ClusterID = m[2]
+		}
+		break
+	}
+	return nil
+}
+
+// monitoringURLs synthesizes the monitoring URLs from the Services in front of
+// prom, the first of its alertmanagers and the Grafana next to prom. URLs
+// that can't be computed are left empty.
+func (b *builder) monitoringURLs(prom *monitoringv1.Prometheus, alertmanagers []*monitoringv1.Alertmanager) (alertmanagerURL, grafanaURL, prometheusURL string, err error) {
+	svc, err := b.findService(prom.Namespace, func(svc *core.Service) bool {
+		return Selects(svc, PrometheusPodLabels(prom))
+	})
+	if err != nil {
+		return
+	}
+	if prometheusURL, err = b.serviceURL(svc); err != nil {
+		return
+	}
+
+	if len(alertmanagers) > 0 {
+		am := alertmanagers[0]
+		svc, err = b.findService(am.Namespace, func(svc *core.Service) bool {
+			return Selects(svc, AlertmanagerPodLabels(am))
+		})
+		if err != nil {
+			return
+		}
+		if alertmanagerURL, err = b.serviceURL(svc); err != nil {
+			return
+		}
+	}
+
+	svc, err = b.findService(prom.Namespace, func(svc *core.Service) bool {
+		return svc.Labels["app.kubernetes.io/name"] == "grafana" ||
+			svc.Spec.Selector["app.kubernetes.io/name"] == "grafana"
+	})
+	if err != nil {
+		return
+	}
+	grafanaURL, err = b.serviceURL(svc)
+	return
+}
+
+// findService returns the first non-headless Service in ns, by name, accepted by fn.
+func (b *builder) findService(ns string, fn func(svc *core.Service) bool) (*core.Service, error) {
+	var list core.ServiceList
+	err := b.kc.List(context.TODO(), &list, client.InNamespace(ns))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	for i := range list.Items {
+		svc := &list.Items[i]
+		if svc.Spec.ClusterIP == core.ClusterIPNone || len(svc.Spec.Ports) == 0 {
+			continue
+		}
+		if fn(svc) {
+			return svc, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *builder) serviceURL(svc *core.Service) (string, error) {
+	if svc == nil {
+		return "", nil
+	}
+	if b.urls.Mode == URLModeIngress {
+		u, err := b.ingressURL(svc)
+		if err != nil || u != "" {
+			return u, err
+		}
+	}
+
+	base := b.urls.proxyBase()
+	if base == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/services/http:%s:%d/proxy", base, svc.Namespace, svc.Name, webPort(svc).Port), nil
+}
+
+// ingressURL returns the url of the first Ingress rule that routes to svc.
+func (b *builder) ingressURL(svc *core.Service) (string, error) {
+	var list networkingv1.IngressList
+	err := b.kc.List(context.TODO(), &list, client.InNamespace(svc.Namespace))
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	for _, ing := range list.Items {
+		for _, rule := range ing.Spec.Rules {
+			if rule.Host == "" || rule.HTTP == nil {
+				continue
+			}
+			for _, p := range rule.HTTP.Paths {
+				if p.Backend.Service == nil || p.Backend.Service.Name != svc.Name {
+					continue
+				}
+				scheme := "http"
+				for _, tls := range ing.Spec.TLS {
+					if contains(tls.Hosts, rule.Host) {
+						scheme = "https"
+					}
+				}
+				return scheme + "://" + rule.Host + strings.TrimSuffix(p.Path, "/"), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func webPort(svc *core.Service) core.ServicePort {
+	for _, name := range []string{"http-web", "web", "http", "service"} {
+		for _, p := range svc.Spec.Ports {
+			if p.Name == name {
+				return p
+			}
+		}
+	}
+	return svc.Spec.Ports[0]
+}
+
+func Selects(svc *core.Service, podLabels map[string]string) bool {
+	return len(svc.Spec.Selector) > 0 &&
+		labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(podLabels))
+}
+
+// PrometheusPodLabels returns the labels prometheus-operator sets on the pods of a Prometheus.
+func PrometheusPodLabels(prom *monitoringv1.Prometheus) map[string]string {
+	result := map[string]string{}
+	if prom.Spec.PodMetadata != nil {
+		for k, v := range prom.Spec.PodMetadata.Labels {
+			result[k] = v
+		}
+	}
+	result["app.kubernetes.io/name"] = "prometheus"
+	result["app.kubernetes.io/managed-by"] = "prometheus-operator"
+	result["app.kubernetes.io/instance"] = prom.Name
+	result["prometheus"] = prom.Name
+	return result
+}
+
+func contains(arr []string, x string) bool {
+	for _, s := range arr {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
@@ -1,4 +1,4 @@
-package main
+package quota
 
 import (
 	"context"
@@ -21,8 +21,6 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/discovery"
-	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/klog/v2/klogr"
 	"kmodules.xyz/apiversion"
 	clustermeta "kmodules.xyz/client-go/cluster"
 	"kmodules.xyz/resource-metadata/apis/management/v1alpha1"
@@ -30,84 +28,8 @@ import (
 	"kmodules.xyz/resource-metrics/api"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
-	"sigs.k8s.io/yaml"
 )
 
-func NewClient() (discovery.DiscoveryInterface, client.Client, error) {
-	scheme := runtime.NewScheme()
-	_ = clientgoscheme.AddToScheme(scheme)
-	_ = v1alpha1.AddToScheme(scheme)
-
-	ctrl.SetLogger(klogr.New())
-	cfg := ctrl.GetConfigOrDie()
-	cfg.QPS = 100
-	cfg.Burst = 100
-
-	disc, err := discovery.NewDiscoveryClientForConfig(cfg)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	mapper, err := apiutil.NewDynamicRESTMapper(cfg)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	kc, err := client.New(cfg, client.Options{
-		Scheme: scheme,
-		Mapper: mapper,
-		//Opts: client.WarningHandlerOptions{
-		//	SuppressWarnings:   false,
-		//	AllowDuplicateLogs: false,
-		//},
-	})
-	return disc, kc, err
-}
-
-func main() {
-	if err := useKubebuilderClient(); err != nil {
-		panic(err)
-	}
-}
-
-func useKubebuilderClient() error {
-	fmt.Println("Using kubebuilder client")
-	disc, kc, err := NewClient()
-	if err != nil {
-		return err
-	}
-
-	rr := NewReconciler(kc, disc)
-	out, err := rr.Reconcile(context.TODO(), ctrl.Request{
-		NamespacedName: types.NamespacedName{
-			Name: "p-demo",
-		},
-	})
-	if err != nil {
-		return err
-	}
-	data, err := yaml.Marshal(out)
-	if err != nil {
-		return err
-	}
-	fmt.Println(string(data))
-
-	/*
-		apiTypes, err := ListKinds(disc)
-		if err != nil {
-			return err
-		}
-		data, err := yaml.Marshal(apiTypes)
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(data))
-	*/
-
-	return nil
-}
-
 // ProjectQuotaReconciler reconciles a ProjectQuota object
 type ProjectQuotaReconciler struct {
 	client.Client
@@ -332,26 +254,10 @@ func (r *ProjectQuotaReconciler) UsedQuota(ns string, typeInfo APIType) (core.Re
 			}
 
 			for _, obj := range list.Items {
-				content := obj.UnstructuredContent()
-
-				usage := core.ResourceList{}
-
-				// https://kubernetes.io/docs/concepts/policy/resource-quotas/#compute-resource-quota
-				requests, err := resourcemetrics.AppResourceRequests(content)
-				if err != nil {
-					return nil, v1alpha1.ResultError, err
-				}
-				for k, v := range requests {
-					usage["requests."+k] = v
-				}
-				limits, err := resourcemetrics.AppResourceLimits(content)
+				usage, err := ObjectUsage(obj.UnstructuredContent())
 				if err != nil {
 					return nil, v1alpha1.ResultError, err
 				}
-				for k, v := range limits {
-					usage["limits."+k] = v
-				}
-
 				used = api.AddResourceList(used, usage)
 			}
 			break
@@ -371,6 +277,29 @@ func (r *ProjectQuotaReconciler) UsedQuota(ns string, typeInfo APIType) (core.Re
 	return used, v1alpha1.ResultSuccess, nil
 }
 
+// ObjectUsage returns the resources an object of a registered type counts
+// against a quota, named like ResourceQuota does, eg. requests.cpu.
+func ObjectUsage(content map[string]interface{}) (core.ResourceList, error) {
+	usage := core.ResourceList{}
+
+	// https://kubernetes.io/docs/concepts/policy/resource-quotas/#compute-resource-quota
+	requests, err := resourcemetrics.AppResourceRequests(content)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range requests {
+		usage["requests."+k] = v
+	}
+	limits, err := resourcemetrics.AppResourceLimits(content)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range limits {
+		usage["limits."+k] = v
+	}
+	return usage, nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *ProjectQuotaReconciler) SetupWithManager(mgr ctrl.Manager) (*ProjectQuotaReconciler, error) {
 	ctrl, err := ctrl.NewControllerManagedBy(mgr).
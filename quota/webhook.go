@@ -0,0 +1,168 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"kmodules.xyz/resource-metadata/apis/management/v1alpha1"
+	"kmodules.xyz/resource-metrics/api"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+// ValidatorPath is where the ProjectQuota validating webhook is served.
+const ValidatorPath = "/validate-projectquota"
+
+// ProjectQuotaValidator denies creating or updating an object of a type with
+// a resource calculator in a project namespace, if the requests and limits of
+// the object would take the usage of the project past any of its ProjectQuota
+// limits. The usage comes from the status of the ProjectQuota, as reconciled
+// by resource-cal, so admission does not list the objects of the project.
+// That makes enforcement best-effort: objects admitted since the status was
+// last updated are not counted. The webhook fails open.
+type ProjectQuotaValidator struct {
+	kc client.Client
+}
+
+var _ admission.Handler = &ProjectQuotaValidator{}
+
+//+kubebuilder:webhook:path=/validate-projectquota,mutating=false,failurePolicy=ignore,sideEffects=None,groups="";apps;batch;kubedb.com;kubevault.com,resources=*,verbs=create;update,versions=*,name=projectquota.management.k8s.appscode.com,admissionReviewVersions=v1
+
+//+kubebuilder:rbac:groups=management.k8s.appscode.com,resources=projectquotas,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+func NewValidator(kc client.Client) *ProjectQuotaValidator {
+	return &ProjectQuotaValidator{kc: kc}
+}
+
+func (v *ProjectQuotaValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+	gvk := schema.GroupVersionKind{Group: req.Kind.Group, Version: req.Kind.Version, Kind: req.Kind.Kind}
+	if req.Namespace == "" || !api.IsRegistered(gvk) {
+		return admission.Allowed("")
+	}
+
+	key := tenancy.NamespaceLabel(v.kc)
+	if key == "" {
+		return admission.Allowed("")
+	}
+	var ns core.Namespace
+	if err := v.kc.Get(ctx, client.ObjectKey{Name: req.Namespace}, &ns); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	projectId, found := ns.Labels[key]
+	if !found {
+		return admission.Allowed("")
+	}
+
+	var pj v1alpha1.ProjectQuota
+	if err := v.kc.Get(ctx, client.ObjectKey{Name: projectId}, &pj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return admission.Allowed("")
+		}
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if !hasQuotaFor(&pj, gvk.GroupKind()) {
+		return admission.Allowed("")
+	}
+
+	requested, err := requestUsage(req.Object.Raw)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	var previous core.ResourceList
+	if req.Operation == admissionv1.Update {
+		if previous, err = requestUsage(req.OldObject.Raw); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+
+	if violations := exceeded(&pj, gvk.GroupKind(), requested, previous); len(violations) > 0 {
+		return admission.Denied(fmt.Sprintf("exceeded ProjectQuota %s: %s", pj.Name, strings.Join(violations, "; ")))
+	}
+	return admission.Allowed("")
+}
+
+func hasQuotaFor(pj *v1alpha1.ProjectQuota, gk schema.GroupKind) bool {
+	for _, q := range pj.Spec.Quotas {
+		if appliesTo(q, gk) {
+			return true
+		}
+	}
+	return false
+}
+
+func appliesTo(q v1alpha1.ResourceQuotaSpec, gk schema.GroupKind) bool {
+	return q.Group == gk.Group && (q.Kind == "" || q.Kind == gk.Kind)
+}
+
+func requestUsage(raw []byte) (core.ResourceList, error) {
+	var obj unstructured.Unstructured
+	if err := obj.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return ObjectUsage(obj.UnstructuredContent())
+}
+
+// usedFor returns the usage of the project for the quota q, as reconciled in
+// the status of pj, or nil if the status has no usage for it yet.
+func usedFor(pj *v1alpha1.ProjectQuota, q v1alpha1.ResourceQuotaSpec) core.ResourceList {
+	for _, st := range pj.Status.Quotas {
+		if st.Group == q.Group && st.Kind == q.Kind {
+			return st.Used
+		}
+	}
+	return nil
+}
+
+// exceeded returns a sorted item per limit of the quotas of pj for gk that an
+// object requesting requested, in place of previous, would exceed. The limits
+// come from the spec of pj and the usage, which includes previous, from its
+// status. Only the resources the request grows are checked, so a project
+// already past a limit can still shrink.
+func exceeded(pj *v1alpha1.ProjectQuota, gk schema.GroupKind, requested, previous core.ResourceList) []string {
+	var violations []string
+	for _, q := range pj.Spec.Quotas {
+		if !appliesTo(q, gk) {
+			continue
+		}
+		kind := q.Kind
+		if kind == "" {
+			kind = "*"
+		}
+		usage := usedFor(pj, q)
+		for name, hard := range q.Hard {
+			req := requested[name]
+			if req.Cmp(previous[name]) <= 0 {
+				continue
+			}
+			used := usage[name]
+			used.Sub(previous[name])
+			if used.Sign() < 0 {
+				used = resource.Quantity{}
+			}
+
+			projected := used.DeepCopy()
+			projected.Add(req)
+			if projected.Cmp(hard) > 0 {
+				violations = append(violations, fmt.Sprintf("%s/%s %s: requested %s, used %s, limited %s",
+					q.Group, kind, name, req.String(), used.String(), hard.String()))
+			}
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
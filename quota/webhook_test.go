@@ -0,0 +1,205 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"kmodules.xyz/resource-metadata/apis/management/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+)
+
+func deployment(cpu, memory string) []byte {
+	data, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "demo"},
+		"spec": map[string]interface{}{
+			"replicas": 2,
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name": "web",
+							"resources": map[string]interface{}{
+								"requests": map[string]interface{}{"cpu": cpu, "memory": memory},
+								"limits":   map[string]interface{}{"memory": memory},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestRequestUsage(t *testing.T) {
+	got, err := requestUsage(deployment("250m", "1Gi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := core.ResourceList{
+		"requests.cpu":    resource.MustParse("500m"),
+		"requests.memory": resource.MustParse("2Gi"),
+		"limits.memory":   resource.MustParse("2Gi"),
+	}
+	for name, q := range want {
+		if v, ok := got[name]; !ok || v.Cmp(q) != 0 {
+			t.Errorf("requestUsage()[%s] = %s, want %s", name, v.String(), q.String())
+		}
+	}
+
+	if _, err := requestUsage([]byte("{")); err == nil {
+		t.Errorf("requestUsage() of invalid json succeeded")
+	}
+}
+
+func projectQuota(hard, used core.ResourceList) *v1alpha1.ProjectQuota {
+	spec := v1alpha1.ResourceQuotaSpec{Group: "apps", Hard: hard}
+	return &v1alpha1.ProjectQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "p-demo"},
+		Spec:       v1alpha1.ProjectQuotaSpec{Quotas: []v1alpha1.ResourceQuotaSpec{spec}},
+		Status: v1alpha1.ProjectQuotaStatus{Quotas: []v1alpha1.ResourceQuotaStatus{
+			{ResourceQuotaSpec: spec, Result: v1alpha1.ResultSuccess, Used: used},
+		}},
+	}
+}
+
+func TestExceeded(t *testing.T) {
+	deploy := schema.GroupKind{Group: "apps", Kind: "Deployment"}
+	hard := core.ResourceList{
+		"limits.memory": resource.MustParse("4Gi"),
+		"requests.cpu":  resource.MustParse("2"),
+	}
+
+	cases := []struct {
+		name      string
+		pj        *v1alpha1.ProjectQuota
+		gk        schema.GroupKind
+		requested core.ResourceList
+		previous  core.ResourceList
+		want      []string
+	}{
+		{
+			name:      "within limits",
+			pj:        projectQuota(hard, core.ResourceList{"limits.memory": resource.MustParse("1Gi")}),
+			gk:        deploy,
+			requested: core.ResourceList{"limits.memory": resource.MustParse("3Gi")},
+		},
+		{
+			name: "itemized by resource",
+			pj: projectQuota(hard, core.ResourceList{
+				"limits.memory": resource.MustParse("3Gi"),
+				"requests.cpu":  resource.MustParse("1500m"),
+			}),
+			gk: deploy,
+			requested: core.ResourceList{
+				"limits.memory": resource.MustParse("2Gi"),
+				"requests.cpu":  resource.MustParse("1"),
+			},
+			want: []string{
+				"apps/* limits.memory: requested 2Gi, used 3Gi, limited 4Gi",
+				"apps/* requests.cpu: requested 1, used 1500m, limited 2",
+			},
+		},
+		{
+			name:      "update replaces previous usage",
+			pj:        projectQuota(hard, core.ResourceList{"limits.memory": resource.MustParse("3Gi")}),
+			gk:        deploy,
+			requested: core.ResourceList{"limits.memory": resource.MustParse("2Gi")},
+			previous:  core.ResourceList{"limits.memory": resource.MustParse("1Gi")},
+		},
+		{
+			name:      "shrinking past the limit",
+			pj:        projectQuota(hard, core.ResourceList{"limits.memory": resource.MustParse("8Gi")}),
+			gk:        deploy,
+			requested: core.ResourceList{"limits.memory": resource.MustParse("1Gi")},
+			previous:  core.ResourceList{"limits.memory": resource.MustParse("2Gi")},
+		},
+		{
+			name:      "other group",
+			pj:        projectQuota(hard, core.ResourceList{"limits.memory": resource.MustParse("4Gi")}),
+			gk:        schema.GroupKind{Group: "kubedb.com", Kind: "Postgres"},
+			requested: core.ResourceList{"limits.memory": resource.MustParse("1Gi")},
+		},
+		{
+			name:      "no reconciled usage",
+			pj:        &v1alpha1.ProjectQuota{Spec: v1alpha1.ProjectQuotaSpec{Quotas: []v1alpha1.ResourceQuotaSpec{{Group: "apps", Kind: "Deployment", Hard: hard}}}},
+			gk:        deploy,
+			requested: core.ResourceList{"limits.memory": resource.MustParse("5Gi")},
+			want:      []string{"apps/Deployment limits.memory: requested 5Gi, used 0, limited 4Gi"},
+		},
+		{
+			name: "limits from spec",
+			pj: func() *v1alpha1.ProjectQuota {
+				pj := projectQuota(hard, core.ResourceList{"limits.memory": resource.MustParse("3Gi")})
+				pj.Spec.Quotas[0].Hard = core.ResourceList{"limits.memory": resource.MustParse("8Gi")}
+				return pj
+			}(),
+			gk:        deploy,
+			requested: core.ResourceList{"limits.memory": resource.MustParse("2Gi")},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := exceeded(c.pj, c.gk, c.requested, c.previous); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("exceeded() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	defer func(v string) { tenancy.NamespaceLabelKey = v }(tenancy.NamespaceLabelKey)
+	tenancy.NamespaceLabelKey = "tenant"
+
+	pj := projectQuota(core.ResourceList{"limits.memory": resource.MustParse("4Gi")},
+		core.ResourceList{"limits.memory": resource.MustParse("3Gi")})
+	kc := testutil.NewFakeClient(t,
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "demo", Labels: map[string]string{"tenant": "p-demo"}}},
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "free"}},
+		pj,
+	)
+	v := NewValidator(kc)
+
+	request := func(ns string, op admissionv1.Operation, obj []byte) admission.Request {
+		return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Namespace: ns,
+			Operation: op,
+			Object:    runtime.RawExtension{Raw: obj},
+		}}
+	}
+
+	resp := v.Handle(context.TODO(), request("demo", admissionv1.Create, deployment("100m", "256Mi")))
+	if !resp.Allowed {
+		t.Errorf("Handle() of a Deployment within the quota = %+v, want allowed", resp.Result)
+	}
+	resp = v.Handle(context.TODO(), request("demo", admissionv1.Create, deployment("100m", "2Gi")))
+	if resp.Allowed || !strings.Contains(string(resp.Result.Reason), "exceeded ProjectQuota p-demo: apps/* limits.memory: requested 4Gi, used 3Gi, limited 4Gi") {
+		t.Errorf("Handle() of a Deployment past the quota = %+v, want denied", resp.Result)
+	}
+	resp = v.Handle(context.TODO(), request("free", admissionv1.Create, deployment("100m", "2Gi")))
+	if !resp.Allowed {
+		t.Errorf("Handle() outside of a project = %+v, want allowed", resp.Result)
+	}
+	resp = v.Handle(context.TODO(), request("demo", admissionv1.Delete, nil))
+	if !resp.Allowed {
+		t.Errorf("Handle() of a delete = %+v, want allowed", resp.Result)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	rbac "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	chartsapi "x-helm.dev/apimachinery/apis/charts/v1alpha1"
+
+	"github.com/tamalsaha/rancid-syncer/projects"
+	"github.com/tamalsaha/rancid-syncer/tenancy"
+	"github.com/tamalsaha/rancid-syncer/trickster"
+)
+
+// Teardown removes everything SetupClusterForPrometheus created for the
+// Prometheus at key. When dryRun is true, the objects are only listed. Only
+// objects labeled with trickster.OwnedLabels are removed, unless byName also
+// finds the ones created before they were labeled.
+//
+// When the Prometheus at key is the primary Prometheus of a project that has
+// others, the default presets are not removed: they are rewritten for the
+// next Prometheus of the project, which becomes the primary.
+//
+// RegisterPrometheus does not register the Prometheus anywhere outside the
+// cluster yet, so there is nothing to deregister.
+func Teardown(kc client.Client, key types.NamespacedName, byName, dryRun bool) error {
+	objs, err := ListSetupObjects(kc, key, byName)
+	if err != nil {
+		return err
+	}
+	successor, err := presetSuccessor(kc, key)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		gvk, err := apiutil.GVKForObject(obj, kc.Scheme())
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			fmt.Printf("%s %s\n", gvk.Kind, client.ObjectKeyFromObject(obj))
+			continue
+		}
+
+		err = kc.Delete(context.TODO(), obj)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		klog.Infof("deleted %s %s", gvk.Kind, client.ObjectKeyFromObject(obj))
+	}
+
+	if successor == nil {
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("promote Prometheus %s\n", client.ObjectKeyFromObject(successor))
+		return nil
+	}
+	return promotePresets(kc, key, successor)
+}
+
+// presetSuccessor returns the Prometheus that takes over the default presets
+// of the Prometheus at key, or nil if it is not the primary Prometheus of a
+// project with others.
+func presetSuccessor(kc client.Client, key types.NamespacedName) (*monitoringv1.Prometheus, error) {
+	var prom monitoringv1.Prometheus
+	if err := kc.Get(context.TODO(), key, &prom); err != nil {
+		return nil, err
+	}
+	proms, err := projects.ProjectPrometheuses(kc, &prom)
+	if err != nil {
+		return nil, err
+	}
+	if len(proms) < 2 || client.ObjectKeyFromObject(proms[0]) != key {
+		return nil, nil
+	}
+	return proms[1], nil
+}
+
+// promotePresets rewrites the default presets of the Prometheus at key for
+// successor. The default Prometheus hands over the ClusterChartPreset, any
+// other one the default ChartPreset of its project, which replaces the
+// ChartPreset named after successor.
+func promotePresets(kc client.Client, key types.NamespacedName, successor *monitoringv1.Prometheus) error {
+	presetBytes, err := json.Marshal(GeneratePresetForPrometheus(*successor))
+	if err != nil {
+		return err
+	}
+	if key == tenancy.DefaultPrometheusKey() {
+		return CreateClusterPreset(kc, presetBytes)
+	}
+
+	if err := CreateProjectPreset(kc, successor, presetBytes, true); err != nil {
+		return err
+	}
+	cp := chartsapi.ChartPreset{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      presetsMonitoring + "-" + successor.Name,
+			Namespace: successor.Namespace,
+		},
+	}
+	if err := kc.Delete(context.TODO(), &cp); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	klog.Infof("deleted ChartPreset %s/%s", cp.Namespace, cp.Name)
+	return nil
+}
+
+// ListSetupObjects returns the objects SetupClusterForPrometheus created for
+// the Prometheus at key, in the order they should be deleted. Objects must be
+// labeled with trickster.OwnedLabels, unless byName, which also returns the
+// ones created before they were labeled. The trickster objects shared with
+// another Prometheus in the namespace are left out, and so are the default
+// presets while another Prometheus of the project can take them over.
+func ListSetupObjects(kc client.Client, key types.NamespacedName, byName bool) ([]client.Object, error) {
+	var prom monitoringv1.Prometheus
+	if err := kc.Get(context.TODO(), key, &prom); err != nil {
+		return nil, err
+	}
+	proms, err := projects.ProjectPrometheuses(kc, &prom)
+	if err != nil {
+		return nil, err
+	}
+	primary := len(proms) == 0 || client.ObjectKeyFromObject(proms[0]) == key
+	// the default presets are promoted instead of removed
+	keepDefaultPresets := primary && len(proms) > 1
+
+	var result []client.Object
+	add := func(obj client.Object, keep func(obj client.Object) bool) error {
+		err := kc.Get(context.TODO(), client.ObjectKeyFromObject(obj), obj)
+		if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !byName && !isOwned(obj) {
+			return nil
+		}
+		if keep == nil || keep(obj) {
+			result = append(result, obj)
+		}
+		return nil
+	}
+	notShared := func(obj client.Object) bool {
+		return !ownedByOtherPrometheus(obj, key.Name)
+	}
+	objectMeta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: key.Namespace, Name: name}
+	}
+
+	// AppBindings
+	var abList appcatalog.AppBindingList
+	err = kc.List(context.TODO(), &abList, client.InNamespace(key.Namespace))
+	if err != nil && !meta.IsNoMatchError(err) {
+		return nil, err
+	}
+	isDefault := false
+	for i := range abList.Items {
+		ab := &abList.Items[i]
+		ref := ab.Spec.AppRef
+		if ref == nil || ref.Kind != "Prometheus" || ref.Name != key.Name || (ref.Namespace != "" && ref.Namespace != key.Namespace) {
+			continue
+		}
+		if !byName && !isOwned(ab) {
+			continue
+		}
+		result = append(result, ab)
+		if ab.Name == "default-prometheus" {
+			isDefault = true
+		}
+	}
+	if isDefault {
+		if err := add(&appcatalog.AppBinding{ObjectMeta: objectMeta("default-grafana")}, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// Secrets
+	shared := sharedServiceAccount(kc, key)
+	var secrets []string
+	if !shared {
+		secrets = append(secrets, trickster.KubeconfigSecretName, trickster.TokenSecretName)
+	}
+	if isDefault {
+		secrets = append(secrets, "default-grafana-auth")
+	}
+	for _, name := range secrets {
+		if err := add(&core.Secret{ObjectMeta: objectMeta(name)}, notShared); err != nil {
+			return nil, err
+		}
+	}
+
+	// presets
+	presets := []string{presetsMonitoring + "-" + key.Name}
+	if primary && !keepDefaultPresets {
+		presets = append(presets, presetsMonitoring)
+	}
+	for _, name := range presets {
+		if err := add(&chartsapi.ChartPreset{ObjectMeta: objectMeta(name)}, nil); err != nil {
+			return nil, err
+		}
+	}
+	// written by CreateTenantPresets in the namespaces of a tenant
+	var cpList chartsapi.ChartPresetList
+	err = kc.List(context.TODO(), &cpList, client.MatchingLabels{
+		labelKeyPresetPrometheusNamespace: key.Namespace,
+		labelKeyPresetPrometheusName:      key.Name,
+	})
+	if err != nil && !meta.IsNoMatchError(err) {
+		return nil, err
+	}
+	for i := range cpList.Items {
+		cp := &cpList.Items[i]
+		if cp.Namespace == key.Namespace && cp.Name == presetsMonitoring {
+			continue // already added
+		}
+		result = append(result, cp)
+	}
+	if isDefault && !keepDefaultPresets {
+		if err := add(&chartsapi.ClusterChartPreset{ObjectMeta: metav1.ObjectMeta{Name: presetsMonitoring}}, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// trickster RBAC
+	roles := []string{trickster.RoleName(&prom)}
+	if !shared {
+		roles = append(roles, trickster.ServiceAccountName)
+	}
+	for _, name := range roles {
+		if err := add(&rbac.RoleBinding{ObjectMeta: objectMeta(name)}, nil); err != nil {
+			return nil, err
+		}
+		if err := add(&rbac.Role{ObjectMeta: objectMeta(name)}, nil); err != nil {
+			return nil, err
+		}
+	}
+	if !shared {
+		if err := add(&core.ServiceAccount{ObjectMeta: objectMeta(trickster.ServiceAccountName)}, nil); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// isOwned reports whether obj carries trickster.OwnedLabels.
+func isOwned(obj client.Object) bool {
+	for k, v := range trickster.OwnedLabels {
+		if obj.GetLabels()[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sharedServiceAccount reports whether the trickster service account next to
+// the Prometheus at key is also owned by another Prometheus.
+func sharedServiceAccount(kc client.Client, key types.NamespacedName) bool {
+	var sa core.ServiceAccount
+	err := kc.Get(context.TODO(), client.ObjectKey{Namespace: key.Namespace, Name: trickster.ServiceAccountName}, &sa)
+	return err == nil && ownedByOtherPrometheus(&sa, key.Name)
+}
+
+// ownedByOtherPrometheus reports whether obj is owned by a Prometheus other
+// than the one named name.
+func ownedByOtherPrometheus(obj client.Object, name string) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Kind == monitoringv1.PrometheusesKind && ref.Name != name {
+			return true
+		}
+	}
+	return false
+}
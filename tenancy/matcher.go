@@ -0,0 +1,217 @@
+package tenancy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// LabelKeyProject tags the namespaces of a tenant whose namespace regex
+	// is too long, with the id of the tenant. The label is owned by the
+	// syncer: it is removed from namespaces that leave the tenant.
+	LabelKeyProject = "monitoring.appscode.com/project"
+
+	// LabelNameProjectID is the series label the cluster Prometheus sets
+	// from the LabelKeyProject label of the namespace of a series.
+	LabelNameProjectID = "project_id"
+)
+
+// MaxNamespaceRegexLen caps the length of a generated namespace regex. Past
+// it, series are matched by LabelNameProjectID.
+var MaxNamespaceRegexLen = 2048
+
+// ChunkedLiteralRegexes returns regexes like LiteralRegex that together match
+// exactly values, each no longer than MaxNamespaceRegexLen unless a single
+// value is.
+func ChunkedLiteralRegexes(values []string) []string {
+	var result []string
+	var chunk []string
+	size := 0
+	for _, v := range values {
+		q := regexp.QuoteMeta(v)
+		if len(chunk) > 0 && size+1+len(q) > MaxNamespaceRegexLen {
+			result = append(result, strings.Join(chunk, "|"))
+			chunk, size = nil, 0
+		}
+		if len(chunk) > 0 {
+			size++
+		}
+		chunk = append(chunk, q)
+		size += len(q)
+	}
+	if len(chunk) > 0 {
+		result = append(result, strings.Join(chunk, "|"))
+	}
+	return result
+}
+
+// ProjectIDRelabelConfigs returns the relabel configs that set
+// LabelNameProjectID to id on the series of namespaces. The namespace regexes
+// are capped by MaxNamespaceRegexLen, so a large project gets several.
+func ProjectIDRelabelConfigs(id string, namespaces []string) []*monitoringv1.RelabelConfig {
+	var configs []*monitoringv1.RelabelConfig
+	for _, regex := range ChunkedLiteralRegexes(namespaces) {
+		configs = append(configs, &monitoringv1.RelabelConfig{
+			Action:       "replace",
+			SourceLabels: []monitoringv1.LabelName{"namespace"},
+			Regex:        "(" + regex + ")",
+			TargetLabel:  LabelNameProjectID,
+			Replacement:  id,
+		})
+	}
+	return configs
+}
+
+// LiteralRegex returns a regex that matches exactly values, with every value
+// escaped. Prometheus anchors relabel and matcher regexes.
+func LiteralRegex(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, regexp.QuoteMeta(v))
+	}
+	return strings.Join(quoted, "|")
+}
+
+// Matcher selects the series of the namespaces of a tenant by the value of
+// a series label.
+type Matcher struct {
+	Label string
+	Regex string
+	// ProjectID is the tenant id matched by LabelNameProjectID, if Label is
+	// LabelNameProjectID.
+	ProjectID string
+}
+
+// PromQL returns the matcher as a PromQL label matcher, eg. namespace=~"a|b".
+func (m Matcher) PromQL() string {
+	return m.Label + "=~" + strconv.Quote(m.Regex)
+}
+
+// TenantID returns the id of the tenant of prom: the value of the tenant
+// namespace label of its namespace, or else its namespace.
+func TenantID(kc client.Client, prom *monitoringv1.Prometheus) (string, error) {
+	if key := NamespaceLabel(kc); key != "" {
+		var ns core.Namespace
+		err := kc.Get(context.TODO(), client.ObjectKey{Name: prom.Namespace}, &ns)
+		if err != nil {
+			return "", err
+		}
+		if id := ns.Labels[key]; id != "" {
+			return id, nil
+		}
+	}
+	return prom.Namespace, nil
+}
+
+// NamespaceMatcher returns the Matcher for the series of namespaces, the
+// namespaces of the tenant of prom. A series without a namespace matches if
+// withEmpty is true. While the namespace regex fits MaxNamespaceRegexLen, it
+// matches the namespace label. Past that, it tags namespaces with
+// LabelKeyProject and matches LabelNameProjectID, so the regex stays compact.
+func NamespaceMatcher(kc client.Client, prom *monitoringv1.Prometheus, namespaces []string, withEmpty bool) (Matcher, error) {
+	values := namespaces
+	if withEmpty {
+		values = append([]string{""}, values...)
+	}
+	id, err := TenantID(kc, prom)
+	if err != nil {
+		return Matcher{}, err
+	}
+	regex := LiteralRegex(values)
+	if len(regex) <= MaxNamespaceRegexLen {
+		// the tenant may have been past the cap before
+		if err := untagNamespaces(kc, id, nil); err != nil {
+			return Matcher{}, err
+		}
+		return Matcher{Label: "namespace", Regex: regex}, nil
+	}
+
+	if err := TagNamespaces(kc, namespaces, id); err != nil {
+		return Matcher{}, err
+	}
+	values = []string{id}
+	if withEmpty {
+		values = append([]string{""}, values...)
+	}
+	return Matcher{Label: LabelNameProjectID, Regex: LiteralRegex(values), ProjectID: id}, nil
+}
+
+// TagNamespaces sets the LabelKeyProject label of namespaces to id, and
+// removes it from the namespaces tagged with id that are no longer in
+// namespaces, so a namespace moved to another tenant stops matching id.
+func TagNamespaces(kc client.Client, namespaces []string, id string) error {
+	for _, name := range namespaces {
+		var ns core.Namespace
+		if err := kc.Get(context.TODO(), client.ObjectKey{Name: name}, &ns); err != nil {
+			return err
+		}
+		if ns.Labels[LabelKeyProject] == id {
+			continue
+		}
+
+		vt, err := cu.CreateOrPatch(context.TODO(), kc, &ns, func(in client.Object, createOp bool) client.Object {
+			obj := in.(*core.Namespace)
+			obj.Labels = meta_util.OverwriteKeys(obj.Labels, map[string]string{
+				LabelKeyProject: id,
+			})
+			return obj
+		})
+		if err != nil {
+			return fmt.Errorf("failed to tag namespace %s: %w", name, err)
+		}
+		klog.Infof("%s Namespace %s", vt, name)
+	}
+	return untagNamespaces(kc, id, namespaces)
+}
+
+// untagNamespaces removes the LabelKeyProject label from the namespaces
+// tagged with id that are not in keep.
+func untagNamespaces(kc client.Client, id string, keep []string) error {
+	var list core.NamespaceList
+	if err := kc.List(context.TODO(), &list, client.MatchingLabels{LabelKeyProject: id}); err != nil {
+		return err
+	}
+	keepSet := sets.NewString(keep...)
+	for i := range list.Items {
+		ns := &list.Items[i]
+		if keepSet.Has(ns.Name) {
+			continue
+		}
+
+		vt, err := cu.CreateOrPatch(context.TODO(), kc, ns, func(in client.Object, createOp bool) client.Object {
+			obj := in.(*core.Namespace)
+			delete(obj.Labels, LabelKeyProject)
+			return obj
+		})
+		if err != nil {
+			return fmt.Errorf("failed to untag namespace %s: %w", ns.Name, err)
+		}
+		klog.Infof("%s Namespace %s", vt, ns.Name)
+	}
+	return nil
+}
+
+// ProjectID returns the id of the tenant of the namespace ns: its tenant
+// namespace label, or else its LabelKeyProject label. The tenant namespace
+// label comes first, so a namespace that moved to another tenant doesn't keep
+// the id of the old one until the old tenant untags it. It returns "" if ns
+// has neither.
+func ProjectID(kc client.Client, ns *core.Namespace) string {
+	if key := NamespaceLabel(kc); key != "" {
+		if id := ns.Labels[key]; id != "" {
+			return id
+		}
+	}
+	return ns.Labels[LabelKeyProject]
+}
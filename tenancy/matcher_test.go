@@ -0,0 +1,183 @@
+package tenancy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/internal/testutil"
+)
+
+func TestLiteralRegex(t *testing.T) {
+	regex := LiteralRegex([]string{"a.b", "c", ""})
+	if want := `a\.b|c|`; regex != want {
+		t.Errorf("LiteralRegex() = %s, want %s", regex, want)
+	}
+	re := regexp.MustCompile("^(?:" + regex + ")$")
+	for v, want := range map[string]bool{"a.b": true, "axb": false, "c": true, "": true, "cc": false} {
+		if got := re.MatchString(v); got != want {
+			t.Errorf("LiteralRegex() matches %q = %v, want %v", v, got, want)
+		}
+	}
+}
+
+func TestChunkedLiteralRegexes(t *testing.T) {
+	defer func(v int) { MaxNamespaceRegexLen = v }(MaxNamespaceRegexLen)
+	MaxNamespaceRegexLen = 10
+
+	values := []string{"aaaa", "bbbb", "cccc", "d.d", "eeeeeeeeeeee"}
+	got := ChunkedLiteralRegexes(values)
+	want := []string{"aaaa|bbbb", `cccc|d\.d`, "eeeeeeeeeeee"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("ChunkedLiteralRegexes() = %v, want %v", got, want)
+	}
+	if got := ChunkedLiteralRegexes(nil); got != nil {
+		t.Errorf("ChunkedLiteralRegexes(nil) = %v, want nil", got)
+	}
+}
+
+func TestNamespaceMatcher(t *testing.T) {
+	defer func(v string) { NamespaceLabelKey = v }(NamespaceLabelKey)
+	NamespaceLabelKey = "tenant"
+	defer func(v int) { MaxNamespaceRegexLen = v }(MaxNamespaceRegexLen)
+	MaxNamespaceRegexLen = 256
+
+	prom := &monitoringv1.Prometheus{ObjectMeta: metav1.ObjectMeta{Namespace: "t1-monitoring", Name: "prom"}}
+	objs := []client.Object{
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: prom.Namespace, Labels: map[string]string{"tenant": "t1"}}},
+	}
+	var namespaces []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("t1-app-%03d", i)
+		namespaces = append(namespaces, name)
+		objs = append(objs, &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"tenant": "t1"}}})
+	}
+	kc := testutil.NewFakeClient(t, objs...)
+
+	m, err := NamespaceMatcher(kc, prom, namespaces[:2], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Matcher{Label: "namespace", Regex: "|t1-app-000|t1-app-001"}); m != want {
+		t.Errorf("NamespaceMatcher() = %+v, want %+v", m, want)
+	}
+
+	// past the cap
+	m, err = NamespaceMatcher(kc, prom, namespaces, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Matcher{Label: LabelNameProjectID, Regex: "|t1", ProjectID: "t1"}); m != want {
+		t.Errorf("NamespaceMatcher() past the cap = %+v, want %+v", m, want)
+	}
+	for _, name := range namespaces {
+		var ns core.Namespace
+		if err := kc.Get(context.TODO(), client.ObjectKey{Name: name}, &ns); err != nil {
+			t.Fatal(err)
+		}
+		if got := ns.Labels[LabelKeyProject]; got != "t1" {
+			t.Errorf("namespace %s label %s = %q, want t1", name, LabelKeyProject, got)
+		}
+		if got := ProjectID(kc, &ns); got != "t1" {
+			t.Errorf("ProjectID(%s) = %q, want t1", name, got)
+		}
+	}
+
+	configs := ProjectIDRelabelConfigs(m.ProjectID, namespaces)
+	if len(configs) < 2 {
+		t.Fatalf("ProjectIDRelabelConfigs() = %d configs, want the namespaces split past the cap", len(configs))
+	}
+	for _, c := range configs {
+		if len(c.Regex) > MaxNamespaceRegexLen+2 {
+			t.Errorf("ProjectIDRelabelConfigs() regex is %d long, past the cap %d", len(c.Regex), MaxNamespaceRegexLen)
+		}
+		if c.TargetLabel != LabelNameProjectID || c.Replacement != "t1" {
+			t.Errorf("ProjectIDRelabelConfigs() = %+v, want %s set to t1", c, LabelNameProjectID)
+		}
+	}
+}
+
+func TestNamespaceMatcherMovesNamespace(t *testing.T) {
+	defer func(v string) { NamespaceLabelKey = v }(NamespaceLabelKey)
+	NamespaceLabelKey = "tenant"
+	defer func(v int) { MaxNamespaceRegexLen = v }(MaxNamespaceRegexLen)
+	MaxNamespaceRegexLen = 256
+
+	big := &monitoringv1.Prometheus{ObjectMeta: metav1.ObjectMeta{Namespace: "t1-monitoring", Name: "prom"}}
+	small := &monitoringv1.Prometheus{ObjectMeta: metav1.ObjectMeta{Namespace: "t2-monitoring", Name: "prom"}}
+	objs := []client.Object{
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: big.Namespace, Labels: map[string]string{"tenant": "t1"}}},
+		&core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: small.Namespace, Labels: map[string]string{"tenant": "t2"}}},
+	}
+	var namespaces []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("t1-app-%03d", i)
+		namespaces = append(namespaces, name)
+		objs = append(objs, &core.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"tenant": "t1"}}})
+	}
+	kc := testutil.NewFakeClient(t, objs...)
+
+	namespace := func(name string) *core.Namespace {
+		var ns core.Namespace
+		if err := kc.Get(context.TODO(), client.ObjectKey{Name: name}, &ns); err != nil {
+			t.Fatal(err)
+		}
+		return &ns
+	}
+
+	if _, err := NamespaceMatcher(kc, big, namespaces, true); err != nil {
+		t.Fatal(err)
+	}
+	moved := namespace(namespaces[0])
+	if got := moved.Labels[LabelKeyProject]; got != "t1" {
+		t.Fatalf("namespace %s label %s = %q, want t1", moved.Name, LabelKeyProject, got)
+	}
+
+	// move the first namespace from the large project t1 to the small project t2
+	moved.Labels["tenant"] = "t2"
+	if err := kc.Update(context.TODO(), moved); err != nil {
+		t.Fatal(err)
+	}
+	if got := ProjectID(kc, namespace(moved.Name)); got != "t2" {
+		t.Errorf("ProjectID(%s) before t1 is reconciled = %q, want t2", moved.Name, got)
+	}
+
+	m, err := NamespaceMatcher(kc, big, namespaces[1:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ProjectID != "t1" {
+		t.Fatalf("NamespaceMatcher() = %+v, want the t1 project id", m)
+	}
+	if got, found := namespace(moved.Name).Labels[LabelKeyProject]; found {
+		t.Errorf("moved namespace %s keeps label %s = %q", moved.Name, LabelKeyProject, got)
+	}
+	if _, err := NamespaceMatcher(kc, small, []string{small.Namespace, moved.Name}, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := ProjectID(kc, namespace(moved.Name)); got != "t2" {
+		t.Errorf("ProjectID(%s) = %q, want t2", moved.Name, got)
+	}
+	if got := ProjectID(kc, namespace(namespaces[1])); got != "t1" {
+		t.Errorf("ProjectID(%s) = %q, want t1", namespaces[1], got)
+	}
+
+	// t1 shrinks under the cap and stops tagging
+	if _, err := NamespaceMatcher(kc, big, namespaces[1:3], true); err != nil {
+		t.Fatal(err)
+	}
+	var tagged core.NamespaceList
+	if err := kc.List(context.TODO(), &tagged, client.HasLabels{LabelKeyProject}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged.Items) != 0 {
+		t.Errorf("%d namespaces keep label %s after t1 shrank under the cap", len(tagged.Items), LabelKeyProject)
+	}
+}
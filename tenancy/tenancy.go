@@ -0,0 +1,158 @@
+package tenancy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clustermeta "kmodules.xyz/client-go/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationKeyTenantNamespaces on a Prometheus lists, comma separated, the
+// namespaces of its tenant. It overrides every other way to find them.
+const AnnotationKeyTenantNamespaces = "monitoring.appscode.com/tenant-namespaces"
+
+// The tenancy model is set once at startup. The zero value is the Rancher
+// model: the cluster Prometheus is rancher-monitoring-prometheus and every
+// project Prometheus monitors the namespaces its ServiceMonitor namespace
+// selector picks.
+var (
+	// DefaultPrometheus is the cluster Prometheus. Setting it enables
+	// multi-tenant monitoring on clusters not managed by Rancher.
+	DefaultPrometheus types.NamespacedName
+
+	// NamespaceLabelKey groups namespaces into tenants. A tenant Prometheus
+	// monitors the namespaces that share the value of this label with its own
+	// namespace. Empty uses the ServiceMonitor namespace selector of the
+	// Prometheus.
+	NamespaceLabelKey string
+)
+
+var rancherPrometheus = types.NamespacedName{
+	Namespace: clustermeta.NamespaceRancherMonitoring,
+	Name:      "rancher-monitoring-prometheus",
+}
+
+// ParsePrometheusKey parses a namespace/name reference to a Prometheus.
+func ParsePrometheusKey(s string) (types.NamespacedName, error) {
+	ns, name, ok := strings.Cut(s, "/")
+	if !ok || ns == "" || name == "" {
+		return types.NamespacedName{}, fmt.Errorf("invalid Prometheus %q, must be namespace/name", s)
+	}
+	return types.NamespacedName{Namespace: ns, Name: name}, nil
+}
+
+// Enabled reports whether the cluster runs multi-tenant monitoring: it is
+// managed by Rancher or a default Prometheus is configured.
+func Enabled(kc client.Client) bool {
+	return DefaultPrometheus.Name != "" || clustermeta.IsRancherManaged(kc.RESTMapper())
+}
+
+// DefaultPrometheusKey returns the key of the cluster Prometheus.
+func DefaultPrometheusKey() types.NamespacedName {
+	if DefaultPrometheus.Name != "" {
+		return DefaultPrometheus
+	}
+	return rancherPrometheus
+}
+
+// IsDefaultPrometheus reports whether prom is the cluster Prometheus.
+func IsDefaultPrometheus(prom *monitoringv1.Prometheus) bool {
+	return client.ObjectKeyFromObject(prom) == DefaultPrometheusKey()
+}
+
+// NamespaceLabel returns the namespace label that groups namespaces into
+// tenants, or "" if there is none.
+func NamespaceLabel(kc client.Client) string {
+	if NamespaceLabelKey != "" {
+		return NamespaceLabelKey
+	}
+	if clustermeta.IsRancherManaged(kc.RESTMapper()) {
+		return clustermeta.LabelKeyRancherFieldProjectId
+	}
+	return ""
+}
+
+// TenantNamespaces returns the sorted namespaces monitored by the tenant
+// Prometheus prom. They come from, in order, the AnnotationKeyTenantNamespaces
+// annotation of prom, the namespaces sharing the NamespaceLabelKey label with
+// the namespace of prom, or the ServiceMonitor namespace selector of prom.
+func TenantNamespaces(kc client.Client, prom *monitoringv1.Prometheus) ([]string, error) {
+	if v, ok := prom.Annotations[AnnotationKeyTenantNamespaces]; ok {
+		var namespaces []string
+		for _, ns := range strings.Split(v, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				namespaces = append(namespaces, ns)
+			}
+		}
+		sort.Strings(namespaces)
+		return namespaces, nil
+	}
+
+	if NamespaceLabelKey != "" {
+		return namespacesSharingLabel(kc, prom.Namespace, NamespaceLabelKey)
+	}
+
+	if prom.Spec.ServiceMonitorNamespaceSelector == nil {
+		// Prometheus only watches its own namespace
+		return []string{prom.Namespace}, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(prom.Spec.ServiceMonitorNamespaceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	var nsList core.NamespaceList
+	err = kc.List(context.TODO(), &nsList, client.MatchingLabelsSelector{
+		Selector: sel,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := make([]string, 0, len(nsList.Items))
+	for _, ns := range nsList.Items {
+		// skip the namespace Rancher creates for the project monitoring stack
+		if ns.Name == fmt.Sprintf("cattle-project-%s", ns.Labels[clustermeta.LabelKeyRancherFieldProjectId]) {
+			continue
+		}
+		namespaces = append(namespaces, ns.Name)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// namespacesSharingLabel returns the sorted namespaces that have the same
+// value for the label key as the namespace seedNS, or nil if seedNS does not
+// have the label.
+func namespacesSharingLabel(kc client.Client, seedNS, key string) ([]string, error) {
+	var seed core.Namespace
+	err := kc.Get(context.TODO(), client.ObjectKey{Name: seedNS}, &seed)
+	if err != nil {
+		return nil, err
+	}
+	value, found := seed.Labels[key]
+	if !found {
+		return nil, nil
+	}
+
+	var list core.NamespaceList
+	err = kc.List(context.TODO(), &list, client.MatchingLabels{
+		key: value,
+	})
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]string, 0, len(list.Items))
+	for _, ns := range list.Items {
+		namespaces = append(namespaces, ns.Name)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
@@ -0,0 +1,193 @@
+package trickster
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	rbac "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	meta_util "kmodules.xyz/client-go/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/tamalsaha/rancid-syncer/projects"
+)
+
+// ProxyServices returns the non-headless Services next to prom that trickster
+// proxies to: the ones in front of prom, its alertmanagers in the same
+// namespace and Grafana.
+func ProxyServices(kc client.Client, prom *monitoringv1.Prometheus) ([]core.Service, error) {
+	alertmanagers, err := projects.FindAlertmanagersForPrometheus(kc, prom)
+	if err != nil {
+		return nil, err
+	}
+
+	var list core.ServiceList
+	err = kc.List(context.TODO(), &list, client.InNamespace(prom.Namespace))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []core.Service
+	for _, svc := range list.Items {
+		if svc.Spec.ClusterIP == core.ClusterIPNone || len(svc.Spec.Ports) == 0 {
+			continue
+		}
+		if isProxyService(&svc, prom, alertmanagers) {
+			result = append(result, svc)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func isProxyService(svc *core.Service, prom *monitoringv1.Prometheus, alertmanagers []*monitoringv1.Alertmanager) bool {
+	if projects.Selects(svc, projects.PrometheusPodLabels(prom)) {
+		return true
+	}
+	for _, am := range alertmanagers {
+		if am.Namespace == svc.Namespace && projects.Selects(svc, projects.AlertmanagerPodLabels(am)) {
+			return true
+		}
+	}
+	return svc.Labels["app.kubernetes.io/name"] == "grafana" ||
+		svc.Spec.Selector["app.kubernetes.io/name"] == "grafana"
+}
+
+// ProxyResourceNames returns the names the api server authorizes a
+// services/proxy request against. The proxy path segment is
+// [scheme:]name[:port], where port is a port name or number.
+func ProxyResourceNames(services []core.Service) []string {
+	names := sets.NewString()
+	for _, svc := range services {
+		names.Insert(svc.Name)
+		for _, p := range svc.Spec.Ports {
+			ports := []string{strconv.Itoa(int(p.Port))}
+			if p.Name != "" {
+				ports = append(ports, p.Name)
+			}
+			for _, port := range ports {
+				for _, scheme := range []string{"", "http:", "https:"} {
+					names.Insert(scheme + svc.Name + ":" + port)
+				}
+			}
+		}
+	}
+	return names.List()
+}
+
+// RoleName returns the name of the Role and RoleBinding that grant the
+// trickster service account access to the Services of prom. Every Prometheus
+// in a namespace gets its own, as they share the service account.
+func RoleName(prom *monitoringv1.Prometheus) string {
+	return ServiceAccountName + "-" + prom.Name
+}
+
+// EnsureRBAC grants the trickster service account next to prom read access
+// to the services/proxy subresource of the Services it proxies to, and
+// nothing else. It is recomputed whenever those Services change.
+func EnsureRBAC(kc client.Client, prom *monitoringv1.Prometheus) error {
+	services, err := ProxyServices(kc, prom)
+	if err != nil {
+		return err
+	}
+	resourceNames := ProxyResourceNames(services)
+
+	ref := metav1.NewControllerRef(prom, schema.GroupVersionKind{
+		Group:   monitoring.GroupName,
+		Version: monitoringv1.Version,
+		Kind:    monitoringv1.PrometheusesKind,
+	})
+
+	role := rbac.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RoleName(prom),
+			Namespace: prom.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &role, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*rbac.Role)
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, OwnedLabels)
+
+		obj.Rules = nil
+		if len(resourceNames) > 0 {
+			// an empty resourceNames would grant access to every Service
+			obj.Rules = []rbac.PolicyRule{
+				{
+					APIGroups:     []string{""},
+					Resources:     []string{"services/proxy"},
+					ResourceNames: resourceNames,
+					Verbs:         []string{"get"},
+				},
+			}
+		}
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s role %s/%s", vt, role.Namespace, role.Name)
+
+	rb := rbac.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RoleName(prom),
+			Namespace: prom.Namespace,
+		},
+	}
+	vt, err = cu.CreateOrPatch(context.TODO(), kc, &rb, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*rbac.RoleBinding)
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, OwnedLabels)
+
+		obj.RoleRef = rbac.RoleRef{
+			APIGroup: rbac.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		}
+		obj.Subjects = []rbac.Subject{
+			{
+				Kind:      rbac.ServiceAccountKind,
+				Name:      ServiceAccountName,
+				Namespace: prom.Namespace,
+			},
+		}
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s role binding %s/%s", vt, rb.Namespace, rb.Name)
+
+	return removeSharedRBAC(kc, prom.Namespace)
+}
+
+// removeSharedRBAC deletes the Role and RoleBinding named after the service
+// account, which older versions shared between every Prometheus in ns.
+func removeSharedRBAC(kc client.Client, ns string) error {
+	key := client.ObjectKey{Namespace: ns, Name: ServiceAccountName}
+	for kind, obj := range map[string]client.Object{
+		"role binding": &rbac.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}},
+		"role":         &rbac.Role{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}},
+	} {
+		err := kc.Delete(context.TODO(), obj)
+		if err == nil {
+			klog.Infof("deleted shared %s %s", kind, key)
+		} else if !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package trickster
+
+import (
+	"reflect"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProxyResourceNames(t *testing.T) {
+	services := []core.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "prometheus"},
+			Spec: core.ServiceSpec{
+				Ports: []core.ServicePort{{Name: "web", Port: 9090}},
+			},
+		},
+	}
+	want := []string{
+		"http:prometheus:9090",
+		"http:prometheus:web",
+		"https:prometheus:9090",
+		"https:prometheus:web",
+		"prometheus",
+		"prometheus:9090",
+		"prometheus:web",
+	}
+	if got := ProxyResourceNames(services); !reflect.DeepEqual(got, want) {
+		t.Errorf("ProxyResourceNames() = %v, want %v", got, want)
+	}
+}
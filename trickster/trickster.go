@@ -0,0 +1,203 @@
+package trickster
+
+import (
+	"context"
+
+	"github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+	cu "kmodules.xyz/client-go/client"
+	core_util "kmodules.xyz/client-go/core/v1"
+	meta_util "kmodules.xyz/client-go/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ServiceAccountName   = "trickster"
+	TokenSecretName      = "trickster-token"
+	KubeconfigSecretName = "trickster-kubeconfig"
+	KubeconfigKey        = "kubeconfig"
+)
+
+// OwnedLabels is set on every object created for a Prometheus, so they can be found on teardown.
+var OwnedLabels = map[string]string{
+	meta_util.ManagedByLabelKey: "rancid-syncer",
+}
+
+// EnsureTokenSecret creates the long-lived token Secret of the trickster
+// service account. Kubernetes 1.24+ no longer creates one automatically.
+// Deleting the Secret rotates the token.
+func EnsureTokenSecret(kc client.Client, sa *core.ServiceAccount) error {
+	s := core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      TokenSecretName,
+			Namespace: sa.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &s, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Secret)
+
+		ref := metav1.NewControllerRef(sa, core.SchemeGroupVersion.WithKind("ServiceAccount"))
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, OwnedLabels)
+		obj.Annotations = meta_util.OverwriteKeys(obj.Annotations, map[string]string{
+			core.ServiceAccountNameKey: sa.Name,
+		})
+		if createOp {
+			obj.Type = core.SecretTypeServiceAccountToken
+		}
+
+		return obj
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("%s token secret %s/%s", vt, s.Namespace, s.Name)
+	return nil
+}
+
+// ReadToken returns nil data until the token Secret of the trickster service
+// account in ns is populated by the token controller.
+func ReadToken(kc client.Client, ns string) (caData, tokenData []byte, err error) {
+	var s core.Secret
+	err = kc.Get(context.TODO(), client.ObjectKey{Namespace: ns, Name: TokenSecretName}, &s)
+	if apierrors.IsNotFound(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	caData, caFound := s.Data[core.ServiceAccountRootCAKey]
+	tokenData, tokenFound := s.Data[core.ServiceAccountTokenKey]
+	if !caFound || !tokenFound {
+		return nil, nil, nil
+	}
+	return caData, tokenData, nil
+}
+
+// NewKubeconfig returns a kubeconfig that authenticates as the trickster
+// service account in ns against server.
+func NewKubeconfig(server, ns string, caData, tokenData []byte) ([]byte, error) {
+	const name = "trickster"
+	cfg := clientcmdapi.Config{
+		Clusters: map[string]*clientcmdapi.Cluster{
+			name: {
+				Server:                   server,
+				CertificateAuthorityData: caData,
+			},
+		},
+		AuthInfos: map[string]*clientcmdapi.AuthInfo{
+			name: {
+				Token: string(tokenData),
+			},
+		},
+		Contexts: map[string]*clientcmdapi.Context{
+			name: {
+				Cluster:   name,
+				AuthInfo:  name,
+				Namespace: ns,
+			},
+		},
+		CurrentContext: name,
+	}
+	return clientcmd.Write(cfg)
+}
+
+// EnsureKubeconfigSecret stores the kubeconfig for the trickster service
+// account sa. Every Prometheus in the namespace of sa shares it. It is
+// rewritten whenever the token changes.
+func EnsureKubeconfigSecret(kc client.Client, server string, sa *core.ServiceAccount, caData, tokenData []byte) (*core.Secret, error) {
+	data, err := NewKubeconfig(server, sa.Namespace, caData, tokenData)
+	if err != nil {
+		return nil, err
+	}
+
+	s := core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeconfigSecretName,
+			Namespace: sa.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &s, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.Secret)
+
+		ref := metav1.NewControllerRef(sa, core.SchemeGroupVersion.WithKind("ServiceAccount"))
+		obj.OwnerReferences = []metav1.OwnerReference{*ref}
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, OwnedLabels)
+
+		obj.Type = core.SecretTypeOpaque
+		obj.Data = map[string][]byte{
+			KubeconfigKey: data,
+		}
+
+		return obj
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("%s kubeconfig secret %s/%s", vt, s.Namespace, s.Name)
+	return &s, nil
+}
+
+// EnsureServiceAccount creates the trickster service account next to prom.
+// Every Prometheus set up in the namespace shares it and is one of its
+// owners, so it is removed with the last of them.
+func EnsureServiceAccount(kc client.Client, prom *monitoringv1.Prometheus) (*core.ServiceAccount, error) {
+	sa := core.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ServiceAccountName,
+			Namespace: prom.Namespace,
+		},
+	}
+	vt, err := cu.CreateOrPatch(context.TODO(), kc, &sa, func(in client.Object, createOp bool) client.Object {
+		obj := in.(*core.ServiceAccount)
+
+		ref := core_util.NewOwnerRef(prom, schema.GroupVersionKind{
+			Group:   monitoring.GroupName,
+			Version: monitoringv1.Version,
+			Kind:    monitoringv1.PrometheusesKind,
+		})
+		core_util.EnsureOwnerReference(obj, ref)
+		obj.Labels = meta_util.OverwriteKeys(obj.Labels, OwnedLabels)
+
+		return obj
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("%s service account %s/%s", vt, sa.Namespace, sa.Name)
+	return &sa, nil
+}
+
+// PrometheusesForServiceAccount returns every Prometheus that owns the
+// trickster service account in ns.
+func PrometheusesForServiceAccount(kc client.Client, ns string) ([]*monitoringv1.Prometheus, error) {
+	var sa core.ServiceAccount
+	err := kc.Get(context.TODO(), client.ObjectKey{Namespace: ns, Name: ServiceAccountName}, &sa)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*monitoringv1.Prometheus
+	for _, ref := range sa.OwnerReferences {
+		if ref.Kind != monitoringv1.PrometheusesKind {
+			continue
+		}
+		var prom monitoringv1.Prometheus
+		err = kc.Get(context.TODO(), types.NamespacedName{Namespace: ns, Name: ref.Name}, &prom)
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result = append(result, &prom)
+	}
+	return result, nil
+}